@@ -1,23 +1,27 @@
 package aof
 
 import (
+	"bytes"
+	"fmt"
 	"goredis/config"
 	databaseface "goredis/interface/database"
 	"goredis/lib/logger"
 	"goredis/lib/utils"
-	"goredis/resp/connection"
-	"goredis/resp/parser"
 	"goredis/resp/reply"
-	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 )
 
 type CmdLine = [][]byte
 
 const (
 	aofQueueSize = 1 << 16 //避免魔法值 65535
+
+	defaultAofFilename = "appendonly.aof"
+	defaultAofDirname  = "appendonlydir"
 )
 
 type payload struct {
@@ -26,22 +30,53 @@ type payload struct {
 }
 
 type AofHandler struct {
-	db          databaseface.Database //Redis核心
-	aofChan     chan *payload         //写文件的一个缓冲区，文件要落入到硬盘中，速度较慢，需要加Chan
-	aofFile     *os.File              //后期读取appendonly.aof文件
-	aofFilename string
+	db          databaseface.DBEngine        //Redis核心
+	tmpDBMaker  func() databaseface.DBEngine //重写时用于重放旧文件的临时数据库
+	aofChan     chan *payload                //写文件的一个缓冲区，文件要落入到硬盘中，速度较慢，需要加Chan
+	aofFile     *os.File                     //当前正在追加的 incr 文件
+	aofDirname  string                       //存放 base、incr 文件和清单的目录
+	aofFilename string                       //文件名前缀
+	manifest    *aofManifest                 //当前生效的文件清单
 	aofFinished chan struct{}
 	pausingAof  sync.RWMutex
+	rewriteLock sync.Mutex //同一时间只允许一个重写任务
+	closeOnce   sync.Once
 	currentDB   int //记录指令保存到那个DB
 }
 
 // NewAOFHandler 新建handler
-func NewAOFHandler(db databaseface.Database) (*AofHandler, error) {
+func NewAOFHandler(db databaseface.DBEngine, tmpDBMaker func() databaseface.DBEngine) (*AofHandler, error) {
 	handler := &AofHandler{}
 	handler.aofFilename = config.Properties.AppendFilename //找到配置文件的文件名
+	if handler.aofFilename == "" {
+		handler.aofFilename = defaultAofFilename
+	}
+	handler.aofDirname = config.Properties.AppendDirname
+	if handler.aofDirname == "" {
+		handler.aofDirname = defaultAofDirname
+	}
 	handler.db = db
-	handler.LoadAof(0)
-	aofFile, err := os.OpenFile(handler.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600) //入参依次是，文件名，flag（只读，只写，追加），文件模式
+	handler.tmpDBMaker = tmpDBMaker
+	if err := os.MkdirAll(handler.aofDirname, 0755); err != nil {
+		return nil, err
+	}
+	manifest, err := handler.loadOrCreateManifest()
+	if err != nil {
+		return nil, err
+	}
+	handler.manifest = manifest
+	if err := handler.LoadAof(); err != nil {
+		return nil, err
+	}
+	if len(manifest.incrs) == 0 {
+		// 第一次启动或者刚从单文件升级，需要创建第一个 incr 文件
+		manifest.nextIncr(handler.aofFilename)
+		if err := manifest.save(handler.manifestPath()); err != nil {
+			return nil, err
+		}
+	}
+	current := manifest.incrs[len(manifest.incrs)-1]
+	aofFile, err := os.OpenFile(handler.filePath(current), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600) //入参依次是，文件名，flag（只读，只写，追加），文件模式
 	if err != nil {
 		return nil, err
 	}
@@ -54,6 +89,39 @@ func NewAOFHandler(db databaseface.Database) (*AofHandler, error) {
 	return handler, nil
 }
 
+// loadOrCreateManifest 读取清单文件
+// 清单不存在时，如果工作目录下有旧版的单个 AOF 文件，则把它移动到目录中作为 base 文件
+func (handler *AofHandler) loadOrCreateManifest() (*aofManifest, error) {
+	manifest, err := loadManifest(handler.manifestPath())
+	if err == nil {
+		return manifest, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	manifest = &aofManifest{}
+	if info, err := os.Stat(handler.aofFilename); err == nil && !info.IsDir() {
+		base := manifest.nextBase(handler.aofFilename)
+		if err := os.Rename(handler.aofFilename, handler.filePath(base)); err != nil {
+			return nil, err
+		}
+		manifest.base = base
+		logger.Info(fmt.Sprintf("upgrade append only file %s to %s", handler.aofFilename, handler.filePath(base)))
+		if err := manifest.save(handler.manifestPath()); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+func (handler *AofHandler) manifestPath() string {
+	return filepath.Join(handler.aofDirname, handler.aofFilename+manifestSuffix)
+}
+
+func (handler *AofHandler) filePath(info *aofInfo) string {
+	return filepath.Join(handler.aofDirname, info.name)
+}
+
 // AddAof 用户的指令包装成payload放入缓冲区
 func (handler *AofHandler) AddAof(dbIndex int, cmdLine CmdLine) {
 	if config.Properties.AppendOnly && handler.aofChan != nil { //判断是否开AOF功能
@@ -65,86 +133,82 @@ func (handler *AofHandler) AddAof(dbIndex int, cmdLine CmdLine) {
 }
 
 // handleAof 从缓冲区取出，保存到硬盘中
+// 切换 DB 时 SELECT 与命令合并为一次写入，保证每条记录所属的 DB 不会因为写入失败而错乱
 func (handler *AofHandler) handleAof() {
 	// serialized execution
-	handler.currentDB = 0
+	handler.currentDB = -1 // 每个文件的第一条记录之前总是写入 SELECT
 	for p := range handler.aofChan {
 		handler.pausingAof.RLock() // prevent other goroutines from pausing aof
+		var buf bytes.Buffer
 		if p.dbIndex != handler.currentDB {
 			// select db
-			data := reply.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(p.dbIndex))).ToBytes()
-			_, err := handler.aofFile.Write(data)
-			if err != nil {
-				logger.Warn(err)
-				continue // skip this command
-			}
-			handler.currentDB = p.dbIndex
+			buf.Write(reply.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(p.dbIndex))).ToBytes())
 		}
-		data := reply.MakeMultiBulkReply(p.cmdLine).ToBytes()
-		_, err := handler.aofFile.Write(data)
-		if err != nil {
+		buf.Write(reply.MakeMultiBulkReply(p.cmdLine).ToBytes())
+		if err := handler.writeRecord(buf.Bytes()); err != nil {
 			logger.Warn(err)
+			// 写入失败时无法确定文件中当前的 DB，下一条记录重新写入 SELECT
+			handler.currentDB = -1
+		} else {
+			handler.currentDB = p.dbIndex
 		}
 		handler.pausingAof.RUnlock()
 	}
 	handler.aofFinished <- struct{}{}
 }
 
-// LoadAof 重启系统后从文件中加载到内存中，防止数据丢失
-func (handler *AofHandler) LoadAof(maxBytes int) {
+// writeRecord 写入一条完整记录，部分写入时截断掉已写入的部分，避免在文件中间留下残缺的记录
+func (handler *AofHandler) writeRecord(data []byte) error {
+	n, err := handler.aofFile.Write(data)
+	if err == nil || n == 0 {
+		return err
+	}
+	info, statErr := handler.aofFile.Stat()
+	if statErr != nil {
+		return err
+	}
+	if truncErr := handler.aofFile.Truncate(info.Size() - int64(n)); truncErr != nil {
+		logger.Error("failed to remove partial aof record: " + truncErr.Error())
+	}
+	return err
+}
+
+// LoadAof 重启系统后按清单顺序加载 base 文件和 incr 文件，防止数据丢失
+// 最后一个文件尾部的不完整命令按照 aof-load-truncated 配置截断或报错，其他位置的损坏直接报错
+func (handler *AofHandler) LoadAof() error {
 	aofChan := handler.aofChan
 	handler.aofChan = nil
 	defer func(aofChan chan *payload) {
 		handler.aofChan = aofChan
 	}(aofChan)
 
-	file, err := os.Open(handler.aofFilename)
-	if err != nil {
-		if _, ok := err.(*os.PathError); ok {
-			return
-		}
-		logger.Warn(err)
-		return
-	}
-	defer file.Close()
-
-	var reader io.Reader
-	if maxBytes > 0 {
-		reader = io.LimitReader(file, int64(maxBytes))
-	} else {
-		reader = file
-	}
-	ch := parser.ParseStream(reader)
-	fakeConn := &connection.FakeConn{}
-	for p := range ch {
-		if p.Err != nil {
-			if p.Err == io.EOF {
-				break
-			}
-			logger.Error("parse error: " + p.Err.Error())
-			continue
-		}
-		if p.Data == nil {
-			logger.Error("empty payload")
-			continue
-		}
-		r, ok := p.Data.(*reply.MultiBulkReply)
-		if !ok {
-			logger.Error("require multi bulk reply")
-			continue
-		}
-		ret := handler.db.Exec(fakeConn, r.Args)
-		if reply.IsErrorReply(ret) {
-			logger.Error("exec err", err)
+	start := time.Now()
+	files := handler.manifest.files()
+	for i, info := range files {
+		last := i == len(files)-1
+		if err := handler.loadAofFile(handler.filePath(info), handler.db, last); err != nil {
+			return err
 		}
 	}
+	if len(files) > 0 {
+		logger.Info(fmt.Sprintf("DB loaded from append only file: %.3f seconds", time.Since(start).Seconds()))
+		reportKeyspace(handler.db)
+	}
+	return nil
 }
 
 // Close gracefully stops aof persistence procedure
 func (handler *AofHandler) Close() {
+	handler.closeOnce.Do(handler.close)
+}
+
+func (handler *AofHandler) close() {
 	if handler.aofFile != nil {
 		close(handler.aofChan)
 		<-handler.aofFinished // wait for aof finished
+		if err := handler.aofFile.Sync(); err != nil {
+			logger.Warn(err)
+		}
 		err := handler.aofFile.Close()
 		if err != nil {
 			logger.Warn(err)
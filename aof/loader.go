@@ -0,0 +1,106 @@
+package aof
+
+import (
+	"fmt"
+	"goredis/config"
+	databaseface "goredis/interface/database"
+	"goredis/lib/logger"
+	"goredis/resp/connection"
+	"goredis/resp/reply"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loadAofFile 将一个文件中的命令重放到 db 中，allowTruncated 表示是否允许截断尾部的不完整命令
+// 每个文件使用独立的连接重放，文件开头总是 0 号 DB，SELECT 由加载器自己处理并校验范围
+func (handler *AofHandler) loadAofFile(filename string, db databaseface.Database, allowTruncated bool) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	start := time.Now()
+	reader := NewCmdReader(file)
+	conn := &connection.FakeConn{}
+	commands := 0
+	for {
+		cmdLine, err := reader.ReadCommand()
+		if err == io.EOF {
+			break
+		}
+		if err == ErrTruncated && allowTruncated {
+			if err := handler.handleTruncated(filename, reader.Offset()); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("bad file format reading the append only file %s: %v", filename, err)
+		}
+		commands++
+		if strings.ToLower(string(cmdLine[0])) == "select" {
+			dbIndex, err := parseSelect(cmdLine)
+			if err != nil {
+				return fmt.Errorf("bad file format reading the append only file %s at offset %d: %v",
+					filename, reader.Offset(), err)
+			}
+			conn.SelectDB(dbIndex)
+			continue
+		}
+		ret := db.Exec(conn, cmdLine)
+		if reply.IsErrorReply(ret) {
+			logger.Error("exec err", string(ret.ToBytes()))
+		}
+	}
+	logger.Info(fmt.Sprintf("loaded %d commands from %s in %.3f seconds",
+		commands, filename, time.Since(start).Seconds()))
+	return nil
+}
+
+// parseSelect 解析 SELECT 命令的 DB 序号，超出 databases 配置范围视为文件损坏
+func parseSelect(cmdLine CmdLine) (int, error) {
+	if len(cmdLine) != 2 {
+		return 0, fmt.Errorf("wrong number of arguments for 'select'")
+	}
+	dbIndex, err := strconv.Atoi(string(cmdLine[1]))
+	if err != nil {
+		return 0, fmt.Errorf("invalid DB index '%s'", string(cmdLine[1]))
+	}
+	if dbIndex < 0 || dbIndex >= config.Properties.Databases {
+		return 0, fmt.Errorf("DB index %d is out of range, databases is %d", dbIndex, config.Properties.Databases)
+	}
+	return dbIndex, nil
+}
+
+// handleTruncated 处理尾部不完整的 AOF 文件
+// 开启 aof-load-truncated 时截断到最后一条完整命令并打印警告，否则拒绝启动
+func (handler *AofHandler) handleTruncated(filename string, validSize int64) error {
+	if !config.Properties.AofLoadTruncated {
+		return fmt.Errorf("unexpected end of file reading the append only file %s, "+
+			"use aof-check --fix or set aof-load-truncated yes", filename)
+	}
+	logger.Warn(fmt.Sprintf("!!! Warning: short read while loading the AOF file %s !!!", filename))
+	logger.Warn(fmt.Sprintf("AOF loaded anyway because aof-load-truncated is enabled, truncating to offset %d", validSize))
+	return FixAof(filename, validSize)
+}
+
+// reportKeyspace 打印加载完成后每个 DB 的键数量和设置了过期时间的键数量
+func reportKeyspace(db databaseface.DBEngine) {
+	for i := 0; i < config.Properties.Databases; i++ {
+		keys, expires := 0, 0
+		db.ForEach(i, func(key string, entity *databaseface.DataEntity) bool {
+			keys++
+			if entity.ExpireTime > 0 {
+				expires++
+			}
+			return true
+		})
+		if keys > 0 {
+			logger.Info(fmt.Sprintf("db%d: keys=%d,expires=%d", i, keys, expires))
+		}
+	}
+}
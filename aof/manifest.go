@@ -0,0 +1,197 @@
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ * 多文件 AOF 的清单（manifest），格式与 Redis 7 一致，每行描述一个文件：
+ *   file appendonly.aof.1.base.aof seq 1 type b
+ *   file appendonly.aof.1.incr.aof seq 1 type i
+ * 加载时先读取 base 文件，再按顺序读取所有 incr 文件
+ */
+
+const (
+	aofBaseType = 'b' // base 文件，重写后生成的全量快照
+	aofIncrType = 'i' // incr 文件，记录 base 之后的增量命令
+
+	manifestSuffix = ".manifest"
+	baseSuffix     = ".base.aof"
+	incrSuffix     = ".incr.aof"
+)
+
+// aofInfo 描述清单中的一个文件
+type aofInfo struct {
+	name     string
+	seq      int64
+	fileType byte
+}
+
+func (info *aofInfo) String() string {
+	return fmt.Sprintf("file %s seq %d type %c", info.name, info.seq, info.fileType)
+}
+
+// aofManifest 记录当前有效的 base 文件和 incr 文件
+type aofManifest struct {
+	base    *aofInfo   // 可能为空，表示还没有重写过
+	incrs   []*aofInfo // 按 seq 递增排列
+	baseSeq int64      // 最近一次使用的 base 序号
+	incrSeq int64      // 最近一次使用的 incr 序号
+}
+
+// loadManifest 读取清单文件，文件不存在时返回 os.ErrNotExist
+func loadManifest(filename string) (*aofManifest, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	manifest := &aofManifest{}
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		info, err := parseManifestLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aof manifest %s at line %d: %v", filename, lineNum, err)
+		}
+		switch info.fileType {
+		case aofBaseType:
+			if manifest.base != nil {
+				return nil, fmt.Errorf("invalid aof manifest %s: found duplicate base file", filename)
+			}
+			manifest.base = info
+			manifest.baseSeq = info.seq
+		case aofIncrType:
+			if info.seq <= manifest.incrSeq {
+				return nil, fmt.Errorf("invalid aof manifest %s: incr file seq %d out of order", filename, info.seq)
+			}
+			manifest.incrs = append(manifest.incrs, info)
+			manifest.incrSeq = info.seq
+		default:
+			return nil, fmt.Errorf("invalid aof manifest %s: unknown file type '%c'", filename, info.fileType)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// parseManifestLine 解析 "file <name> seq <seq> type <type>" 格式的一行
+func parseManifestLine(line string) (*aofInfo, error) {
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid line: %s", line)
+	}
+	info := &aofInfo{}
+	for i := 0; i < len(fields); i += 2 {
+		value := fields[i+1]
+		switch fields[i] {
+		case "file":
+			info.name = value
+		case "seq":
+			seq, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seq <= 0 {
+				return nil, fmt.Errorf("invalid seq: %s", value)
+			}
+			info.seq = seq
+		case "type":
+			if len(value) != 1 {
+				return nil, fmt.Errorf("invalid type: %s", value)
+			}
+			info.fileType = value[0]
+		}
+	}
+	if info.name == "" || info.seq == 0 || info.fileType == 0 {
+		return nil, fmt.Errorf("incomplete line: %s", line)
+	}
+	// 清单中只允许出现文件名，防止通过路径访问目录以外的文件
+	if filepath.Base(info.name) != info.name {
+		return nil, fmt.Errorf("invalid file name: %s", info.name)
+	}
+	return info, nil
+}
+
+// save 先写入临时文件再重命名，保证清单文件的更新是原子的
+func (m *aofManifest) save(filename string) error {
+	tmpFilename := filename + ".tmp"
+	file, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	if m.base != nil {
+		_, _ = writer.WriteString(m.base.String() + "\n")
+	}
+	for _, incr := range m.incrs {
+		_, _ = writer.WriteString(incr.String() + "\n")
+	}
+	if err = writer.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpFilename)
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+// files 按加载顺序返回清单中的所有文件
+func (m *aofManifest) files() []*aofInfo {
+	result := make([]*aofInfo, 0, len(m.incrs)+1)
+	if m.base != nil {
+		result = append(result, m.base)
+	}
+	return append(result, m.incrs...)
+}
+
+// nextIncr 分配一个新的 incr 文件并追加到清单末尾
+func (m *aofManifest) nextIncr(prefix string) *aofInfo {
+	m.incrSeq++
+	info := &aofInfo{
+		name:     prefix + "." + strconv.FormatInt(m.incrSeq, 10) + incrSuffix,
+		seq:      m.incrSeq,
+		fileType: aofIncrType,
+	}
+	m.incrs = append(m.incrs, info)
+	return info
+}
+
+// nextBase 分配一个新的 base 文件名，调用者写入完成后再替换清单中的 base
+func (m *aofManifest) nextBase(prefix string) *aofInfo {
+	m.baseSeq++
+	return &aofInfo{
+		name:     prefix + "." + strconv.FormatInt(m.baseSeq, 10) + baseSuffix,
+		seq:      m.baseSeq,
+		fileType: aofBaseType,
+	}
+}
+
+// ManifestFiles 按加载顺序返回清单中列出的文件路径
+func ManifestFiles(filename string) ([]string, error) {
+	manifest, err := loadManifest(filename)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(filename)
+	files := manifest.files()
+	paths := make([]string, len(files))
+	for i, info := range files {
+		paths[i] = filepath.Join(dir, info.name)
+	}
+	return paths, nil
+}
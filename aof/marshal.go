@@ -0,0 +1,24 @@
+package aof
+
+import (
+	"goredis/interface/database"
+	"goredis/lib/utils"
+	"strconv"
+)
+
+// EntityToCmd 将数据实体序列化为可以重建它的命令，不支持的类型返回 nil
+func EntityToCmd(key string, entity *database.DataEntity) CmdLine {
+	if entity == nil {
+		return nil
+	}
+	switch val := entity.Data.(type) {
+	case []byte:
+		return utils.ToCmdLine2("SET", []byte(key), val)
+	}
+	return nil
+}
+
+// MakeExpireCmd 生成以绝对时间（毫秒）设置过期时间的命令，重放时不会受到加载耗时的影响
+func MakeExpireCmd(key string, expireAt int64) CmdLine {
+	return utils.ToCmdLine("PEXPIREAT", key, strconv.FormatInt(expireAt, 10))
+}
@@ -0,0 +1,119 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"goredis/resp/parser"
+	"io"
+	"math"
+	"os"
+)
+
+// ErrTruncated 表示文件在一条命令的中间结束，通常是写入过程中进程崩溃导致的
+var ErrTruncated = errors.New("unexpected end of file")
+
+// CorruptError 表示 AOF 文件中出现了无法解析的记录
+type CorruptError struct {
+	Offset int64  // 发现错误时所在的字节偏移量
+	Msg    string // 错误描述
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("bad file format at offset %d: %s", e.Offset, e.Msg)
+}
+
+// CmdReader 顺序读取 AOF 文件或复制流中的命令，并记录每条完整命令结束时的偏移量，
+// 用于定位损坏的记录以及截断不完整的尾部
+type CmdReader struct {
+	reader *parser.CommandReader
+	offset int64 // 最后一条完整命令结束的位置
+}
+
+// NewCmdReader 创建 CmdReader，reader 已经是 *bufio.Reader 时会直接复用其中缓冲的数据
+func NewCmdReader(reader io.Reader) *CmdReader {
+	cmdReader := parser.NewCommandReader(bufio.NewReader(reader))
+	cmdReader.Inline = false // AOF 文件和复制流中只有 RESP 格式的命令
+	// 客户端的 proto-max-bulk-len 不限制已经写入的数据，调小配置后仍然可以加载原有的 AOF 文件和复制流
+	cmdReader.MaxBulkLen = math.MaxInt64
+	cmdReader.MaxMultiBulkLen = math.MaxInt64
+	// AOF 文件和复制流中不会出现空命令，出现时视为损坏
+	cmdReader.RejectEmpty = true
+	return &CmdReader{
+		reader: cmdReader,
+	}
+}
+
+// ReadCommand 读取下一条命令
+// 文件正常结束时返回 io.EOF，命令不完整时返回 ErrTruncated，格式错误时返回 *CorruptError
+func (r *CmdReader) ReadCommand() (CmdLine, error) {
+	cmdLine, err := r.reader.ReadCommand()
+	if err == io.ErrUnexpectedEOF {
+		return nil, ErrTruncated
+	}
+	if protoErr, ok := err.(*parser.ProtocolError); ok {
+		return nil, &CorruptError{
+			Offset: r.reader.Offset(),
+			Msg:    protoErr.Msg,
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.offset = r.reader.Offset()
+	return cmdLine, nil
+}
+
+// Offset 返回最后一条完整命令结束的位置
+func (r *CmdReader) Offset() int64 {
+	return r.offset
+}
+
+// CheckResult 记录 AOF 文件的校验结果
+type CheckResult struct {
+	Size      int64 // 文件大小
+	ValidSize int64 // 最后一条完整命令结束的位置，也就是第一条损坏记录的起始位置
+	Commands  int   // 完整命令的数量
+	Err       error // 遇到的第一个错误，nil 表示文件完整
+}
+
+// Truncated 文件是否仅仅是尾部不完整
+func (r *CheckResult) Truncated() bool {
+	return r.Err == ErrTruncated
+}
+
+// CheckAof 逐条校验 AOF 文件，不执行任何命令
+func CheckAof(filename string) (*CheckResult, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CheckResult{
+		Size: info.Size(),
+	}
+	reader := NewCmdReader(file)
+	for {
+		_, err = reader.ReadCommand()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			result.Err = err
+			break
+		}
+		result.Commands++
+	}
+	result.ValidSize = reader.Offset()
+	return result, nil
+}
+
+// FixAof 将 AOF 文件截断到最后一条完整命令结束的位置
+func FixAof(filename string, validSize int64) error {
+	return os.Truncate(filename, validSize)
+}
@@ -0,0 +1,175 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"goredis/config"
+	databaseface "goredis/interface/database"
+	"goredis/lib/logger"
+	"goredis/lib/utils"
+	"goredis/resp/reply"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ErrRewriting 已经有重写任务在进行
+var ErrRewriting = errors.New("ERR Background append only file rewriting already in progress")
+
+// rewriteCtx 记录一次重写开始时需要合并的文件
+type rewriteCtx struct {
+	files   []*aofInfo // 需要合并为新 base 的旧文件
+	incrSeq int64      // 被合并的最后一个 incr 文件的序号
+}
+
+// StartRewrite 在后台重写 AOF
+// 先切换到新的 incr 文件承接后续写入，再在临时数据库中重放旧文件并生成新的 base 文件
+func (handler *AofHandler) StartRewrite() error {
+	if !handler.rewriteLock.TryLock() {
+		return ErrRewriting
+	}
+	ctx, err := handler.rotate()
+	if err != nil {
+		handler.rewriteLock.Unlock()
+		return err
+	}
+	go func() {
+		defer handler.rewriteLock.Unlock()
+		if err := handler.rewrite(ctx); err != nil {
+			logger.Error("background aof rewrite failed: " + err.Error())
+			return
+		}
+		logger.Info("background aof rewrite finished successfully")
+	}()
+	return nil
+}
+
+// rotate 暂停写入，打开新的 incr 文件并更新清单
+func (handler *AofHandler) rotate() (*rewriteCtx, error) {
+	handler.pausingAof.Lock()
+	defer handler.pausingAof.Unlock()
+
+	if err := handler.aofFile.Sync(); err != nil {
+		return nil, err
+	}
+	ctx := &rewriteCtx{
+		files:   handler.manifest.files(),
+		incrSeq: handler.manifest.incrSeq,
+	}
+
+	info := handler.manifest.nextIncr(handler.aofFilename)
+	file, err := os.OpenFile(handler.filePath(info), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err == nil {
+		err = handler.manifest.save(handler.manifestPath())
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(handler.filePath(info))
+		}
+	}
+	if err != nil {
+		// 回滚清单中新增的 incr 文件
+		handler.manifest.incrs = handler.manifest.incrs[:len(handler.manifest.incrs)-1]
+		handler.manifest.incrSeq--
+		return nil, err
+	}
+
+	_ = handler.aofFile.Close()
+	handler.aofFile = file
+	handler.currentDB = -1 // 新文件的第一条记录之前总是写入 SELECT
+	return ctx, nil
+}
+
+// rewrite 将旧文件合并为新的 base 文件，成功后从清单中移除旧文件
+func (handler *AofHandler) rewrite(ctx *rewriteCtx) error {
+	tmpDB := handler.tmpDBMaker()
+	defer tmpDB.Close()
+	for _, info := range ctx.files {
+		if err := handler.loadAofFile(handler.filePath(info), tmpDB, false); err != nil {
+			return err
+		}
+	}
+
+	handler.pausingAof.Lock()
+	base := handler.manifest.nextBase(handler.aofFilename)
+	handler.pausingAof.Unlock()
+
+	tmpFilename := filepath.Join(handler.aofDirname, fmt.Sprintf("temp-rewriteaof-%d.aof", os.Getpid()))
+	if err := dumpToFile(tmpDB, tmpFilename); err != nil {
+		_ = os.Remove(tmpFilename)
+		return err
+	}
+	if err := os.Rename(tmpFilename, handler.filePath(base)); err != nil {
+		_ = os.Remove(tmpFilename)
+		return err
+	}
+
+	handler.pausingAof.Lock()
+	oldBase := handler.manifest.base
+	oldIncrs := handler.manifest.incrs
+	handler.manifest.base = base
+	handler.manifest.incrs = nil
+	for _, incr := range oldIncrs {
+		if incr.seq > ctx.incrSeq {
+			handler.manifest.incrs = append(handler.manifest.incrs, incr)
+		}
+	}
+	err := handler.manifest.save(handler.manifestPath())
+	if err != nil {
+		handler.manifest.base = oldBase
+		handler.manifest.incrs = oldIncrs
+	}
+	handler.pausingAof.Unlock()
+	if err != nil {
+		_ = os.Remove(handler.filePath(base))
+		return err
+	}
+
+	// 清单已经不再引用旧文件，可以安全删除
+	for _, info := range ctx.files {
+		if err := os.Remove(handler.filePath(info)); err != nil {
+			logger.Warn(err)
+		}
+	}
+	return nil
+}
+
+// dumpToFile 将数据库中的所有键序列化为命令写入文件
+func dumpToFile(db databaseface.DBEngine, filename string) error {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for i := 0; i < config.Properties.Databases; i++ {
+		selected := false
+		db.ForEach(i, func(key string, entity *databaseface.DataEntity) bool {
+			cmdLine := EntityToCmd(key, entity)
+			if cmdLine == nil {
+				return true
+			}
+			if !selected {
+				_, err = writer.Write(reply.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(i))).ToBytes())
+				selected = true
+			}
+			_, err = writer.Write(reply.MakeMultiBulkReply(cmdLine).ToBytes())
+			if entity.ExpireTime > 0 {
+				_, err = writer.Write(reply.MakeMultiBulkReply(MakeExpireCmd(key, entity.ExpireTime)).ToBytes())
+			}
+			return err == nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
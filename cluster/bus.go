@@ -0,0 +1,445 @@
+package cluster
+
+import (
+	"fmt"
+	"goredis/config"
+	"goredis/interface/resp"
+	"goredis/lib/logger"
+	"goredis/lib/utils"
+	"goredis/resp/client"
+	"goredis/resp/reply"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * 集群总线：节点之间定时互相发送 CLUSTER HEARTBEAT 检测故障
+ * 与 Redis Cluster 相同，超过 cluster-node-timeout 没有收到回复的节点被标记为 PFAIL（疑似下线），
+ * 心跳中携带本节点认为 PFAIL 的节点，当集群中的多数节点都报告某个节点 PFAIL 时将它标记为 FAIL 并广播 CLUSTER FAIL。
+ * 键所在的节点处于 FAIL 状态时直接回复 CLUSTERDOWN，不再等待转发超时
+ */
+
+const (
+	busPeriod          = time.Second      // 发送心跳的间隔
+	defaultNodeTimeout = 15 * time.Second // 默认的 cluster-node-timeout
+	failReportValidity = 2                // 其他节点的 PFAIL 报告在 node-timeout 的多少倍时间内有效
+)
+
+// busLink 总线使用的连接，与转发命令的连接池分开，命令繁忙时不影响故障检测
+type busLink struct {
+	addr   string
+	mu     sync.Mutex
+	client *client.Client
+}
+
+// send 发送命令，连接出错时丢弃连接，下次发送时重新建立
+func (l *busLink) send(args [][]byte) (resp.Reply, error) {
+	l.mu.Lock()
+	if l.client == nil {
+		c, err := makePeerClient(l.addr)
+		if err != nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+		c.Start()
+		l.client = c
+	}
+	c := l.client
+	l.mu.Unlock()
+
+	ret := c.Send(args)
+	if client.IsLinkError(ret) {
+		l.mu.Lock()
+		if l.client == c {
+			l.client = nil
+		}
+		l.mu.Unlock()
+		// Close 会等待进行中的请求结束，不阻塞调用者
+		go c.Close()
+		return nil, ret.(*client.LinkError)
+	}
+	return ret, nil
+}
+
+func (l *busLink) close() {
+	l.mu.Lock()
+	c := l.client
+	l.client = nil
+	l.mu.Unlock()
+	if c != nil {
+		go c.Close()
+	}
+}
+
+// nodeState 本节点观察到的其他节点的状态，由 clusterBus.mu 保护
+type nodeState struct {
+	link        *busLink
+	pinging     bool                 // 是否有正在进行的心跳，同一时间只发送一个
+	pingSent    time.Time            // 正在进行的心跳的发送时间
+	lastPong    time.Time            // 最近一次收到回复的时间
+	pfail       bool                 // 本节点认为它疑似下线
+	fail        bool                 // 集群多数节点认为它已经下线
+	failReports map[string]time.Time // 报告它 PFAIL 的节点 -> 报告时间
+	offset      int64                // 心跳中携带的复制偏移量
+}
+
+// clusterBus 维护所有节点的状态
+type clusterBus struct {
+	cluster     *ClusterDatabase
+	nodeTimeout time.Duration
+
+	mu    sync.Mutex
+	nodes map[string]*nodeState
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+
+	// 本节点作为从库时主库下线后的故障转移，只在 cron 中访问
+	failoverPrimary string    // 正在等待故障转移的主库
+	failoverAt      time.Time // 开始故障转移的时间
+}
+
+func makeClusterBus(cluster *ClusterDatabase) *clusterBus {
+	bus := &clusterBus{
+		cluster:     cluster,
+		nodeTimeout: defaultNodeTimeout,
+		nodes:       make(map[string]*nodeState),
+		stopCh:      make(chan struct{}),
+	}
+	if config.Properties.NodeTimeout > 0 {
+		bus.nodeTimeout = time.Duration(config.Properties.NodeTimeout) * time.Millisecond
+	}
+	return bus
+}
+
+// start 启动定时发送心跳的 goroutine
+func (bus *clusterBus) start() {
+	go func() {
+		ticker := time.NewTicker(busPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				bus.cron()
+			case <-bus.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (bus *clusterBus) close() {
+	bus.stopOnce.Do(func() {
+		close(bus.stopCh)
+		bus.mu.Lock()
+		for _, state := range bus.nodes {
+			state.link.close()
+		}
+		bus.mu.Unlock()
+	})
+}
+
+// members 返回集群中除自己以外的所有节点，包括从库
+func (cluster *ClusterDatabase) members() []string {
+	var nodes []string
+	if cluster.slots != nil {
+		cluster.slots.mu.RLock()
+		nodes = cluster.slots.nodes()
+		cluster.slots.mu.RUnlock()
+	} else {
+		nodes = cluster.broadcastTargets()
+	}
+	cluster.topologyLock.RLock()
+	for replica := range cluster.replicas {
+		nodes = append(nodes, replica)
+	}
+	cluster.topologyLock.RUnlock()
+	seen := map[string]struct{}{cluster.self: {}}
+	result := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if _, ok := seen[node]; !ok {
+			seen[node] = struct{}{}
+			result = append(result, node)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// getState 返回节点的状态，不存在时创建，调用者需要持有 bus.mu
+func (bus *clusterBus) getState(node string) *nodeState {
+	state, ok := bus.nodes[node]
+	if !ok {
+		state = &nodeState{
+			link:        &busLink{addr: node},
+			lastPong:    time.Now(),
+			failReports: make(map[string]time.Time),
+		}
+		bus.nodes[node] = state
+	}
+	return state
+}
+
+// cron 向所有节点发送心跳，并根据心跳结果和其他节点的报告更新节点状态
+func (bus *clusterBus) cron() {
+	members := bus.cluster.members()
+	epoch, primary, replicas := bus.cluster.heartbeatInfo()
+	offset := bus.cluster.ReplOffset()
+	now := time.Now()
+
+	bus.mu.Lock()
+	known := make(map[string]struct{}, len(members))
+	for _, node := range members {
+		known[node] = struct{}{}
+	}
+	for node, state := range bus.nodes {
+		if _, ok := known[node]; !ok {
+			// 节点已经离开集群
+			state.link.close()
+			delete(bus.nodes, node)
+		}
+	}
+	heartbeat := utils.ToCmdLine("CLUSTER", "HEARTBEAT", bus.cluster.self, joinOrDash(bus.suspectedLocked()),
+		strconv.FormatInt(epoch, 10), orDash(primary), strconv.FormatInt(offset, 10), joinOrDash(replicas))
+	var failed []string
+	for _, node := range members {
+		state := bus.getState(node)
+		if !state.pinging {
+			state.pinging = true
+			state.pingSent = now
+			go bus.ping(node, state, heartbeat)
+		}
+		if !state.pfail && now.Sub(state.lastPong) > bus.nodeTimeout {
+			state.pfail = true
+			logger.Info("cluster: +pfail " + node)
+		}
+		if state.pfail && !state.fail && bus.countFailReports(node, state, len(members)+1) {
+			state.fail = true
+			failed = append(failed, node)
+			logger.Info("cluster: +fail " + node)
+		}
+	}
+	bus.mu.Unlock()
+
+	// 将 FAIL 广播给其他节点，让它们立即停止向失败节点转发命令
+	for _, node := range failed {
+		cmdLine := utils.ToCmdLine("CLUSTER", "FAIL", node)
+		for _, member := range members {
+			if member != node {
+				go bus.sendTo(member, cmdLine)
+			}
+		}
+	}
+	bus.checkFailover()
+}
+
+// orDash 心跳中用 - 表示空的参数
+func orDash(arg string) string {
+	if arg == "" {
+		return "-"
+	}
+	return arg
+}
+
+func joinOrDash(items []string) string {
+	return orDash(strings.Join(items, ","))
+}
+
+// countFailReports 判断包括自己在内报告 node PFAIL 的节点是否达到多数，同时清除过期的报告
+func (bus *clusterBus) countFailReports(node string, state *nodeState, size int) bool {
+	validity := failReportValidity * bus.nodeTimeout
+	reports := 1 // 自己的报告
+	for reporter, reportTime := range state.failReports {
+		if time.Since(reportTime) > validity {
+			delete(state.failReports, reporter)
+			continue
+		}
+		reports++
+	}
+	return reports >= size/2+1
+}
+
+// ping 发送一次心跳，收到回复时清除 PFAIL 和 FAIL 状态
+func (bus *clusterBus) ping(node string, state *nodeState, heartbeat [][]byte) {
+	_, err := state.link.send(heartbeat)
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	state.pinging = false
+	if err != nil {
+		return
+	}
+	bus.markAlive(node, state)
+}
+
+// markAlive 节点可以正常通信，调用者需要持有 bus.mu
+func (bus *clusterBus) markAlive(node string, state *nodeState) {
+	state.lastPong = time.Now()
+	if state.fail {
+		logger.Info("cluster: -fail " + node)
+	} else if state.pfail {
+		logger.Info("cluster: -pfail " + node)
+	}
+	state.pfail = false
+	state.fail = false
+}
+
+// sendTo 通过总线连接发送一条命令
+func (bus *clusterBus) sendTo(node string, cmdLine [][]byte) {
+	bus.mu.Lock()
+	link := bus.getState(node).link
+	bus.mu.Unlock()
+	_, _ = link.send(cmdLine)
+}
+
+// suspectedLocked 返回本节点认为 PFAIL 或 FAIL 的节点，调用者需要持有 bus.mu
+func (bus *clusterBus) suspectedLocked() []string {
+	var result []string
+	for node, state := range bus.nodes {
+		if state.pfail {
+			result = append(result, node)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// onHeartbeat 处理 sender 发来的心跳，suspected 为 sender 认为 PFAIL 的节点，offset 为 sender 的复制偏移量
+func (bus *clusterBus) onHeartbeat(sender string, suspected []string, offset int64) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if sender != bus.cluster.self {
+		state := bus.getState(sender)
+		state.offset = offset
+		bus.markAlive(sender, state)
+	}
+	reported := make(map[string]struct{}, len(suspected))
+	for _, node := range suspected {
+		if node == bus.cluster.self {
+			continue
+		}
+		reported[node] = struct{}{}
+		bus.getState(node).failReports[sender] = time.Now()
+	}
+	for node, state := range bus.nodes {
+		if _, ok := reported[node]; !ok {
+			delete(state.failReports, sender)
+		}
+	}
+}
+
+// onFail 处理其他节点广播的 FAIL
+func (bus *clusterBus) onFail(node string) {
+	if node == bus.cluster.self {
+		return
+	}
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	state := bus.getState(node)
+	if !state.fail {
+		logger.Info("cluster: +fail " + node + " (reported)")
+	}
+	state.pfail = true
+	state.fail = true
+}
+
+// knows 判断是否已经与节点直接通信过
+func (bus *clusterBus) knows(node string) bool {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	_, ok := bus.nodes[node]
+	return ok
+}
+
+// isFailing 判断节点是否处于 FAIL 状态
+func (bus *clusterBus) isFailing(node string) bool {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	state, ok := bus.nodes[node]
+	return ok && state.fail
+}
+
+// nodeStatus CLUSTER NODES 中展示的节点状态
+type nodeStatus struct {
+	flags    string // 空字符串、fail? 或 fail
+	pingSent int64  // 正在进行的心跳的发送时间（毫秒），没有时为 0
+	pongRecv int64  // 最近一次收到回复的时间（毫秒）
+	linkUp   bool
+}
+
+// status 返回节点在 CLUSTER NODES 中展示的状态
+func (bus *clusterBus) status(node string) *nodeStatus {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	state, ok := bus.nodes[node]
+	if !ok {
+		return &nodeStatus{linkUp: true}
+	}
+	result := &nodeStatus{
+		pongRecv: state.lastPong.UnixNano() / 1e6,
+		linkUp:   !state.pfail,
+	}
+	if state.pinging {
+		result.pingSent = state.pingSent.UnixNano() / 1e6
+	}
+	if state.fail {
+		result.flags = "fail"
+	} else if state.pfail {
+		result.flags = "fail?"
+	}
+	return result
+}
+
+// execHeartbeat 处理 CLUSTER HEARTBEAT <sender> <suspected nodes> <epoch> <primary> <offset> <replicas>
+// suspected nodes 为 sender 认为 PFAIL 的节点，primary 为 sender 复制的主库，replicas 为 sender 知道的从库（从库>主库），为空时都用 - 表示
+func (cluster *ClusterDatabase) execHeartbeat(args [][]byte) resp.Reply {
+	if len(args) != 6 {
+		return reply.MakeArgNumErrReply("cluster|heartbeat")
+	}
+	epoch, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR invalid epoch")
+	}
+	offset, err := strconv.ParseInt(string(args[4]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR invalid offset")
+	}
+	sender := string(args[0])
+	primary := string(args[3])
+	if primary == "-" {
+		primary = ""
+	}
+	cluster.learnReplica(sender, primary)
+	if string(args[5]) != "-" {
+		for _, item := range strings.Split(string(args[5]), ",") {
+			pivot := strings.IndexByte(item, '>')
+			// 只通过传闻认识从来没有通信过的节点，已经通信过的节点以它自己的心跳为准
+			if pivot > 0 && item[:pivot] != cluster.self && !cluster.bus.knows(item[:pivot]) {
+				cluster.learnReplica(item[:pivot], item[pivot+1:])
+			}
+		}
+	}
+	var suspected []string
+	if string(args[1]) != "-" {
+		suspected = strings.Split(string(args[1]), ",")
+	}
+	cluster.bus.onHeartbeat(sender, suspected, offset)
+	cluster.syncPeer(sender, epoch, primary)
+	return &reply.PongReply{}
+}
+
+// execFail 处理 CLUSTER FAIL <node>
+func (cluster *ClusterDatabase) execFail(args [][]byte) resp.Reply {
+	if len(args) != 1 {
+		return reply.MakeArgNumErrReply("cluster|fail")
+	}
+	cluster.bus.onFail(string(args[0]))
+	return reply.MakeOkReply()
+}
+
+// makeClusterDownReply 键所在的节点已经下线时的回复
+func makeClusterDownReply(node string) reply.ErrorReply {
+	return reply.MakeErrReply(fmt.Sprintf("CLUSTERDOWN The cluster is down, node %s is failing", node))
+}
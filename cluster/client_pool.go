@@ -4,9 +4,49 @@ import (
 	"context"
 	"errors"
 	"github.com/jolestar/go-commons-pool/v2" // 对象池库
-	"goredis/resp/client"                    // 自定义的 Redis 客户端包
+	"goredis/config"
+	"goredis/lib/utils"
+	"goredis/resp/client" // 自定义的 Redis 客户端包
+	"goredis/resp/reply"
+	"time"
 )
 
+const (
+	defaultPoolMaxTotal      = 8               // 默认的 peer-pool-max-total
+	defaultPoolMaxIdle       = 8               // 默认的 peer-pool-max-idle
+	defaultPoolBorrowTimeout = 3 * time.Second // 默认的 peer-pool-borrow-timeout
+)
+
+// makePoolConfig 根据配置生成连接池的配置
+// 设置了 peer-pool-idle-timeout 时后台定期关闭空闲太久的连接，并 PING 检查剩下的空闲连接
+func makePoolConfig() *pool.ObjectPoolConfig {
+	poolConfig := pool.NewDefaultPoolConfig()
+	poolConfig.MaxTotal = defaultPoolMaxTotal
+	if config.Properties.PeerPoolMaxTotal != 0 {
+		poolConfig.MaxTotal = config.Properties.PeerPoolMaxTotal
+	}
+	poolConfig.MaxIdle = defaultPoolMaxIdle
+	if config.Properties.PeerPoolMaxIdle != 0 {
+		poolConfig.MaxIdle = config.Properties.PeerPoolMaxIdle
+	}
+	if config.Properties.PeerPoolIdleTimeout > 0 {
+		idleTimeout := time.Duration(config.Properties.PeerPoolIdleTimeout) * time.Second
+		poolConfig.MinEvictableIdleTime = idleTimeout
+		poolConfig.TimeBetweenEvictionRuns = idleTimeout
+		poolConfig.TestWhileIdle = true
+	}
+	poolConfig.TestOnBorrow = config.Properties.PeerPoolTestOnBorrow
+	return poolConfig
+}
+
+// borrowTimeout 连接池中的连接用尽时等待空闲连接的时间
+func borrowTimeout() time.Duration {
+	if config.Properties.PeerPoolBorrowTimeout > 0 {
+		return time.Duration(config.Properties.PeerPoolBorrowTimeout) * time.Millisecond
+	}
+	return defaultPoolBorrowTimeout
+}
+
 // connectionFactory 是一个连接工厂，用于在连接池中创建、验证、销毁 Redis 节点连接。
 type connectionFactory struct {
 	Peer string // Redis 节点的地址，例如 "127.0.0.1:6379"
@@ -15,7 +55,7 @@ type connectionFactory struct {
 // MakeObject 创建一个新的 Redis 客户端连接，并将其包装为 PooledObject。
 func (f *connectionFactory) MakeObject(ctx context.Context) (*pool.PooledObject, error) {
 	// 创建一个新的 Redis 客户端，连接目标节点
-	c, err := client.MakeClient(f.Peer)
+	c, err := makePeerClient(f.Peer)
 	if err != nil {
 		return nil, err // 创建失败，返回错误
 	}
@@ -35,9 +75,14 @@ func (f *connectionFactory) DestroyObject(ctx context.Context, object *pool.Pool
 }
 
 // ValidateObject 验证对象是否有效（连接是否健康），返回 true 表示可用
+// 向节点发送 PING，没有收到 PONG 时连接会被销毁
 func (f *connectionFactory) ValidateObject(ctx context.Context, object *pool.PooledObject) bool {
-	// 此处可以实现 ping、状态检查等逻辑，目前直接返回 true（总是有效）
-	return true
+	c, ok := object.Object.(*client.Client)
+	if !ok {
+		return false
+	}
+	status, ok := c.Send(utils.ToCmdLine("PING")).(*reply.StatusReply)
+	return ok && status.Status == "PONG"
 }
 
 // ActivateObject 激活连接对象，表示即将开始使用（可做清理或准备）
@@ -46,8 +91,15 @@ func (f *connectionFactory) ActivateObject(ctx context.Context, object *pool.Poo
 	return nil
 }
 
-// PassivateObject 钝化连接对象，表示当前使用完毕准备归还池中（可做资源释放等）
+// PassivateObject 钝化连接对象，表示当前使用完毕准备归还池中
+// 连接的状态未知时（例如请求发送失败或 SELECT 失败）返回错误，连接池会销毁它而不是交给下一个使用者
 func (f *connectionFactory) PassivateObject(ctx context.Context, object *pool.PooledObject) error {
-	// 通常用于清理上下文状态或缓冲区，此处为空实现
+	c, ok := object.Object.(*client.Client)
+	if !ok {
+		return errors.New("type mismatch")
+	}
+	if c.SelectedDB() < 0 {
+		return errors.New("connection state unknown")
+	}
 	return nil
 }
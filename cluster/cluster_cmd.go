@@ -0,0 +1,384 @@
+package cluster
+
+import (
+	"fmt"
+	databaseface "goredis/interface/database"
+	"goredis/interface/resp"
+	"goredis/resp/reply"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// execCluster 处理槽位模式下的 CLUSTER 子命令，一致性哈希模式下的子命令由 execRingCluster 处理
+func execCluster(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) < 2 {
+		return reply.MakeArgNumErrReply("cluster")
+	}
+	subCmd := strings.ToLower(string(args[1]))
+	args = args[2:]
+	if cluster.slots == nil {
+		return execRingCluster(cluster, subCmd, args)
+	}
+	switch subCmd {
+	case "distribution":
+		return cluster.execClusterDistribution()
+	case "myid":
+		return reply.MakeBulkReply([]byte(makeNodeId(cluster.self)))
+	case "keyslot":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply("cluster|keyslot")
+		}
+		return reply.MakeIntReply(int64(KeySlot(string(args[0]))))
+	case "countkeysinslot":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply("cluster|countkeysinslot")
+		}
+		slot, errReply := parseSlot(args[0])
+		if errReply != nil {
+			return errReply
+		}
+		count := 0
+		cluster.forEachKeyInSlot(c.GetDBIndex(), slot, func(key string) bool {
+			count++
+			return true
+		})
+		return reply.MakeIntReply(int64(count))
+	case "getkeysinslot":
+		if len(args) != 2 {
+			return reply.MakeArgNumErrReply("cluster|getkeysinslot")
+		}
+		slot, errReply := parseSlot(args[0])
+		if errReply != nil {
+			return errReply
+		}
+		count, err := strconv.Atoi(string(args[1]))
+		if err != nil || count < 0 {
+			return reply.MakeErrReply("ERR Invalid number of keys")
+		}
+		keys := make([][]byte, 0, count)
+		cluster.forEachKeyInSlot(c.GetDBIndex(), slot, func(key string) bool {
+			if len(keys) >= count {
+				return false
+			}
+			keys = append(keys, []byte(key))
+			return true
+		})
+		return reply.MakeMultiBulkReply(keys)
+	case "slots":
+		return cluster.execClusterSlots()
+	case "shards":
+		return cluster.execClusterShards()
+	case "nodes":
+		return cluster.execClusterNodes()
+	case "info":
+		return cluster.execClusterInfo()
+	case "setslot":
+		return cluster.execClusterSetSlot(args)
+	case "heartbeat":
+		return cluster.execHeartbeat(args)
+	case "fail":
+		return cluster.execFail(args)
+	case "replicate":
+		return cluster.execReplicate(args)
+	case "replicas", "slaves":
+		return cluster.execReplicas(args)
+	case "failover":
+		return cluster.execFailover(args)
+	case "promoted":
+		return cluster.execPromoted(args)
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try CLUSTER HELP.")
+}
+
+// execClusterDistribution 报告每个节点负责的键空间比例，用于检查数据分布是否均匀
+// 槽位模式下按槽位数量统计，一致性哈希模式下按节点在环上占据的哈希空间统计
+func (cluster *ClusterDatabase) execClusterDistribution() resp.Reply {
+	builder := &strings.Builder{}
+	if cluster.slots != nil {
+		table := cluster.slots
+		table.mu.RLock()
+		counts := make(map[string]int)
+		for _, owner := range table.owners {
+			if owner != "" {
+				counts[owner]++
+			}
+		}
+		for _, node := range table.nodes() {
+			builder.WriteString(fmt.Sprintf("node=%s slots=%d share=%.2f%%\n",
+				node, counts[node], float64(counts[node])*100/SlotCount))
+		}
+		table.mu.RUnlock()
+	} else {
+		cluster.topologyLock.RLock()
+		picker := cluster.peerPicker
+		cluster.topologyLock.RUnlock()
+		for _, share := range picker.Distribution() {
+			builder.WriteString(fmt.Sprintf("node=%s weight=%d points=%d share=%.2f%%\n",
+				share.Node, share.Weight, share.Points, share.Share*100))
+		}
+	}
+	return reply.MakeBulkReply([]byte(builder.String()))
+}
+
+func parseSlot(arg []byte) (int, reply.ErrorReply) {
+	slot, err := strconv.Atoi(string(arg))
+	if err != nil || slot < 0 || slot >= SlotCount {
+		return 0, reply.MakeErrReply("ERR Invalid or out of range slot")
+	}
+	return slot, nil
+}
+
+// forEachKeyInSlot 遍历本地指定 DB 中属于 slot 的键
+func (cluster *ClusterDatabase) forEachKeyInSlot(dbIndex int, slot int, cb func(key string) bool) {
+	engine, ok := cluster.db.(databaseface.DBEngine)
+	if !ok {
+		return
+	}
+	engine.ForEach(dbIndex, func(key string, entity *databaseface.DataEntity) bool {
+		if KeySlot(key) != slot {
+			return true
+		}
+		return cb(key)
+	})
+}
+
+// splitNodeAddr 将节点地址拆分为 ip 和端口
+func splitNodeAddr(addr string) (string, int) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+// execClusterSlots 回复 CLUSTER SLOTS：[[begin, end, [ip, port, id], [replica ip, port, id]...], ...]
+func (cluster *ClusterDatabase) execClusterSlots() resp.Reply {
+	table := cluster.slots
+	table.mu.RLock()
+	ranges := table.ranges()
+	table.mu.RUnlock()
+	replies := make([]resp.Reply, 0, len(ranges))
+	for _, r := range ranges {
+		item := []resp.Reply{
+			reply.MakeIntReply(int64(r.begin)),
+			reply.MakeIntReply(int64(r.end)),
+		}
+		for _, node := range append([]string{r.node}, cluster.replicasOf(r.node)...) {
+			host, port := splitNodeAddr(node)
+			item = append(item, reply.MakeMultiRawReply([]resp.Reply{
+				reply.MakeBulkReply([]byte(host)),
+				reply.MakeIntReply(int64(port)),
+				reply.MakeBulkReply([]byte(makeNodeId(node))),
+			}))
+		}
+		replies = append(replies, reply.MakeMultiRawReply(item))
+	}
+	return reply.MakeMultiRawReply(replies)
+}
+
+// execClusterShards 回复 CLUSTER SHARDS，每个主库和它的从库是一个分片
+func (cluster *ClusterDatabase) execClusterShards() resp.Reply {
+	table := cluster.slots
+	table.mu.RLock()
+	ranges := table.ranges()
+	nodes := table.nodes()
+	table.mu.RUnlock()
+	replies := make([]resp.Reply, 0, len(nodes))
+	for _, node := range nodes {
+		if cluster.replicaOf(node) != "" {
+			continue
+		}
+		var slots []resp.Reply
+		for _, r := range ranges {
+			if r.node == node {
+				slots = append(slots, reply.MakeIntReply(int64(r.begin)), reply.MakeIntReply(int64(r.end)))
+			}
+		}
+		nodeInfos := []resp.Reply{cluster.shardNodeInfo(node, "master")}
+		for _, replica := range cluster.replicasOf(node) {
+			nodeInfos = append(nodeInfos, cluster.shardNodeInfo(replica, "replica"))
+		}
+		replies = append(replies, reply.MakeMultiRawReply([]resp.Reply{
+			reply.MakeBulkReply([]byte("slots")), reply.MakeMultiRawReply(slots),
+			reply.MakeBulkReply([]byte("nodes")), reply.MakeMultiRawReply(nodeInfos),
+		}))
+	}
+	return reply.MakeMultiRawReply(replies)
+}
+
+// shardNodeInfo 生成 CLUSTER SHARDS 中节点的描述
+func (cluster *ClusterDatabase) shardNodeInfo(node string, role string) resp.Reply {
+	host, port := splitNodeAddr(node)
+	health := "online"
+	if node != cluster.self && cluster.bus.isFailing(node) {
+		health = "fail"
+	}
+	return reply.MakeMultiRawReply([]resp.Reply{
+		reply.MakeBulkReply([]byte("id")), reply.MakeBulkReply([]byte(makeNodeId(node))),
+		reply.MakeBulkReply([]byte("port")), reply.MakeIntReply(int64(port)),
+		reply.MakeBulkReply([]byte("ip")), reply.MakeBulkReply([]byte(host)),
+		reply.MakeBulkReply([]byte("endpoint")), reply.MakeBulkReply([]byte(host)),
+		reply.MakeBulkReply([]byte("role")), reply.MakeBulkReply([]byte(role)),
+		reply.MakeBulkReply([]byte("replication-offset")), reply.MakeIntReply(0),
+		reply.MakeBulkReply([]byte("health")), reply.MakeBulkReply([]byte(health)),
+	})
+}
+
+// execClusterNodes 回复 CLUSTER NODES，格式与 Redis 相同：
+// <id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> ...
+func (cluster *ClusterDatabase) execClusterNodes() resp.Reply {
+	table := cluster.slots
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	ranges := table.ranges()
+	builder := &strings.Builder{}
+	for _, node := range table.nodes() {
+		builder.WriteString(cluster.nodeLine(node, 0))
+		for _, r := range ranges {
+			if r.node != node {
+				continue
+			}
+			if r.begin == r.end {
+				builder.WriteString(fmt.Sprintf(" %d", r.begin))
+			} else {
+				builder.WriteString(fmt.Sprintf(" %d-%d", r.begin, r.end))
+			}
+		}
+		if node == cluster.self {
+			for slot, target := range table.migrating {
+				builder.WriteString(fmt.Sprintf(" [%d->-%s]", slot, makeNodeId(target)))
+			}
+			for slot, source := range table.importing {
+				builder.WriteString(fmt.Sprintf(" [%d-<-%s]", slot, makeNodeId(source)))
+			}
+		}
+		builder.WriteString("\n")
+	}
+	return reply.MakeBulkReply([]byte(builder.String()))
+}
+
+// nodeLine 生成 CLUSTER NODES 中节点的描述，不包括槽位
+func (cluster *ClusterDatabase) nodeLine(node string, epoch int64) string {
+	host, port := splitNodeAddr(node)
+	flags := "master"
+	master := "-"
+	if primary := cluster.replicaOf(node); primary != "" {
+		flags = "slave"
+		master = makeNodeId(primary)
+	}
+	var pingSent, pongRecv int64
+	linkState := "connected"
+	if node == cluster.self {
+		flags = "myself," + flags
+	} else {
+		status := cluster.bus.status(node)
+		if status.flags != "" {
+			flags += "," + status.flags
+		}
+		pingSent, pongRecv = status.pingSent, status.pongRecv
+		if !status.linkUp {
+			linkState = "disconnected"
+		}
+	}
+	return fmt.Sprintf("%s %s:%d@%d %s %s %d %d %d %s",
+		makeNodeId(node), host, port, port+10000, flags, master, pingSent, pongRecv, epoch, linkState)
+}
+
+// execRingNodes 回复一致性哈希模式下的 CLUSTER NODES，格式与槽位模式相同，但没有槽位信息
+func (cluster *ClusterDatabase) execRingNodes() resp.Reply {
+	cluster.topologyLock.RLock()
+	epoch := cluster.epoch
+	cluster.topologyLock.RUnlock()
+	nodes := append(cluster.members(), cluster.self)
+	sort.Strings(nodes)
+	builder := &strings.Builder{}
+	for _, node := range nodes {
+		builder.WriteString(cluster.nodeLine(node, epoch))
+		builder.WriteString("\n")
+	}
+	return reply.MakeBulkReply([]byte(builder.String()))
+}
+
+// execClusterInfo 回复 CLUSTER INFO
+func (cluster *ClusterDatabase) execClusterInfo() resp.Reply {
+	table := cluster.slots
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	assigned := 0
+	for _, owner := range table.owners {
+		if owner != "" {
+			assigned++
+		}
+	}
+	size := make(map[string]struct{})
+	for _, r := range table.ranges() {
+		size[r.node] = struct{}{}
+	}
+	state := "ok"
+	if assigned < SlotCount {
+		state = "fail"
+	}
+	lines := []string{
+		"cluster_enabled:1",
+		"cluster_state:" + state,
+		"cluster_slots_assigned:" + strconv.Itoa(assigned),
+		"cluster_slots_ok:" + strconv.Itoa(assigned),
+		"cluster_known_nodes:" + strconv.Itoa(len(table.nodeIds)),
+		"cluster_size:" + strconv.Itoa(len(size)),
+	}
+	return reply.MakeBulkReply([]byte(strings.Join(lines, reply.CRLF) + reply.CRLF))
+}
+
+// execClusterSetSlot 处理 CLUSTER SETSLOT <slot> IMPORTING|MIGRATING|NODE <node-id> 和 CLUSTER SETSLOT <slot> STABLE
+// 与 Redis 相同，迁移槽位时需要分别通知源节点和目标节点
+func (cluster *ClusterDatabase) execClusterSetSlot(args [][]byte) resp.Reply {
+	if len(args) < 2 {
+		return reply.MakeArgNumErrReply("cluster|setslot")
+	}
+	slot, errReply := parseSlot(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	action := strings.ToLower(string(args[1]))
+	table := cluster.slots
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if action == "stable" {
+		delete(table.migrating, slot)
+		delete(table.importing, slot)
+		return reply.MakeOkReply()
+	}
+	if len(args) != 3 {
+		return reply.MakeArgNumErrReply("cluster|setslot")
+	}
+	nodeId := string(args[2])
+	node, ok := table.nodeIds[nodeId]
+	if !ok {
+		return reply.MakeErrReply("ERR I don't know about node " + nodeId)
+	}
+	switch action {
+	case "migrating":
+		if table.owners[slot] != cluster.self {
+			return reply.MakeErrReply(fmt.Sprintf("ERR I'm not the owner of hash slot %d", slot))
+		}
+		table.migrating[slot] = node
+	case "importing":
+		if table.owners[slot] == cluster.self {
+			return reply.MakeErrReply(fmt.Sprintf("ERR I'm already the owner of hash slot %d", slot))
+		}
+		table.importing[slot] = node
+	case "node":
+		table.owners[slot] = node
+		if node == cluster.self {
+			delete(table.importing, slot)
+		} else {
+			delete(table.migrating, slot)
+		}
+	default:
+		return reply.MakeErrReply("ERR Invalid CLUSTER SETSLOT action or number of arguments")
+	}
+	return reply.MakeOkReply()
+}
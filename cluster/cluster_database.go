@@ -11,10 +11,14 @@ import (
 	databaseface "goredis/interface/database"     // 数据库接口
 	"goredis/interface/resp"
 	"goredis/lib/consistenthash" // 一致性哈希库，用于选择目标节点
+	"goredis/lib/lock"
 	"goredis/lib/logger"
 	"goredis/resp/reply"
+	"net"
 	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 // ClusterDatabase 表示集群中的一个 Redis 节点实例
@@ -26,15 +30,49 @@ type ClusterDatabase struct {
 	peerPicker     *consistenthash.NodeMap     // 一致性哈希节点选择器
 	peerConnection map[string]*pool.ObjectPool // 各个 peer 节点的连接池
 	db             databaseface.Database       // 当前节点本地数据库
+
+	proxy  bool        // 代理模式，nodes 是不了解集群的后端，db 为空
+	slots  *slotTable  // 槽位模式（cluster-enabled yes）下的槽位分配，为空表示使用一致性哈希转发
+	asking sync.Map    // 发送了 ASKING 的连接
+	bus    *clusterBus // 集群总线，检测节点故障
+
+	// 一致性哈希模式下集群成员可以动态变更，以下字段与 nodes、peerPicker、peerConnection 一起由 topologyLock 保护
+	topologyLock sync.RWMutex
+	epoch        int64                   // 拓扑纪元，每次成员变更加一
+	prevPicker   *consistenthash.NodeMap // 上一个拓扑的哈希环，迁移完成前用于找到键原来所在的节点
+	pending      map[string]struct{}     // 还没有完成迁移的旧节点
+	primary      string                  // 本节点作为从库时复制的主库，空字符串表示本节点是主库
+	replicas     map[string]string       // 通过心跳得知的从库 -> 它复制的主库
+
+	readonly sync.Map // 发送了 READONLY 的连接，只读命令可以在从库上执行
+	peers    sync.Map // 通过 CLUSTER PEERAUTH 认证的其他节点的连接，只有它们可以执行内部命令
+
+	// 跨节点事务的参与者状态
+	keyLocks     *lock.Locks             // 键锁，准备好的事务锁住键直到提交或回滚
+	txLock       sync.Mutex              // 保护 transactions 和 finishedTx
+	transactions map[string]*transaction // 事务 ID -> 本节点参与的事务
+	finishedTx   map[string]int          // 最近结束的事务 ID -> 最终状态，供其他参与者在超时时查询
+	txSeq        uint64                  // 本节点作为协调者生成事务 ID 的序号
+	runId        string                  // 本次启动的随机 ID，参与者可能还保留着重启之前的事务，事务 ID 需要包含它
 }
 
 // MakeClusterDatabase 初始化并启动一个集群节点
 func MakeClusterDatabase() *ClusterDatabase {
+	if config.Properties.Self == "" {
+		// 没有配置 self 时使用监听地址
+		config.Properties.Self = fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port)
+	}
+	checkClusterSecret()
 	cluster := &ClusterDatabase{
-		self:           config.Properties.Self,            // 获取当前节点地址（从配置中读取）
-		db:             database.NewStandaloneDatabase(),  // 初始化单机数据库作为本地存储
-		peerPicker:     consistenthash.NewNodeMap(nil),    // 初始化一致性哈希选择器
-		peerConnection: make(map[string]*pool.ObjectPool), // 创建连接池映射
+		self:           config.Properties.Self,                                                     // 获取当前节点地址（从配置中读取）
+		db:             database.NewStandaloneDatabase(),                                           // 初始化单机数据库作为本地存储
+		peerPicker:     consistenthash.NewNodeMapWithReplicas(config.Properties.VirtualNodes, nil), // 初始化一致性哈希选择器，virtual-nodes 为每个节点的虚拟节点数量
+		peerConnection: make(map[string]*pool.ObjectPool),                                          // 创建连接池映射
+		replicas:       make(map[string]string),
+		keyLocks:       lock.Make(lockStripes),
+		transactions:   make(map[string]*transaction),
+		finishedTx:     make(map[string]int),
+		runId:          makeRunId(),
 	}
 
 	// 收集所有节点地址（包括自身）
@@ -42,27 +80,66 @@ func MakeClusterDatabase() *ClusterDatabase {
 	for _, peer := range config.Properties.Peers {
 		nodes = append(nodes, peer)
 	}
-	nodes = append(nodes, config.Properties.Self) // 加入自身节点
-	cluster.peerPicker.AddNode(nodes...)          // 加入一致性哈希环
-	cluster.nodes = nodes                         // 保存节点列表
+	if config.Properties.ReplicaOf != "" {
+		// 配置了 replicaof 的节点是其他节点的从库，不负责任何键，本地数据库已经开始复制
+		fields := strings.Fields(config.Properties.ReplicaOf)
+		cluster.primary = net.JoinHostPort(fields[0], fields[1])
+	} else {
+		nodes = append(nodes, config.Properties.Self) // 加入自身节点
+	}
+	cluster.peerPicker.AddNode(nodes...) // 加入一致性哈希环
+	cluster.nodes = nodes                // 保存节点列表
+	addNodeWeights(cluster.peerPicker)
+	if config.Properties.ClusterEnabled {
+		// 槽位模式：槽位平均分配给所有节点
+		cluster.slots = makeSlotTable(nodes)
+		if cluster.primary != "" {
+			// 从库不分配槽位，但仍然是集群的已知节点
+			cluster.slots.nodeIds[makeNodeId(cluster.self)] = cluster.self
+		}
+	}
 
 	// 为每个 peer 节点创建一个连接池（不包括自己）
-	ctx := context.Background()
 	for _, peer := range config.Properties.Peers {
-		cluster.peerConnection[peer] = pool.NewObjectPoolWithDefaultConfig(ctx, &connectionFactory{
-			Peer: peer, // 每个节点创建自己的连接工厂
-		})
+		cluster.peerConnection[peer] = makePeerPool(peer)
 	}
+	cluster.bus = makeClusterBus(cluster)
+	cluster.bus.start()
 
 	return cluster
 }
 
+// addNodeWeights 为配置了权重的节点设置权重：node-weights host:port=weight,...
+func addNodeWeights(picker *consistenthash.NodeMap) {
+	for _, item := range config.Properties.NodeWeights {
+		pivot := strings.LastIndexByte(item, '=')
+		if pivot <= 0 {
+			panic("invalid node-weights config: " + item)
+		}
+		weight, err := strconv.Atoi(item[pivot+1:])
+		if err != nil || weight < 1 {
+			panic("invalid node-weights config: " + item)
+		}
+		picker.AddWeightedNode(strings.TrimSpace(item[:pivot]), weight)
+	}
+}
+
+// makePeerPool 创建到 peer 节点的连接池，容量、空闲连接的回收和健康检查由 peer-pool-* 配置决定
+func makePeerPool(peer string) *pool.ObjectPool {
+	return pool.NewObjectPool(context.Background(), &connectionFactory{
+		Peer: peer, // 每个节点创建自己的连接工厂
+	}, makePoolConfig())
+}
+
 // CmdFunc 表示每个 Redis 命令对应的执行函数签名
 type CmdFunc func(cluster *ClusterDatabase, c resp.Connection, cmdAndArgs [][]byte) resp.Reply
 
 // Close 关闭当前节点（释放本地数据库资源）
 func (cluster *ClusterDatabase) Close() {
-	cluster.db.Close()
+	cluster.bus.close()
+	if cluster.db != nil {
+		cluster.db.Close()
+	}
 }
 
 // router 是命令路由器，将命令名映射到具体执行函数
@@ -77,8 +154,27 @@ func (cluster *ClusterDatabase) Exec(c resp.Connection, cmdLine [][]byte) (resul
 			result = &reply.UnknownErrReply{} // 返回通用错误
 		}
 	}()
+	if !cluster.proxy {
+		if isPeerAuth(cmdLine) {
+			return cluster.execPeerAuth(c, cmdLine[2:])
+		}
+		if errReply := cluster.checkPeer(c, cmdLine); errReply != nil {
+			return errReply
+		}
+	}
+	if cluster.slots != nil {
+		// 槽位模式下不转发命令，由客户端根据重定向访问正确的节点
+		return cluster.execSlotMode(c, cmdLine)
+	}
 	cmdName := strings.ToLower(string(cmdLine[0])) // 获取命令名（转换为小写）
-	cmdFunc, ok := router[cmdName]                 // 查找对应处理函数
+	if cluster.proxy {
+		cmdFunc, ok := proxyRouter[cmdName]
+		if !ok {
+			return reply.MakeErrReply("ERR unknown command '" + cmdName + "', or not supported in proxy mode")
+		}
+		return cmdFunc(cluster, c, cmdLine)
+	}
+	cmdFunc, ok := router[cmdName] // 查找对应处理函数
 	if !ok {
 		// 如果命令不存在或在集群模式下不支持，返回错误
 		return reply.MakeErrReply("ERR unknown command '" + cmdName + "', or not supported in cluster mode")
@@ -89,5 +185,10 @@ func (cluster *ClusterDatabase) Exec(c resp.Connection, cmdLine [][]byte) (resul
 
 // AfterClientClose 客户端断开连接后的清理操作（代理到本地数据库）
 func (cluster *ClusterDatabase) AfterClientClose(c resp.Connection) {
-	cluster.db.AfterClientClose(c)
+	cluster.asking.Delete(c)
+	cluster.readonly.Delete(c)
+	cluster.peers.Delete(c)
+	if cluster.db != nil {
+		cluster.db.AfterClientClose(c)
+	}
 }
@@ -7,16 +7,23 @@ import (
 	"goredis/lib/utils"
 	"goredis/resp/client"
 	"goredis/resp/reply"
-	"strconv"
+	"sort"
+	"strings"
+	"time"
 )
 
 // getPeerClient 从连接池中获取一个连接到目标 peer 节点的 client 实例
 func (cluster *ClusterDatabase) getPeerClient(peer string) (*client.Client, error) {
+	cluster.topologyLock.RLock()
 	factory, ok := cluster.peerConnection[peer]
+	cluster.topologyLock.RUnlock()
 	if !ok {
 		return nil, errors.New("connection factory not found") // 找不到目标节点的连接池
 	}
-	raw, err := factory.BorrowObject(context.Background()) // 从连接池借出一个连接对象
+	// 从连接池借出一个连接对象，连接用尽时最多等待 borrowTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), borrowTimeout())
+	defer cancel()
+	raw, err := factory.BorrowObject(ctx)
 	if err != nil {
 		return nil, err // 借连接失败
 	}
@@ -29,7 +36,9 @@ func (cluster *ClusterDatabase) getPeerClient(peer string) (*client.Client, erro
 
 // returnPeerClient 将连接归还给指定 peer 节点的连接池
 func (cluster *ClusterDatabase) returnPeerClient(peer string, peerClient *client.Client) error {
+	cluster.topologyLock.RLock()
 	connectionFactory, ok := cluster.peerConnection[peer]
+	cluster.topologyLock.RUnlock()
 	if !ok {
 		return errors.New("connection factory not found") // 找不到对应的连接池
 	}
@@ -38,14 +47,20 @@ func (cluster *ClusterDatabase) returnPeerClient(peer string, peerClient *client
 
 // relay 用于将命令转发给指定的 peer 节点
 // 注意：
-//   - 如果目标是本节点，则直接调用本地数据库执行命令
+//   - 如果目标是本节点，则锁住命令涉及的键后直接调用本地数据库执行命令
 //   - 否则通过网络连接发送命令
-//   - 自动为连接选择对应的 DB（SELECT index）
+//   - 自动为连接选择对应的 DB（连接池中的连接记录自己选中的 DB，只在不同时发送 SELECT）
 //   - 不允许调用自身的事务命令（Prepare, Commit, Rollback）
+//   - 目标节点处于 FAIL 状态时直接回复 CLUSTERDOWN
 func (cluster *ClusterDatabase) relay(peer string, c resp.Connection, args [][]byte) resp.Reply {
 	if peer == cluster.self {
-		// 如果目标节点是自己，直接调用本地数据库执行命令
-		return cluster.db.Exec(c, args)
+		// 如果目标节点是自己，直接调用本地数据库执行命令，事务锁住的键需要等待事务结束
+		return cluster.execLocked(c, args)
+	}
+
+	// 目标节点已经被集群判定为下线时立即返回错误，不再等待超时
+	if cluster.bus.isFailing(peer) {
+		return makeClusterDownReply(peer)
 	}
 
 	// 否则获取远程连接
@@ -57,20 +72,108 @@ func (cluster *ClusterDatabase) relay(peer string, c resp.Connection, args [][]b
 		_ = cluster.returnPeerClient(peer, peerClient) // 使用完毕后归还连接
 	}()
 
-	// 设置使用相同的 DB（保持一致性）
-	peerClient.Send(utils.ToCmdLine("SELECT", strconv.Itoa(c.GetDBIndex())))
-
-	// 转发真实命令
-	return peerClient.Send(args)
+	// 在与客户端相同的 DB 中执行，连接选中的 DB 不同时才会先发送 SELECT
+	return peerClient.SendDB(c.GetDBIndex(), args)
 }
 
+// broadcastTimeout 广播和分散执行命令时等待所有节点回复的最长时间
+const broadcastTimeout = 3 * time.Second
+
 // broadcast 向集群中的所有节点广播命令（包括自身）
 // 用于执行需要全局一致的命令，例如 FLUSHALL
+// 发给其他节点的命令包装为 ExecLocal，避免对方收到后再次广播，代理模式的后端不了解集群，直接发送原命令
+// 所有节点并行执行，超过 broadcastTimeout 没有回复的节点记为超时
 func (cluster *ClusterDatabase) broadcast(c resp.Connection, args [][]byte) map[string]resp.Reply {
-	result := make(map[string]resp.Reply) // 每个节点对应一个执行结果
-	for _, node := range cluster.nodes {
-		reply := cluster.relay(node, c, args) // 对每个节点进行转发
-		result[node] = reply
+	ctx, cancel := context.WithTimeout(context.Background(), broadcastTimeout)
+	defer cancel()
+	return gather(ctx, cluster.broadcastTargets(), func(node string) resp.Reply {
+		if node == cluster.self || cluster.proxy {
+			return cluster.relay(node, c, args)
+		}
+		return cluster.relay(node, c, utils.ToCmdLine2("ExecLocal", args...))
+	})
+}
+
+// gather 并行地对每个节点调用 call，返回 节点 -> 回复
+// ctx 结束时还没有回复的节点记为超时，不再等待它们
+func gather(ctx context.Context, nodes []string, call func(node string) resp.Reply) map[string]resp.Reply {
+	type result struct {
+		node  string
+		reply resp.Reply
+	}
+	// 缓冲区足够大，超时后仍在执行的 goroutine 也不会阻塞
+	results := make(chan result, len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			results <- result{node: node, reply: call(node)}
+		}(node)
+	}
+	replies := make(map[string]resp.Reply, len(nodes))
+	for len(replies) < len(nodes) {
+		select {
+		case ret := <-results:
+			replies[ret.node] = ret.reply
+		case <-ctx.Done():
+			for _, node := range nodes {
+				if _, ok := replies[node]; !ok {
+					replies[node] = reply.MakeErrReply("IOERR timeout waiting for reply")
+				}
+			}
+		}
+	}
+	return replies
+}
+
+// nodeError 多个节点执行命令时的错误，列出每个出错的节点和它的错误，节点按地址排序
+type nodeError struct {
+	errs map[string]string
+}
+
+// makeNodeError 创建只有一个节点出错的 nodeError
+func makeNodeError(node string, msg string) *nodeError {
+	return &nodeError{errs: map[string]string{node: msg}}
+}
+
+// collectErrors 收集所有节点的错误回复，没有错误时返回 nil
+func collectErrors(replies map[string]resp.Reply) reply.ErrorReply {
+	errs := make(map[string]string)
+	for node, ret := range replies {
+		if errReply, ok := ret.(reply.ErrorReply); ok {
+			errs[node] = errReply.Error()
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &nodeError{errs: errs}
+}
+
+// Nodes 返回出错的节点
+func (e *nodeError) Nodes() []string {
+	nodes := make([]string, 0, len(e.errs))
+	for node := range e.errs {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func (e *nodeError) Error() string {
+	parts := make([]string, 0, len(e.errs))
+	for _, node := range e.Nodes() {
+		parts = append(parts, node+" ("+e.errs[node]+")")
+	}
+	return "ERR error occurs on " + strings.Join(parts, ", ")
+}
+
+func (e *nodeError) ToBytes() []byte {
+	return []byte("-" + e.Error() + reply.CRLF)
+}
+
+// execExecLocal 处理集群内部的 ExecLocal cmd [args...]，在本节点执行被包装的命令
+func execExecLocal(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) < 2 {
+		return reply.MakeArgNumErrReply("execlocal")
 	}
-	return result
+	return cluster.execLocked(c, args[1:])
 }
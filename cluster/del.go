@@ -5,35 +5,27 @@ import (
 	"goredis/resp/reply"
 )
 
-// Del 原子性地删除多个写键（writeKeys）
-// 支持跨节点操作，如果键分布在不同的节点上，会广播指令并采用 try-commit-catch 模式删除
+// Del 删除多个键（keys），返回删除的数量
+// 支持跨节点操作，键按所在节点分组，通过两阶段提交在各个节点上删除，任何节点失败时所有节点都恢复原来的键
 func Del(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
-	// 广播 DEL 命令给所有节点（每个节点会尝试删除它自己本地的数据）
-	replies := cluster.broadcast(c, args)
-
-	var errReply reply.ErrorReply // 用于记录第一个错误响应
-	var deleted int64 = 0         // 累加删除成功的 key 数量
-
-	for _, v := range replies {
-		if reply.IsErrorReply(v) {
-			// 如果有任何节点返回错误，记录下第一个错误
-			errReply = v.(reply.ErrorReply)
-			break // 一旦出现错误就停止统计
-		}
-		// 期望每个返回值都是整数类型（表示成功删除的键个数）
-		intReply, ok := v.(*reply.IntReply)
-		if !ok {
-			errReply = reply.MakeErrReply("error") // 类型不匹配也视为错误
+	if len(args) < 2 {
+		return reply.MakeArgNumErrReply("del")
+	}
+	groups := cluster.groupByNode(c, keysOf(args, 1))
+	if len(groups) == 1 {
+		for node := range groups {
+			return cluster.relay(node, c, args)
 		}
-		// 累加各个节点返回的删除数量
-		deleted += intReply.Code
 	}
-
-	// 如果没有任何错误，返回总共删除的键数
-	if errReply == nil {
-		return reply.MakeIntReply(deleted)
+	if cluster.proxy {
+		// 代理的后端不支持两阶段提交，分别在每个后端上删除
+		return sumIntReplies(cluster.scatter(c, groups, func(indexes []int) [][]byte {
+			return makeSubCmd(args, 1, indexes)
+		}))
 	}
-
-	// 否则，统一返回一个错误信息
-	return reply.MakeErrReply("error occurs: " + errReply.Error())
+	replies, errReply := cluster.execTx(c, splitByNode(args, 1, groups))
+	if errReply != nil {
+		return errReply
+	}
+	return sumIntReplies(replies)
 }
@@ -0,0 +1,82 @@
+package cluster
+
+import (
+	"fmt"
+	"goredis/interface/resp"
+	"goredis/resp/reply"
+	"sort"
+	"strings"
+)
+
+// execInfo 处理 INFO [section ...]，在本节点的输出之后加上集群部分，列出到每个节点的连接池状态
+// 代理模式没有本地数据库，只输出集群部分
+func execInfo(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	var ret resp.Reply = reply.MakeVerbatimReply("txt", nil)
+	if !cluster.proxy {
+		ret = cluster.db.Exec(c, args)
+	}
+	info, ok := ret.(*reply.VerbatimReply)
+	if !ok || !infoWanted(args[1:], "cluster") {
+		return ret
+	}
+	builder := &strings.Builder{}
+	builder.Write(info.Text)
+	if builder.Len() > 0 {
+		builder.WriteString(reply.CRLF)
+	}
+	builder.WriteString("# Cluster" + reply.CRLF)
+	cluster.genPoolInfo(builder)
+	return reply.MakeVerbatimReply("txt", []byte(builder.String()))
+}
+
+// infoWanted 判断 INFO 的参数是否包含 section，不指定或指定 all/default/everything 时包含所有部分
+func infoWanted(args [][]byte, section string) bool {
+	if len(args) == 0 {
+		return true
+	}
+	for _, arg := range args {
+		switch strings.ToLower(string(arg)) {
+		case "all", "default", "everything", section:
+			return true
+		}
+	}
+	return false
+}
+
+// genPoolInfo 输出连接池的配置和每个节点连接池中正在使用、空闲和已经销毁的连接数
+func (cluster *ClusterDatabase) genPoolInfo(builder *strings.Builder) {
+	poolConfig := makePoolConfig()
+	cluster.topologyLock.RLock()
+	defer cluster.topologyLock.RUnlock()
+	enabled := 0
+	if cluster.slots != nil {
+		enabled = 1
+	}
+	writeInfoField(builder, "cluster_enabled", enabled)
+	proxy := 0
+	if cluster.proxy {
+		proxy = 1
+	}
+	writeInfoField(builder, "proxy_mode", proxy)
+	writeInfoField(builder, "peer_pool_max_total", poolConfig.MaxTotal)
+	writeInfoField(builder, "peer_pool_max_idle", poolConfig.MaxIdle)
+	writeInfoField(builder, "peer_pool_borrow_timeout_ms", borrowTimeout().Milliseconds())
+	writeInfoField(builder, "peer_pool_idle_timeout_s", int64(poolConfig.TimeBetweenEvictionRuns.Seconds()))
+	writeInfoField(builder, "connected_peers", len(cluster.peerConnection))
+	peers := make([]string, 0, len(cluster.peerConnection))
+	for peer := range cluster.peerConnection {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	for i, peer := range peers {
+		p := cluster.peerConnection[peer]
+		writeInfoField(builder, fmt.Sprintf("peer%d", i),
+			fmt.Sprintf("addr=%s,active=%d,idle=%d,destroyed=%d,destroyed_by_validation=%d",
+				peer, p.GetNumActive(), p.GetNumIdle(), p.GetDestroyedCount(), p.GetDestroyedByBorrowValidationCount()))
+	}
+}
+
+// writeInfoField 写入一行 key:value
+func writeInfoField(builder *strings.Builder, key string, value interface{}) {
+	builder.WriteString(fmt.Sprintf("%s:%v%s", key, value, reply.CRLF))
+}
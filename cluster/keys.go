@@ -2,30 +2,182 @@ package cluster
 
 import (
 	"goredis/interface/resp"
+	"goredis/lib/utils"
 	"goredis/resp/reply"
+	"math/rand"
+	"sort"
+	"strconv"
 )
 
-// FlushDB 清空当前数据库中的所有数据（对整个集群生效）
+// scanNodeBits SCAN 游标的低位保存正在遍历的节点下标，高位保存该节点上的游标
+const scanNodeBits = 10
+
+// FlushDB 清空当前数据库中的所有数据（对整个集群生效），FLUSHALL 同样使用它清空所有数据库
 // 将命令广播到集群中所有节点，逐个清空各自节点上的数据
 func FlushDB(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
 	// 向所有节点广播 FLUSHDB 命令，让每个节点都清空自己本地的数据库
 	replies := cluster.broadcast(c, args)
 
-	var errReply reply.ErrorReply // 记录第一个出现的错误回复
+	// 任意一个节点出错时返回所有出错的节点及其错误
+	if errReply := collectErrors(replies); errReply != nil {
+		return errReply
+	}
+	return &reply.OkReply{}
+}
+
+// bulkArgs 返回多条批量回复中的参数，空数组的回复由 EmptyMultiBulkReply 表示
+func bulkArgs(ret resp.Reply) ([][]byte, bool) {
+	switch ret := ret.(type) {
+	case *reply.MultiBulkReply:
+		return ret.Args, true
+	case *reply.EmptyMultiBulkReply:
+		return nil, true
+	}
+	return nil, false
+}
+
+// Keys 返回集群中所有匹配 pattern 的键，迁移期间同一个键可能同时在新旧节点上，只返回一次
+func Keys(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) != 2 {
+		return reply.MakeArgNumErrReply("keys")
+	}
+	replies := cluster.broadcast(c, args)
+	if errReply := collectErrors(replies); errReply != nil {
+		return errReply
+	}
+	// 按节点地址的顺序合并，相同的集群状态下结果的顺序总是相同的
+	nodes := make([]string, 0, len(replies))
+	for node := range replies {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	seen := make(map[string]struct{})
+	result := make([][]byte, 0)
+	for _, node := range nodes {
+		keys, ok := bulkArgs(replies[node])
+		if !ok {
+			return makeNodeError(node, "unexpected reply "+strconv.Quote(string(replies[node].ToBytes())))
+		}
+		for _, key := range keys {
+			if _, ok := seen[string(key)]; !ok {
+				seen[string(key)] = struct{}{}
+				result = append(result, key)
+			}
+		}
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+// DBSize 返回集群中当前数据库的键数量，即每个节点的键数量之和
+func DBSize(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) != 1 {
+		return reply.MakeArgNumErrReply("dbsize")
+	}
+	return sumIntReplies(cluster.broadcast(c, args))
+}
+
+// RandomKey 从每个节点随机取一个键，再从中随机返回一个，集群为空时返回 nil
+func RandomKey(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) != 1 {
+		return reply.MakeArgNumErrReply("randomkey")
+	}
+	replies := cluster.broadcast(c, args)
+	if errReply := collectErrors(replies); errReply != nil {
+		return errReply
+	}
+	var keys [][]byte
+	for _, ret := range replies {
+		if bulk, ok := ret.(*reply.BulkReply); ok && bulk.Arg != nil {
+			keys = append(keys, bulk.Arg)
+		}
+	}
+	if len(keys) == 0 {
+		return reply.MakeNullBulkReply()
+	}
+	return reply.MakeBulkReply(keys[rand.Intn(len(keys))])
+}
+
+// Scan 遍历整个集群的键：SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+// 节点按地址排序后依次遍历，游标的低 scanNodeBits 位是节点下标，其余位是该节点上的游标
+// 一个节点遍历结束后游标指向下一个节点，所有节点都遍历结束时返回 0
+// 遍历期间集群的节点发生变化时节点下标可能指向其他节点，与 Redis 在 rehash 时一样可能重复返回一些键
+func Scan(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) < 2 {
+		return reply.MakeArgNumErrReply("scan")
+	}
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR invalid cursor")
+	}
+	nodes := cluster.broadcastTargets()
+	sort.Strings(nodes)
+	index, nodeCursor := splitScanCursor(cursor)
+	if index >= len(nodes) {
+		return makeScanReply(0, nil)
+	}
 
-	for _, v := range replies {
-		if reply.IsErrorReply(v) {
-			// 如果有任意一个节点返回错误，记录下并跳出循环
-			errReply = v.(reply.ErrorReply)
-			break
+	cmdLine := utils.ToCmdLine2("SCAN", append([][]byte{[]byte(strconv.FormatUint(nodeCursor, 10))}, args[2:]...)...)
+	var ret resp.Reply
+	switch {
+	case nodes[index] == cluster.self:
+		ret = cluster.execLocked(c, cmdLine)
+	case cluster.proxy:
+		ret = cluster.relay(nodes[index], c, cmdLine)
+	default:
+		ret = cluster.relay(nodes[index], c, utils.ToCmdLine2("ExecLocal", cmdLine...))
+	}
+	values, ok := parseScanReply(ret)
+	if !ok {
+		if reply.IsErrorReply(ret) {
+			return ret
 		}
+		return makeNodeError(nodes[index], "unexpected reply "+strconv.Quote(string(ret.ToBytes())))
+	}
+	next, err := strconv.ParseUint(string(values[0]), 10, 64)
+	if err != nil {
+		return makeNodeError(nodes[index], "invalid cursor "+string(values[0]))
 	}
+	return makeScanReply(nextScanCursor(index, next, len(nodes)), values[1:])
+}
+
+// splitScanCursor 将集群的游标拆分为节点下标和该节点上的游标
+func splitScanCursor(cursor uint64) (index int, nodeCursor uint64) {
+	return int(cursor & (1<<scanNodeBits - 1)), cursor >> scanNodeBits
+}
+
+// nextScanCursor 根据第 index 个节点返回的游标 next 生成集群的下一个游标，nodeCount 是节点的数量
+func nextScanCursor(index int, next uint64, nodeCount int) uint64 {
+	if next != 0 {
+		return next<<scanNodeBits | uint64(index)
+	}
+	// 这个节点遍历结束，从下一个节点的开头继续
+	if index+1 >= nodeCount {
+		return 0
+	}
+	return uint64(index + 1)
+}
 
-	// 如果所有节点均成功清空数据，则返回 OK 响应
-	if errReply == nil {
-		return &reply.OkReply{}
+// makeScanReply 生成 SCAN 的回复 [cursor, [key ...]]
+func makeScanReply(cursor uint64, keys [][]byte) resp.Reply {
+	if keys == nil {
+		keys = [][]byte{}
 	}
+	return reply.MakeMultiRawReply([]resp.Reply{
+		reply.MakeBulkReply([]byte(strconv.FormatUint(cursor, 10))),
+		reply.MakeMultiBulkReply(keys),
+	})
+}
 
-	// 否则返回统一的错误信息，包含错误详情
-	return reply.MakeErrReply("error occurs: " + errReply.Error())
+// parseScanReply 将节点的 SCAN 回复 [cursor, [key ...]] 展开为 [cursor, key ...]
+func parseScanReply(ret resp.Reply) ([][]byte, bool) {
+	raw, ok := ret.(*reply.MultiRawReply)
+	if !ok || len(raw.Replies) != 2 {
+		return nil, false
+	}
+	next, ok := raw.Replies[0].(*reply.BulkReply)
+	if !ok {
+		return nil, false
+	}
+	keys, ok := bulkArgs(raw.Replies[1])
+	return append([][]byte{next.Arg}, keys...), ok
 }
@@ -0,0 +1,41 @@
+package cluster
+
+import "testing"
+
+// TestScanCursor 集群游标编码节点下标和节点上的游标，一个节点结束后指向下一个节点，最后一个节点结束后为 0
+func TestScanCursor(t *testing.T) {
+	tests := []struct {
+		index     int
+		next      uint64
+		nodeCount int
+		expect    uint64
+	}{
+		{index: 0, next: 5, nodeCount: 3, expect: 5<<scanNodeBits | 0},
+		{index: 2, next: 12345, nodeCount: 3, expect: 12345<<scanNodeBits | 2},
+		{index: 0, next: 0, nodeCount: 3, expect: 1},
+		{index: 1, next: 0, nodeCount: 3, expect: 2},
+		{index: 2, next: 0, nodeCount: 3, expect: 0},
+		{index: 0, next: 0, nodeCount: 1, expect: 0},
+	}
+	for _, tt := range tests {
+		cursor := nextScanCursor(tt.index, tt.next, tt.nodeCount)
+		if cursor != tt.expect {
+			t.Errorf("nextScanCursor(%d, %d, %d) = %d, expect %d", tt.index, tt.next, tt.nodeCount, cursor, tt.expect)
+			continue
+		}
+		if cursor == 0 {
+			continue
+		}
+		index, nodeCursor := splitScanCursor(cursor)
+		expectIndex, expectNodeCursor := tt.index, tt.next
+		if tt.next == 0 {
+			expectIndex = tt.index + 1
+		}
+		if index != expectIndex || nodeCursor != expectNodeCursor {
+			t.Errorf("splitScanCursor(%d) = (%d, %d), expect (%d, %d)", cursor, index, nodeCursor, expectIndex, expectNodeCursor)
+		}
+	}
+	if index, nodeCursor := splitScanCursor(0); index != 0 || nodeCursor != 0 {
+		t.Errorf("splitScanCursor(0) = (%d, %d), expect (0, 0)", index, nodeCursor)
+	}
+}
@@ -0,0 +1,448 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	pool "github.com/jolestar/go-commons-pool/v2"
+	"goredis/config"
+	"goredis/interface/resp"
+	"goredis/lib/consistenthash"
+	"goredis/lib/logger"
+	"goredis/resp/connection"
+	"goredis/resp/reply"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ * 一致性哈希模式下的动态成员变更
+ * CLUSTER MEET/FORGET 在收到命令的节点上生成新的拓扑并将纪元加一，然后通过 CLUSTER TOPOLOGY 广播给新旧拓扑中的所有节点。
+ * 节点只接受比当前更新的拓扑：纪元更大，或纪元相同但成员列表的字典序更大，这样同时发起的变更最终在所有节点上得到相同的环。
+ * 应用新拓扑后，每个节点在后台把不再属于自己的键迁移到新的节点，完成后广播 CLUSTER MIGRATED。
+ * 在所有旧节点完成迁移之前，访问的键如果还留在旧节点上，新节点会先把它拉取过来，迁移期间仍然可以读写
+ */
+
+// topology 集群成员及其权重
+type topology struct {
+	epoch  int64
+	nodes  map[string]int    // 节点名 -> 权重，节点名决定它在环上的位置
+	owners map[string]string // 从库提升后，节点名 -> 接管这些位置的节点
+}
+
+func makeTopology(epoch int64) *topology {
+	return &topology{
+		epoch:  epoch,
+		nodes:  make(map[string]int),
+		owners: make(map[string]string),
+	}
+}
+
+// topologyOf 根据哈希环生成拓扑
+func topologyOf(epoch int64, picker *consistenthash.NodeMap) *topology {
+	t := makeTopology(epoch)
+	for _, name := range picker.Names() {
+		t.nodes[name] = picker.Weight(name)
+		if owner := picker.Owner(name); owner != name {
+			t.owners[name] = owner
+		}
+	}
+	return t
+}
+
+// owner 返回负责节点名 name 对应位置的节点
+func (t *topology) owner(name string) string {
+	if owner, ok := t.owners[name]; ok {
+		return owner
+	}
+	return name
+}
+
+// members 返回按节点名排序的成员列表，格式为 host:port=weight，位置被接管时为 host:port=weight>owner
+func (t *topology) members() []string {
+	result := make([]string, 0, len(t.nodes))
+	for name, weight := range t.nodes {
+		member := name + "=" + strconv.Itoa(weight)
+		if owner := t.owner(name); owner != name {
+			member += ">" + owner
+		}
+		result = append(result, member)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// newer 判断 t 是否应该取代 other
+func (t *topology) newer(other *topology) bool {
+	if t.epoch != other.epoch {
+		return t.epoch > other.epoch
+	}
+	return strings.Join(t.members(), ",") > strings.Join(other.members(), ",")
+}
+
+// samePlacement 判断两个拓扑中键在环上的位置是否相同，只有负责位置的节点发生变化时不需要迁移数据
+func (t *topology) samePlacement(other *topology) bool {
+	if len(t.nodes) != len(other.nodes) {
+		return false
+	}
+	for name, weight := range t.nodes {
+		if other.nodes[name] != weight {
+			return false
+		}
+	}
+	return true
+}
+
+// picker 根据拓扑生成哈希环
+func (t *topology) picker() *consistenthash.NodeMap {
+	picker := consistenthash.NewNodeMapWithReplicas(config.Properties.VirtualNodes, nil)
+	for name, weight := range t.nodes {
+		picker.AddWeightedNode(name, weight)
+	}
+	for name, owner := range t.owners {
+		picker.SetOwner(name, owner)
+	}
+	return picker
+}
+
+// parseMembers 解析 members 生成的逗号分隔的成员列表
+func parseMembers(epoch int64, arg string) (*topology, error) {
+	t := makeTopology(epoch)
+	for _, item := range strings.Split(arg, ",") {
+		owner := ""
+		if pivot := strings.IndexByte(item, '>'); pivot > 0 {
+			item, owner = item[:pivot], item[pivot+1:]
+		}
+		pivot := strings.LastIndexByte(item, '=')
+		if pivot <= 0 {
+			return nil, errors.New("invalid member: " + item)
+		}
+		weight, err := strconv.Atoi(item[pivot+1:])
+		if err != nil || weight < 1 {
+			return nil, errors.New("invalid member: " + item)
+		}
+		name := item[:pivot]
+		t.nodes[name] = weight
+		if owner != "" && owner != name {
+			t.owners[name] = owner
+		}
+	}
+	return t, nil
+}
+
+// makeTopologyCmd 生成广播拓扑的命令：CLUSTER TOPOLOGY <epoch> <members> <previous members>
+// 同时携带上一个拓扑，刚加入的节点也能知道键原来所在的节点
+func makeTopologyCmd(t *topology, prev *topology) [][]byte {
+	return [][]byte{
+		[]byte("CLUSTER"),
+		[]byte("TOPOLOGY"),
+		[]byte(strconv.FormatInt(t.epoch, 10)),
+		[]byte(strings.Join(t.members(), ",")),
+		[]byte(strings.Join(prev.members(), ",")),
+	}
+}
+
+// execRingCluster 处理一致性哈希模式下的 CLUSTER 子命令
+func execRingCluster(cluster *ClusterDatabase, subCmd string, args [][]byte) resp.Reply {
+	switch subCmd {
+	case "distribution":
+		return cluster.execClusterDistribution()
+	case "meet":
+		return cluster.execMeet(args)
+	case "forget":
+		return cluster.execForget(args)
+	case "topology":
+		return cluster.execTopology(args)
+	case "migrated":
+		return cluster.execMigrated(args)
+	case "nodes":
+		return cluster.execRingNodes()
+	case "heartbeat":
+		return cluster.execHeartbeat(args)
+	case "fail":
+		return cluster.execFail(args)
+	case "replicate":
+		return cluster.execReplicate(args)
+	case "replicas", "slaves":
+		return cluster.execReplicas(args)
+	case "failover":
+		return cluster.execFailover(args)
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + subCmd + "', or not supported in cluster mode")
+}
+
+// execMeet 处理 CLUSTER MEET <ip> <port> [weight]，将节点加入集群或修改节点的权重
+func (cluster *ClusterDatabase) execMeet(args [][]byte) resp.Reply {
+	if len(args) != 2 && len(args) != 3 {
+		return reply.MakeArgNumErrReply("cluster|meet")
+	}
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil || port <= 0 || port > 65535 {
+		return reply.MakeErrReply("ERR Invalid node address specified: " + string(args[0]) + ":" + string(args[1]))
+	}
+	weight := 1
+	if len(args) == 3 {
+		weight, err = strconv.Atoi(string(args[2]))
+		if err != nil || weight < 1 {
+			return reply.MakeErrReply("ERR Invalid node weight")
+		}
+	}
+	addr := net.JoinHostPort(string(args[0]), strconv.Itoa(port))
+	return cluster.changeTopology(func(t *topology) resp.Reply {
+		if t.nodes[addr] == weight {
+			return reply.MakeOkReply()
+		}
+		t.nodes[addr] = weight
+		return nil
+	})
+}
+
+// execForget 处理 CLUSTER FORGET <node-id|ip:port>，将节点移出集群，它的键会迁移到其他节点
+func (cluster *ClusterDatabase) execForget(args [][]byte) resp.Reply {
+	if len(args) != 1 {
+		return reply.MakeArgNumErrReply("cluster|forget")
+	}
+	target := string(args[0])
+	if target == cluster.self || target == makeNodeId(cluster.self) {
+		return reply.MakeErrReply("ERR I tried hard but I can't forget myself...")
+	}
+	// 从库不在哈希环上，只需要从本节点的记录中删除
+	if cluster.forgetReplica(target) {
+		return reply.MakeOkReply()
+	}
+	return cluster.changeTopology(func(t *topology) resp.Reply {
+		found := false
+		for name := range t.nodes {
+			owner := t.owner(name)
+			if owner != target && makeNodeId(owner) != target {
+				continue
+			}
+			if owner == cluster.self {
+				return reply.MakeErrReply("ERR I tried hard but I can't forget myself...")
+			}
+			delete(t.nodes, name)
+			delete(t.owners, name)
+			found = true
+		}
+		if !found {
+			return reply.MakeErrReply("ERR Unknown node " + target)
+		}
+		return nil
+	})
+}
+
+// changeTopology 修改当前拓扑生成新的纪元，应用到本节点后广播给新旧拓扑中的所有节点
+// modify 返回非空回复时不做修改，直接返回该回复
+func (cluster *ClusterDatabase) changeTopology(modify func(t *topology) resp.Reply) resp.Reply {
+	cluster.topologyLock.RLock()
+	prev := topologyOf(cluster.epoch, cluster.peerPicker)
+	next := topologyOf(cluster.epoch+1, cluster.peerPicker)
+	cluster.topologyLock.RUnlock()
+
+	if ret := modify(next); ret != nil {
+		return ret
+	}
+	if !cluster.applyTopology(next, prev) {
+		return reply.MakeErrReply("ERR cluster topology changed concurrently, please retry")
+	}
+
+	// 没有收到的节点发送心跳时会发现自己的纪元落后，届时再收到完整的拓扑
+	targets := cluster.members()
+	for _, t := range []*topology{prev, next} {
+		for name := range t.nodes {
+			targets = append(targets, name, t.owner(name))
+		}
+	}
+	cluster.notify(targets, makeTopologyCmd(next, prev))
+	return reply.MakeOkReply()
+}
+
+// notify 并行地将命令发送给 targets 中除自己以外的节点，等待全部完成，失败时只记录日志
+func (cluster *ClusterDatabase) notify(targets []string, cmdLine [][]byte) {
+	sent := map[string]struct{}{cluster.self: {}}
+	var wg sync.WaitGroup
+	for _, node := range targets {
+		if _, ok := sent[node]; ok {
+			continue
+		}
+		sent[node] = struct{}{}
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			// 从库没有连接池，relayTimeout 会临时建立连接
+			ret := cluster.relayTimeout(node, &connection.FakeConn{}, cmdLine, migrateTimeout)
+			if reply.IsErrorReply(ret) {
+				logger.Warn(fmt.Sprintf("cluster: send %s to %s failed: %s",
+					strings.ToUpper(string(cmdLine[1])), node, string(ret.ToBytes())))
+			}
+		}(node)
+	}
+	wg.Wait()
+}
+
+// execTopology 处理其他节点广播的 CLUSTER TOPOLOGY <epoch> <members> <previous members>
+func (cluster *ClusterDatabase) execTopology(args [][]byte) resp.Reply {
+	if len(args) != 3 {
+		return reply.MakeArgNumErrReply("cluster|topology")
+	}
+	epoch, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR invalid epoch")
+	}
+	next, err := parseMembers(epoch, string(args[1]))
+	if err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	prev, err := parseMembers(epoch-1, string(args[2]))
+	if err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	cluster.applyTopology(next, prev)
+	return reply.MakeOkReply()
+}
+
+// applyTopology 将比当前更新的拓扑应用到本节点并开始迁移键，拓扑不比当前新时返回 false
+// 只有负责位置的节点发生变化时（从库提升为主库）键的位置不变，不需要迁移，本节点根据新的拓扑调整自己复制的主库
+func (cluster *ClusterDatabase) applyTopology(next *topology, prev *topology) bool {
+	cluster.topologyLock.Lock()
+	if !next.newer(topologyOf(cluster.epoch, cluster.peerPicker)) {
+		cluster.topologyLock.Unlock()
+		return false
+	}
+	oldPicker := cluster.peerPicker
+	picker := next.picker()
+	cluster.epoch = next.epoch
+	cluster.peerPicker = picker
+	if !next.samePlacement(prev) {
+		cluster.prevPicker = prev.picker()
+		cluster.pending = make(map[string]struct{})
+		for name := range prev.nodes {
+			cluster.pending[prev.owner(name)] = struct{}{}
+		}
+	}
+	cluster.nodes = picker.Nodes()
+	// 移出集群的节点的连接池保留到迁移结束，迁移期间仍然可能需要从它们拉取键
+	for _, t := range []*topology{next, prev} {
+		for name := range t.nodes {
+			for _, node := range []string{name, t.owner(name)} {
+				if _, ok := cluster.peerConnection[node]; !ok && node != cluster.self {
+					cluster.peerConnection[node] = makePeerPool(node)
+				}
+			}
+		}
+	}
+	// 位置被接管的节点成为接管者的从库
+	for _, name := range oldPicker.Names() {
+		old := oldPicker.Owner(name)
+		if owner := picker.Owner(name); owner != "" && old != cluster.self && !picker.HasNode(old) {
+			cluster.replicas[old] = owner
+		}
+	}
+	for _, node := range cluster.nodes {
+		delete(cluster.replicas, node)
+	}
+	primary := cluster.primary
+	switch {
+	case picker.HasNode(cluster.self):
+		primary = ""
+	case primary != "":
+		if node := followNode(oldPicker, picker, primary); node != "" {
+			primary = node
+		}
+	default:
+		// 本节点的位置被其他节点接管，成为它的从库
+		primary = followNode(oldPicker, picker, cluster.self)
+	}
+	changed := primary != cluster.primary
+	cluster.primary = primary
+	cluster.topologyLock.Unlock()
+
+	logger.Info(fmt.Sprintf("cluster: apply topology epoch %d: %s", next.epoch, strings.Join(next.members(), ",")))
+	if changed {
+		cluster.replicate(primary)
+	}
+	go cluster.migrate(next.epoch)
+	return true
+}
+
+// followNode 返回新的哈希环中接替 node 的节点：node 仍然负责键时返回它自己，
+// 否则返回接管了 node 原来的位置的节点，没有时返回空字符串
+func followNode(oldPicker *consistenthash.NodeMap, picker *consistenthash.NodeMap, node string) string {
+	if picker.HasNode(node) {
+		return node
+	}
+	for _, name := range oldPicker.Names() {
+		if oldPicker.Owner(name) != node {
+			continue
+		}
+		if owner := picker.Owner(name); owner != "" {
+			return owner
+		}
+	}
+	return picker.Owner(node)
+}
+
+// execMigrated 处理 CLUSTER MIGRATED <epoch> <node>，表示 node 已经迁出所有不属于它的键
+func (cluster *ClusterDatabase) execMigrated(args [][]byte) resp.Reply {
+	if len(args) != 2 {
+		return reply.MakeArgNumErrReply("cluster|migrated")
+	}
+	epoch, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR invalid epoch")
+	}
+	cluster.markMigrated(epoch, string(args[1]))
+	return reply.MakeOkReply()
+}
+
+// markMigrated 记录节点完成了 epoch 的迁移，所有旧节点都完成后不再需要旧的哈希环
+func (cluster *ClusterDatabase) markMigrated(epoch int64, node string) {
+	cluster.topologyLock.Lock()
+	if epoch != cluster.epoch || cluster.prevPicker == nil {
+		cluster.topologyLock.Unlock()
+		return
+	}
+	delete(cluster.pending, node)
+	if len(cluster.pending) > 0 {
+		cluster.topologyLock.Unlock()
+		return
+	}
+	cluster.prevPicker = nil
+	var stale []*pool.ObjectPool
+	for peer, p := range cluster.peerConnection {
+		if !cluster.peerPicker.HasNode(peer) {
+			stale = append(stale, p)
+			delete(cluster.peerConnection, peer)
+		}
+	}
+	cluster.topologyLock.Unlock()
+
+	for _, p := range stale {
+		p.Close(context.Background())
+	}
+	logger.Info(fmt.Sprintf("cluster: all nodes finished migration of topology epoch %d", epoch))
+}
+
+// pickNode 返回当前拓扑中负责 key 的节点
+func (cluster *ClusterDatabase) pickNode(key string) string {
+	cluster.topologyLock.RLock()
+	defer cluster.topologyLock.RUnlock()
+	return cluster.peerPicker.PickNode(key)
+}
+
+// broadcastTargets 返回广播命令的目标节点：当前的所有成员，以及还没有迁出键的旧节点
+func (cluster *ClusterDatabase) broadcastTargets() []string {
+	cluster.topologyLock.RLock()
+	defer cluster.topologyLock.RUnlock()
+	targets := make([]string, 0, len(cluster.nodes)+len(cluster.pending))
+	targets = append(targets, cluster.nodes...)
+	for node := range cluster.pending {
+		if !cluster.peerPicker.HasNode(node) {
+			targets = append(targets, node)
+		}
+	}
+	return targets
+}
@@ -0,0 +1,236 @@
+package cluster
+
+import (
+	"fmt"
+	"goredis/config"
+	databaseface "goredis/interface/database"
+	"goredis/interface/resp"
+	"goredis/lib/logger"
+	"goredis/lib/utils"
+	"goredis/resp/connection"
+	"goredis/resp/reply"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	migrateTimeout       = 5 * time.Second // 迁移单个键的超时时间
+	migrateRetryInterval = time.Second     // 有键迁移失败时重试的间隔
+)
+
+// execMigrate 处理 MIGRATE host port key destination-db timeout [COPY] [REPLACE]
+// 与 Redis 相同，使用 DUMP/RESTORE 将当前 DB 中的键连同过期时间一起转移到目标实例，成功后删除本地的键
+func execMigrate(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) < 6 {
+		return reply.MakeArgNumErrReply("migrate")
+	}
+	port, err := strconv.Atoi(string(args[2]))
+	if err != nil || port <= 0 || port > 65535 {
+		return reply.MakeErrReply("ERR Invalid port")
+	}
+	key := string(args[3])
+	destDB, err := strconv.Atoi(string(args[4]))
+	if err != nil || destDB < 0 {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	timeoutMs, err := strconv.Atoi(string(args[5]))
+	if err != nil || timeoutMs < 0 {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	if timeout == 0 {
+		timeout = migrateTimeout
+	}
+	copyKey, replace := false, false
+	for _, arg := range args[6:] {
+		switch strings.ToUpper(string(arg)) {
+		case "COPY":
+			copyKey = true
+		case "REPLACE":
+			replace = true
+		default:
+			return &reply.SyntaxErrReply{}
+		}
+	}
+	target := net.JoinHostPort(string(args[1]), strconv.Itoa(port))
+	if target == cluster.self {
+		return reply.MakeErrReply("ERR Target instance is the same as the source")
+	}
+	return cluster.migrateKey(c.GetDBIndex(), key, target, destDB, copyKey, replace, timeout)
+}
+
+// migrateKey 将本地 dbIndex 中的 key 转移到 target 的 destDB，回复 OK、NOKEY 或错误
+func (cluster *ClusterDatabase) migrateKey(dbIndex int, key string, target string, destDB int,
+	copyKey bool, replace bool, timeout time.Duration) resp.Reply {
+	conn := &connection.FakeConn{}
+	conn.SelectDB(dbIndex)
+	ret := cluster.db.Exec(conn, utils.ToCmdLine("DUMP", key))
+	if reply.IsErrorReply(ret) {
+		return ret
+	}
+	payload, ok := ret.(*reply.BulkReply)
+	if !ok {
+		return reply.MakeStatusReply("NOKEY")
+	}
+	ttlReply, ok := cluster.db.Exec(conn, utils.ToCmdLine("PTTL", key)).(*reply.IntReply)
+	if !ok || ttlReply.Code == -2 {
+		return reply.MakeStatusReply("NOKEY")
+	}
+	ttl := ttlReply.Code
+	if ttl < 0 {
+		ttl = 0 // 没有过期时间
+	}
+	restore := utils.ToCmdLine2("RESTORE", []byte(key), []byte(strconv.FormatInt(ttl, 10)), payload.Arg)
+	if replace {
+		restore = append(restore, []byte("REPLACE"))
+	}
+	targetConn := &connection.FakeConn{}
+	targetConn.SelectDB(destDB)
+	ret = cluster.relayTimeout(target, targetConn, restore, timeout)
+	if reply.IsErrorReply(ret) {
+		return ret
+	}
+	if !copyKey {
+		cluster.db.Exec(conn, utils.ToCmdLine("DEL", key))
+	}
+	return reply.MakeOkReply()
+}
+
+// relayTimeout 在 timeout 内将命令转发给 peer，peer 不是集群成员时临时建立一个连接
+func (cluster *ClusterDatabase) relayTimeout(peer string, c resp.Connection, args [][]byte, timeout time.Duration) resp.Reply {
+	cluster.topologyLock.RLock()
+	_, member := cluster.peerConnection[peer]
+	cluster.topologyLock.RUnlock()
+
+	result := make(chan resp.Reply, 1)
+	go func() {
+		if member {
+			result <- cluster.relay(peer, c, args)
+			return
+		}
+		peerClient, err := makePeerClient(peer)
+		if err != nil {
+			result <- reply.MakeErrReply("IOERR error or timeout connecting to the client")
+			return
+		}
+		peerClient.Start()
+		defer peerClient.Close()
+		result <- peerClient.SendDB(c.GetDBIndex(), args)
+	}()
+	select {
+	case ret := <-result:
+		return ret
+	case <-time.After(timeout):
+		return reply.MakeErrReply("IOERR error or timeout reading to target instance")
+	}
+}
+
+// isBusyKey 判断 RESTORE 是否因为目标实例上已经存在该键而失败
+func isBusyKey(ret resp.Reply) bool {
+	errReply, ok := ret.(reply.ErrorReply)
+	return ok && strings.HasPrefix(errReply.Error(), "BUSYKEY")
+}
+
+// migrate 将本地不再属于自己的键迁移到拓扑 epoch 中负责它们的节点，全部完成后通知其他节点
+// 从库的数据来自主库，不需要迁移
+func (cluster *ClusterDatabase) migrate(epoch int64) {
+	if cluster.primaryNode() == "" && !cluster.migrateKeys(epoch) {
+		return
+	}
+	cluster.markMigrated(epoch, cluster.self)
+	cluster.notify(cluster.members(), utils.ToCmdLine("CLUSTER", "MIGRATED", strconv.FormatInt(epoch, 10), cluster.self))
+}
+
+// migrateKeys 迁移本地不属于自己的键，有键迁移失败时（例如目标节点暂时不可达）稍后重试
+// 拓扑再次变化时停止并返回 false，由新拓扑的迁移接手
+func (cluster *ClusterDatabase) migrateKeys(epoch int64) bool {
+	engine, ok := cluster.db.(databaseface.DBEngine)
+	if !ok {
+		return false
+	}
+	for {
+		moved, failed := 0, 0
+		for dbIndex := 0; dbIndex < config.Properties.Databases; dbIndex++ {
+			var keys []string
+			engine.ForEach(dbIndex, func(key string, entity *databaseface.DataEntity) bool {
+				keys = append(keys, key)
+				return true
+			})
+			for _, key := range keys {
+				if cluster.currentEpoch() != epoch {
+					return false
+				}
+				target := cluster.pickNode(key)
+				if target == cluster.self {
+					continue
+				}
+				ret := cluster.migrateKey(dbIndex, key, target, dbIndex, false, false, migrateTimeout)
+				if isBusyKey(ret) {
+					// 新节点上已经有更新的值，丢弃本地的旧值
+					conn := &connection.FakeConn{}
+					conn.SelectDB(dbIndex)
+					cluster.db.Exec(conn, utils.ToCmdLine("DEL", key))
+				} else if reply.IsErrorReply(ret) {
+					logger.Warn(fmt.Sprintf("cluster: migrate key %s to %s failed: %s", key, target, string(ret.ToBytes())))
+					failed++
+					continue
+				}
+				moved++
+			}
+		}
+		if failed == 0 {
+			logger.Info(fmt.Sprintf("cluster: migrated %d keys for topology epoch %d", moved, epoch))
+			return true
+		}
+		time.Sleep(migrateRetryInterval)
+	}
+}
+
+// currentEpoch 返回当前的拓扑纪元
+func (cluster *ClusterDatabase) currentEpoch() int64 {
+	cluster.topologyLock.RLock()
+	defer cluster.topologyLock.RUnlock()
+	return cluster.epoch
+}
+
+// prepareKeys 返回负责 keys[0] 的节点
+// 迁移期间由本节点负责的键可能还留在旧节点上，执行命令前先从旧节点把它们拉取过来
+func (cluster *ClusterDatabase) prepareKeys(c resp.Connection, keys ...string) string {
+	cluster.topologyLock.RLock()
+	peer := cluster.peerPicker.PickNode(keys[0])
+	sources := make(map[string]string)
+	if cluster.prevPicker != nil {
+		for _, key := range keys {
+			if cluster.peerPicker.PickNode(key) != cluster.self {
+				continue
+			}
+			source := cluster.prevPicker.PickNode(key)
+			if _, ok := cluster.pending[source]; ok && source != cluster.self {
+				sources[key] = source
+			}
+		}
+	}
+	cluster.topologyLock.RUnlock()
+
+	for key, source := range sources {
+		cluster.pullKey(c, key, source)
+	}
+	return peer
+}
+
+// pullKey 本地不存在 key 时请求 source 将它 MIGRATE 到本节点
+func (cluster *ClusterDatabase) pullKey(c resp.Connection, key string, source string) {
+	exists, ok := cluster.db.Exec(c, utils.ToCmdLine("EXISTS", key)).(*reply.IntReply)
+	if !ok || exists.Code > 0 {
+		return
+	}
+	host, port := splitNodeAddr(cluster.self)
+	ret := cluster.relay(source, c, utils.ToCmdLine("MIGRATE", host, strconv.Itoa(port), key,
+		strconv.Itoa(c.GetDBIndex()), strconv.Itoa(int(migrateTimeout/time.Millisecond))))
+	if reply.IsErrorReply(ret) && !isBusyKey(ret) {
+		// 拉取失败时仍然在本地执行命令，旧节点完成迁移后数据会到达本节点
+		logger.Warn(fmt.Sprintf("cluster: pull key %s from %s failed: %s", key, source, string(ret.ToBytes())))
+	}
+}
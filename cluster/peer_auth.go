@@ -0,0 +1,110 @@
+package cluster
+
+/*
+ * 节点之间的内部命令（两阶段提交、ExecLocal、总线和成员变更使用的 CLUSTER 子命令）只接受其他节点的连接
+ * 节点的连接池、总线和临时连接在建立连接后先发送 CLUSTER PEERAUTH <secret>，
+ * secret 为 cluster-secret，没有配置时使用 requirepass，认证成功的连接记录在 cluster.peers 中，
+ * 其他连接执行内部命令时返回 NOPERM。两个配置都为空时无法区分节点和客户端，集群节点拒绝启动
+ */
+
+import (
+	"crypto/subtle"
+	"goredis/config"
+	"goredis/interface/resp"
+	"goredis/lib/utils"
+	"goredis/resp/client"
+	"goredis/resp/reply"
+	"strings"
+)
+
+// internalCommands 节点之间使用的命令，客户端不能直接执行
+var internalCommands = map[string]struct{}{
+	"prepare":   {},
+	"commit":    {},
+	"rollback":  {},
+	"release":   {},
+	"txstatus":  {},
+	"execlocal": {},
+}
+
+// internalClusterCommands 节点之间使用的 CLUSTER 子命令
+var internalClusterCommands = map[string]struct{}{
+	"heartbeat": {},
+	"fail":      {},
+	"promoted":  {},
+	"topology":  {},
+	"migrated":  {},
+}
+
+// clusterSecret 节点之间认证使用的密钥
+func clusterSecret() string {
+	if config.Properties.ClusterSecret != "" {
+		return config.Properties.ClusterSecret
+	}
+	return config.Properties.RequirePass
+}
+
+// checkClusterSecret 集群节点启动时检查是否配置了节点之间认证使用的密钥，没有配置时任何客户端都可以执行内部命令
+func checkClusterSecret() {
+	if clusterSecret() == "" {
+		panic("cluster mode requires cluster-secret (or requirepass) to authenticate internal commands between nodes")
+	}
+}
+
+// makePeerClient 创建到其他节点的连接，每次建立连接后先通过 AUTH 和 CLUSTER PEERAUTH 认证
+func makePeerClient(addr string) (*client.Client, error) {
+	var handshake [][][]byte
+	if config.Properties.RequirePass != "" {
+		handshake = append(handshake, utils.ToCmdLine("AUTH", config.Properties.RequirePass))
+	}
+	handshake = append(handshake, utils.ToCmdLine("CLUSTER", "PEERAUTH", clusterSecret()))
+	return client.MakeHandshakeClient(addr, handshake...)
+}
+
+// isInternalCommand 判断命令是否是节点之间的内部命令
+func isInternalCommand(cmdLine [][]byte) bool {
+	name := strings.ToLower(string(cmdLine[0]))
+	if _, ok := internalCommands[name]; ok {
+		return true
+	}
+	if name != "cluster" || len(cmdLine) < 2 {
+		return false
+	}
+	_, ok := internalClusterCommands[strings.ToLower(string(cmdLine[1]))]
+	return ok
+}
+
+// isPeerAuth 判断命令是否是 CLUSTER PEERAUTH
+func isPeerAuth(cmdLine [][]byte) bool {
+	return len(cmdLine) >= 2 && strings.EqualFold(string(cmdLine[0]), "cluster") &&
+		strings.EqualFold(string(cmdLine[1]), "peerauth")
+}
+
+// execPeerAuth 处理 CLUSTER PEERAUTH <secret>，认证成功后连接可以执行内部命令
+func (cluster *ClusterDatabase) execPeerAuth(c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) != 1 {
+		return reply.MakeArgNumErrReply("cluster|peerauth")
+	}
+	secret := clusterSecret()
+	if secret == "" || subtle.ConstantTimeCompare(args[0], []byte(secret)) != 1 {
+		cluster.peers.Delete(c)
+		return reply.MakeErrReply("ERR invalid cluster secret")
+	}
+	cluster.peers.Store(c, true)
+	return reply.MakeOkReply()
+}
+
+// checkPeer 非节点的连接执行内部命令时返回 NOPERM 错误
+func (cluster *ClusterDatabase) checkPeer(c resp.Connection, cmdLine [][]byte) resp.Reply {
+	if !isInternalCommand(cmdLine) {
+		return nil
+	}
+	if _, ok := cluster.peers.Load(c); ok {
+		return nil
+	}
+	name := strings.ToLower(string(cmdLine[0]))
+	if name == "cluster" {
+		name += "|" + strings.ToLower(string(cmdLine[1]))
+	}
+	return reply.MakeErrReply("NOPERM '" + name + "' can only be sent by cluster nodes")
+}
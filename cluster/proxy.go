@@ -0,0 +1,168 @@
+package cluster
+
+import (
+	"fmt"
+	pool "github.com/jolestar/go-commons-pool/v2"
+	"goredis/config"
+	"goredis/database"
+	databaseface "goredis/interface/database"
+	"goredis/interface/resp"
+	"goredis/lib/consistenthash"
+	"goredis/resp/client"
+	"goredis/resp/reply"
+	"strconv"
+	"strings"
+)
+
+/*
+ * 代理模式（proxy yes 或 -proxy）
+ * 与一致性哈希模式使用相同的路由和连接池，但本地不存储任何数据，peers 中的后端是不了解集群协议的普通 goredis 或 Redis 实例。
+ * 后端之间不通信，因此不支持迁移、复制和两阶段提交：跨后端的 DEL、MSET 分别在各个后端上执行，
+ * 跨后端的 MSETNX、RENAME 返回 CROSSSLOT 错误。
+ * 客户端通过管道发送的命令中，连续的只访问一个后端的命令按后端分组，在同一个连接上按顺序发送后再一起等待回复
+ */
+
+// proxyRouter 代理模式下的命令路由器
+var proxyRouter = makeProxyRouter()
+
+// makeProxyRouter 在集群路由的基础上去掉需要节点之间协作或者访问本地数据的命令
+func makeProxyRouter() map[string]CmdFunc {
+	routerMap := makeRouter()
+	for _, name := range []string{
+		"dump", "restore", "migrate", // 迁移
+		"psync", "replconf", "wait", "replicaof", "slaveof", "readonly", "readwrite", // 复制
+		"prepare", "commit", "rollback", "release", "txstatus", // 两阶段提交
+		"execlocal", "cluster", "bgrewriteaof",
+	} {
+		delete(routerMap, name)
+	}
+	routerMap["ping"] = proxyPing
+	routerMap["select"] = proxySelect
+	return routerMap
+}
+
+// MakeProxy 创建代理，peers 是后端的地址，node-weights 和 virtual-nodes 与一致性哈希模式含义相同
+func MakeProxy() *ClusterDatabase {
+	cluster := &ClusterDatabase{
+		self:           fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port),
+		proxy:          true,
+		peerPicker:     consistenthash.NewNodeMapWithReplicas(config.Properties.VirtualNodes, nil),
+		peerConnection: make(map[string]*pool.ObjectPool),
+		replicas:       make(map[string]string),
+	}
+	backends := make([]string, len(config.Properties.Peers))
+	copy(backends, config.Properties.Peers)
+	cluster.peerPicker.AddNode(backends...)
+	addNodeWeights(cluster.peerPicker)
+	cluster.nodes = backends
+	for _, backend := range backends {
+		cluster.peerConnection[backend] = makePeerPool(backend)
+	}
+	// 后端不参与集群总线，总线不启动，所有后端都不会被判定为下线
+	cluster.bus = makeClusterBus(cluster)
+	return cluster
+}
+
+// proxyPing 由代理直接回复
+func proxyPing(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	switch len(args) {
+	case 1:
+		return &reply.PongReply{}
+	case 2:
+		return reply.MakeStatusReply(string(args[1]))
+	}
+	return reply.MakeArgNumErrReply("ping")
+}
+
+// proxySelect 只记录连接选中的 DB，转发命令时在后端上选择相同的 DB
+func proxySelect(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) != 2 {
+		return reply.MakeArgNumErrReply("select")
+	}
+	dbIndex, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return reply.MakeErrReply("ERR invalid DB index")
+	}
+	if dbIndex < 0 || dbIndex >= config.Properties.Databases {
+		return reply.MakeErrReply("ERR DB index is out of range")
+	}
+	c.SelectDB(dbIndex)
+	return reply.MakeOkReply()
+}
+
+// ExecBatch 执行客户端通过管道发送的多条命令，回复按命令的顺序返回
+// 代理模式下连续的只访问一个后端的命令按后端分组，每个后端借出一个连接按顺序发送所有命令后再等待回复，
+// 其他命令（多个后端、没有键的命令等）在前面的命令都完成后单独执行，因此同一个客户端的命令的执行顺序不变
+func (cluster *ClusterDatabase) ExecBatch(c resp.Connection, cmdLines []databaseface.CmdLine) []resp.Reply {
+	replies := make([]resp.Reply, len(cmdLines))
+	for i := 0; i < len(cmdLines); {
+		if !cluster.proxy {
+			replies[i] = cluster.Exec(c, cmdLines[i])
+			i++
+			continue
+		}
+		groups := make(map[string][]int)
+		j := i
+		for ; j < len(cmdLines); j++ {
+			backend, ok := cluster.singleBackend(cmdLines[j])
+			if !ok {
+				break
+			}
+			groups[backend] = append(groups[backend], j)
+		}
+		if j > i {
+			cluster.pipeline(c, cmdLines, groups, replies)
+			i = j
+			continue
+		}
+		replies[i] = cluster.Exec(c, cmdLines[i])
+		i++
+	}
+	return replies
+}
+
+// singleBackend 判断命令是否可以直接转发给一个后端，是的话返回这个后端
+func (cluster *ClusterDatabase) singleBackend(cmdLine [][]byte) (string, bool) {
+	if _, ok := proxyRouter[strings.ToLower(string(cmdLine[0]))]; !ok {
+		return "", false
+	}
+	keys, _ := database.GetCommandKeys(cmdLine)
+	if len(keys) == 0 {
+		return "", false
+	}
+	backend := cluster.pickNode(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.pickNode(key) != backend {
+			return "", false
+		}
+	}
+	return backend, true
+}
+
+// pipeline 在每个后端借出一个连接，按顺序发送分给它的命令，全部发送后再等待回复
+func (cluster *ClusterDatabase) pipeline(c resp.Connection, cmdLines []databaseface.CmdLine,
+	groups map[string][]int, replies []resp.Reply) {
+	pending := make([]*client.Pending, len(cmdLines))
+	borrowed := make(map[string]*client.Client, len(groups))
+	for backend, indexes := range groups {
+		peerClient, err := cluster.getPeerClient(backend)
+		if err != nil {
+			for _, i := range indexes {
+				replies[i] = reply.MakeErrReply(err.Error())
+			}
+			continue
+		}
+		borrowed[backend] = peerClient
+		for _, i := range indexes {
+			pending[i] = peerClient.SendAsync(c.GetDBIndex(), cmdLines[i])
+		}
+	}
+	for i, p := range pending {
+		if p != nil {
+			replies[i] = p.Wait()
+		}
+	}
+	for backend, peerClient := range borrowed {
+		_ = cluster.returnPeerClient(backend, peerClient)
+	}
+}
@@ -2,12 +2,14 @@ package cluster
 
 import (
 	"goredis/interface/resp"
+	"goredis/lib/utils"
 	"goredis/resp/reply"
+	"strconv"
+	"strings"
 )
 
 // Rename 重命名一个键（key）
-// 要求源键（origin）和目标键（destination）必须位于同一个节点（即同一个哈希槽）
-// 如果两个键不在同一节点上，则不允许重命名，因为 Redis 集群模式不支持跨槽的 rename 操作
+// 源键（origin）和目标键（destination）位于不同节点时通过两阶段提交在两个节点上同时完成
 func Rename(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
 	// 参数数量校验，rename 命令要求三个参数：RENAME 源键 目标键
 	if len(args) != 3 {
@@ -19,15 +21,80 @@ func Rename(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Rep
 	dest := string(args[2])
 
 	// 通过一致性哈希算法找出源键所在的节点
-	srcPeer := cluster.peerPicker.PickNode(src)
+	srcPeer := cluster.pickNode(src)
 	// 同样找出目标键所在的节点
-	destPeer := cluster.peerPicker.PickNode(dest)
+	destPeer := cluster.pickNode(dest)
 
-	// 如果两个键不在同一节点（即不同哈希槽），则不允许执行重命名操作
-	if srcPeer != destPeer {
-		return reply.MakeErrReply("ERR rename must within one slot in cluster mode")
+	// 两个键在同一节点时直接将 rename 命令转发到该节点执行
+	// 可以使用相同的 {hashtag} 让两个键落在同一个节点上
+	cluster.prepareKeys(c, src, dest)
+	if srcPeer == destPeer {
+		return cluster.relay(srcPeer, c, args)
 	}
+	if cluster.proxy {
+		// 代理的后端不支持两阶段提交
+		return makeCrossNodeReply()
+	}
+	return cluster.renameTx(c, src, dest, srcPeer, destPeer, strings.ToLower(string(args[0])) == "renamenx")
+}
 
-	// 如果两个键在同一节点，则将 rename 命令转发到目标节点执行
-	return cluster.relay(srcPeer, c, args)
+// renameTx 通过两阶段提交完成跨节点的重命名：源节点删除 src，目标节点用 src 的值和过期时间恢复 dest
+func (cluster *ClusterDatabase) renameTx(c resp.Connection, src string, dest string,
+	srcPeer string, destPeer string, nx bool) resp.Reply {
+	tx := cluster.newCoordinator(c, []string{srcPeer, destPeer})
+	// 与其他事务一样按节点地址顺序加锁，目标节点在前时先锁住目标键，
+	// 此时还不知道源键的值，准备时使用空的值，提交时替换为源键的值
+	makeRestore := func(payload []byte, ttl int64) [][]byte {
+		restore := utils.ToCmdLine2("RESTORE", []byte(dest), []byte(strconv.FormatInt(ttl, 10)), payload)
+		if !nx {
+			restore = append(restore, []byte("REPLACE"))
+		}
+		return restore
+	}
+	destFirst := tx.nodes[0] == destPeer
+	if destFirst {
+		if errReply := tx.prepareRestore(destPeer, makeRestore([]byte{}, 0), nx); errReply != nil {
+			return errReply
+		}
+	}
+	// 锁住源键，从准备阶段回复的快照中得到它的值和过期时间
+	snapshot, errReply := tx.prepare(srcPeer, utils.ToCmdLine("DEL", src))
+	if errReply != nil {
+		tx.rollback()
+		return errReply
+	}
+	if len(snapshot) != 2 || snapshot[0] == nil {
+		tx.rollback()
+		return reply.MakeErrReply("ERR no such key")
+	}
+	ttl, err := strconv.ParseInt(string(snapshot[1]), 10, 64)
+	if err != nil || ttl < 0 {
+		ttl = 0
+	}
+	restore := makeRestore(snapshot[0], ttl)
+	if destFirst {
+		tx.commitArgs[destPeer] = restore
+	} else if errReply := tx.prepareRestore(destPeer, restore, nx); errReply != nil {
+		return errReply
+	}
+	if _, errReply := tx.commit(); errReply != nil {
+		return errReply
+	}
+	if nx {
+		return reply.MakeIntReply(1)
+	}
+	return reply.MakeOkReply()
+}
+
+// prepareRestore 在目标节点上准备 RESTORE，失败时回滚已经准备的节点
+// RENAMENX 的目标键已经存在时返回 0
+func (tx *coordinator) prepareRestore(destPeer string, restore [][]byte, nx bool) resp.Reply {
+	if _, errReply := tx.prepare(destPeer, restore); errReply != nil {
+		tx.rollback()
+		if nx && isBusyKey(errReply) {
+			return reply.MakeIntReply(0)
+		}
+		return errReply
+	}
+	return nil
 }
@@ -0,0 +1,458 @@
+package cluster
+
+import (
+	"fmt"
+	"goredis/config"
+	"goredis/database"
+	databaseface "goredis/interface/database"
+	"goredis/interface/resp"
+	"goredis/lib/logger"
+	"goredis/lib/utils"
+	"goredis/resp/connection"
+	"goredis/resp/reply"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * 集群内的主从复制
+ * 从库（配置 replicaof 或执行 CLUSTER REPLICATE）不负责任何键，本地数据库通过 REPLICAOF 接收主库的写入。
+ * 节点在心跳中携带自己复制的主库，其他节点据此记录每个分片的从库，客户端发送 READONLY 后可以在从库上执行只读命令。
+ * 集群总线将主库标记为 FAIL 后，它的从库按复制偏移量排名，等待 failoverDelay + rank * failoverRankDelay 后提升为主库：
+ * 一致性哈希模式下生成新的拓扑，让从库接管主库在环上的位置；槽位模式下广播 CLUSTER PROMOTED，把主库的槽位交给从库。
+ * 键的分布不变，不需要迁移数据，原来的主库和其他从库随后改为复制新的主库
+ */
+
+const (
+	failoverDelay     = 500 * time.Millisecond // 主库被标记为 FAIL 后从库开始故障转移前的等待时间
+	failoverRankDelay = time.Second            // 复制偏移量每落后一名多等待的时间，让数据最新的从库优先提升
+)
+
+// primaryNode 返回本节点复制的主库，本节点是主库时返回空字符串
+func (cluster *ClusterDatabase) primaryNode() string {
+	cluster.topologyLock.RLock()
+	defer cluster.topologyLock.RUnlock()
+	return cluster.primary
+}
+
+// replicaOf 返回节点复制的主库，节点是主库时返回空字符串
+func (cluster *ClusterDatabase) replicaOf(node string) string {
+	cluster.topologyLock.RLock()
+	defer cluster.topologyLock.RUnlock()
+	if node == cluster.self {
+		return cluster.primary
+	}
+	return cluster.replicas[node]
+}
+
+// replicasOf 返回复制 primary 的所有从库，包括本节点，按地址排序
+func (cluster *ClusterDatabase) replicasOf(primary string) []string {
+	cluster.topologyLock.RLock()
+	defer cluster.topologyLock.RUnlock()
+	var result []string
+	for replica, node := range cluster.replicas {
+		if node == primary {
+			result = append(result, replica)
+		}
+	}
+	if cluster.primary == primary {
+		result = append(result, cluster.self)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// heartbeatInfo 返回心跳中携带的拓扑纪元、本节点复制的主库和已知的从库（从库>主库）
+func (cluster *ClusterDatabase) heartbeatInfo() (int64, string, []string) {
+	cluster.topologyLock.RLock()
+	defer cluster.topologyLock.RUnlock()
+	replicas := make([]string, 0, len(cluster.replicas))
+	for replica, primary := range cluster.replicas {
+		replicas = append(replicas, replica+">"+primary)
+	}
+	sort.Strings(replicas)
+	return cluster.epoch, cluster.primary, replicas
+}
+
+// ReplOffset 返回本地数据库的复制偏移量，代理模式下没有本地数据库，返回 0
+func (cluster *ClusterDatabase) ReplOffset() int64 {
+	if db, ok := cluster.db.(databaseface.Replicated); ok {
+		return db.ReplOffset()
+	}
+	return 0
+}
+
+// IsReplica 本地数据库是否正在复制其他节点
+func (cluster *ClusterDatabase) IsReplica() bool {
+	if db, ok := cluster.db.(databaseface.Replicated); ok {
+		return db.IsReplica()
+	}
+	return false
+}
+
+// learnReplica 记录节点复制的主库，primary 为空表示节点是主库
+func (cluster *ClusterDatabase) learnReplica(node string, primary string) {
+	if node == cluster.self {
+		return
+	}
+	cluster.topologyLock.Lock()
+	if primary == "" {
+		delete(cluster.replicas, node)
+	} else {
+		cluster.replicas[node] = primary
+	}
+	cluster.topologyLock.Unlock()
+	if primary != "" && cluster.slots != nil {
+		cluster.slots.mu.Lock()
+		cluster.slots.nodeIds[makeNodeId(node)] = node
+		cluster.slots.mu.Unlock()
+	}
+}
+
+// forgetReplica 删除从库的记录，target 不是已知的从库时返回 false
+func (cluster *ClusterDatabase) forgetReplica(target string) bool {
+	cluster.topologyLock.Lock()
+	defer cluster.topologyLock.Unlock()
+	for replica := range cluster.replicas {
+		if replica == target || makeNodeId(replica) == target {
+			delete(cluster.replicas, replica)
+			return true
+		}
+	}
+	return false
+}
+
+// replicate 让本地数据库复制 primary，primary 为空时停止复制成为主库
+func (cluster *ClusterDatabase) replicate(primary string) {
+	cmdLine := utils.ToCmdLine("REPLICAOF", "NO", "ONE")
+	if primary != "" {
+		host, port := splitNodeAddr(primary)
+		cmdLine = utils.ToCmdLine("REPLICAOF", host, strconv.Itoa(port))
+	}
+	ret := cluster.db.Exec(&connection.FakeConn{}, cmdLine)
+	if reply.IsErrorReply(ret) {
+		logger.Warn(fmt.Sprintf("cluster: replicate %s failed: %s", orDash(primary), string(ret.ToBytes())))
+		return
+	}
+	if primary == "" {
+		logger.Info("cluster: turned into a primary")
+	} else {
+		logger.Info("cluster: replicating " + primary)
+	}
+}
+
+// syncPeer 根据心跳发现 sender 的集群配置落后时，把最新的配置发给它
+// 一致性哈希模式下发送当前的拓扑；槽位模式下如果 sender 或它复制的主库已经被从库取代，告诉它新的主库
+func (cluster *ClusterDatabase) syncPeer(sender string, epoch int64, primary string) {
+	if cluster.slots == nil {
+		cluster.topologyLock.RLock()
+		var current *topology
+		if epoch < cluster.epoch {
+			current = topologyOf(cluster.epoch, cluster.peerPicker)
+		}
+		cluster.topologyLock.RUnlock()
+		if current != nil {
+			// 键的位置以 sender 收到的拓扑为准，上一个拓扑与当前相同，不会触发迁移
+			go cluster.relayTimeout(sender, &connection.FakeConn{}, makeTopologyCmd(current, current), migrateTimeout)
+		}
+		return
+	}
+	node := primary
+	if node == "" {
+		node = sender
+	}
+	cluster.slots.mu.RLock()
+	replacement, ok := cluster.slots.replacedBy[node]
+	cluster.slots.mu.RUnlock()
+	if ok {
+		go cluster.relayTimeout(sender, &connection.FakeConn{},
+			utils.ToCmdLine("CLUSTER", "PROMOTED", node, replacement), migrateTimeout)
+	}
+}
+
+// findNode 根据节点 ID 或地址查找已知的节点（包括自己）
+func (cluster *ClusterDatabase) findNode(target string) (string, bool) {
+	for _, node := range append(cluster.members(), cluster.self) {
+		if node == target || makeNodeId(node) == target {
+			return node, true
+		}
+	}
+	return "", false
+}
+
+// ownsKeys 判断本节点是否负责键：一致性哈希模式下在环上占据位置，槽位模式下分配了槽位
+func (cluster *ClusterDatabase) ownsKeys() bool {
+	if cluster.slots == nil {
+		cluster.topologyLock.RLock()
+		defer cluster.topologyLock.RUnlock()
+		return cluster.peerPicker.HasNode(cluster.self)
+	}
+	cluster.slots.mu.RLock()
+	defer cluster.slots.mu.RUnlock()
+	for _, owner := range cluster.slots.owners {
+		if owner == cluster.self {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmpty 判断本地数据库是否没有任何键
+func (cluster *ClusterDatabase) isEmpty() bool {
+	engine, ok := cluster.db.(databaseface.DBEngine)
+	if !ok {
+		return true
+	}
+	empty := true
+	for dbIndex := 0; dbIndex < config.Properties.Databases && empty; dbIndex++ {
+		engine.ForEach(dbIndex, func(key string, entity *databaseface.DataEntity) bool {
+			empty = false
+			return false
+		})
+	}
+	return empty
+}
+
+// execReplicate 处理 CLUSTER REPLICATE <node-id|ip:port>，让本节点成为指定主库的从库
+// 与 Redis 相同，本节点必须没有数据；一致性哈希模式下本节点在环上的位置会被移除
+func (cluster *ClusterDatabase) execReplicate(args [][]byte) resp.Reply {
+	if len(args) != 1 {
+		return reply.MakeArgNumErrReply("cluster|replicate")
+	}
+	target, ok := cluster.findNode(string(args[0]))
+	if !ok {
+		return reply.MakeErrReply("ERR Unknown node " + string(args[0]))
+	}
+	if target == cluster.self {
+		return reply.MakeErrReply("ERR Can't replicate myself")
+	}
+	if cluster.replicaOf(target) != "" {
+		return reply.MakeErrReply("ERR I can only replicate a master, not a replica.")
+	}
+	owns := cluster.ownsKeys()
+	if !cluster.isEmpty() || (owns && cluster.slots != nil) {
+		return reply.MakeErrReply("ERR To set a master the node must be empty and without assigned slots.")
+	}
+
+	cluster.topologyLock.Lock()
+	prevPrimary := cluster.primary
+	cluster.primary = target
+	cluster.topologyLock.Unlock()
+	if owns {
+		ret := cluster.changeTopology(func(t *topology) resp.Reply {
+			for name := range t.nodes {
+				if t.owner(name) == cluster.self {
+					delete(t.nodes, name)
+					delete(t.owners, name)
+				}
+			}
+			if len(t.nodes) == 0 {
+				return reply.MakeErrReply("ERR The cluster must keep at least one master")
+			}
+			return nil
+		})
+		if reply.IsErrorReply(ret) {
+			cluster.topologyLock.Lock()
+			cluster.primary = prevPrimary
+			cluster.topologyLock.Unlock()
+			return ret
+		}
+	}
+	cluster.replicate(target)
+	return reply.MakeOkReply()
+}
+
+// execReplicas 处理 CLUSTER REPLICAS <node-id>，以 CLUSTER NODES 的格式列出节点的从库
+func (cluster *ClusterDatabase) execReplicas(args [][]byte) resp.Reply {
+	if len(args) != 1 {
+		return reply.MakeArgNumErrReply("cluster|replicas")
+	}
+	node, ok := cluster.findNode(string(args[0]))
+	if !ok {
+		return reply.MakeErrReply("ERR Unknown node " + string(args[0]))
+	}
+	if cluster.replicaOf(node) != "" {
+		return reply.MakeErrReply("ERR The specified node is not a master")
+	}
+	var epoch int64
+	if cluster.slots == nil {
+		epoch = cluster.currentEpoch()
+	}
+	replicas := cluster.replicasOf(node)
+	lines := make([][]byte, 0, len(replicas))
+	for _, replica := range replicas {
+		lines = append(lines, []byte(cluster.nodeLine(replica, epoch)))
+	}
+	return reply.MakeMultiBulkReply(lines)
+}
+
+// execFailover 处理 CLUSTER FAILOVER [FORCE|TAKEOVER]，从库立即取代它的主库
+// 提升不需要主库参与，三种方式的效果相同
+func (cluster *ClusterDatabase) execFailover(args [][]byte) resp.Reply {
+	if len(args) > 1 {
+		return reply.MakeArgNumErrReply("cluster|failover")
+	}
+	if len(args) == 1 {
+		option := strings.ToLower(string(args[0]))
+		if option != "force" && option != "takeover" {
+			return &reply.SyntaxErrReply{}
+		}
+	}
+	primary := cluster.primaryNode()
+	if primary == "" {
+		return reply.MakeErrReply("ERR You should send CLUSTER FAILOVER to a replica")
+	}
+	return cluster.promote(primary)
+}
+
+// promote 将本节点提升为主库，接管 old 负责的所有键
+func (cluster *ClusterDatabase) promote(old string) resp.Reply {
+	logger.Info("cluster: promoting to replace " + old)
+	if cluster.slots == nil {
+		return cluster.changeTopology(func(t *topology) resp.Reply {
+			found := false
+			for name := range t.nodes {
+				if t.owner(name) != old {
+					continue
+				}
+				found = true
+				if name == cluster.self {
+					delete(t.owners, name)
+				} else {
+					t.owners[name] = cluster.self
+				}
+			}
+			if !found {
+				return reply.MakeErrReply("ERR Unknown node " + old)
+			}
+			return nil
+		})
+	}
+	cluster.applyPromoted(old, cluster.self)
+	cluster.notify(cluster.members(), utils.ToCmdLine("CLUSTER", "PROMOTED", old, cluster.self))
+	return reply.MakeOkReply()
+}
+
+// execPromoted 处理槽位模式下的 CLUSTER PROMOTED <old> <new>，表示 new 取代了 old
+func (cluster *ClusterDatabase) execPromoted(args [][]byte) resp.Reply {
+	if len(args) != 2 {
+		return reply.MakeArgNumErrReply("cluster|promoted")
+	}
+	cluster.applyPromoted(string(args[0]), string(args[1]))
+	return reply.MakeOkReply()
+}
+
+// applyPromoted 将 old 的槽位交给 new，old 和它原来的从库都成为 new 的从库
+func (cluster *ClusterDatabase) applyPromoted(old string, newNode string) {
+	table := cluster.slots
+	table.mu.Lock()
+	for slot, owner := range table.owners {
+		if owner == old {
+			table.owners[slot] = newNode
+		}
+	}
+	delete(table.replacedBy, newNode)
+	table.replacedBy[old] = newNode
+	table.nodeIds[makeNodeId(old)] = old
+	table.nodeIds[makeNodeId(newNode)] = newNode
+	table.mu.Unlock()
+
+	cluster.topologyLock.Lock()
+	for replica, primary := range cluster.replicas {
+		if primary == old {
+			cluster.replicas[replica] = newNode
+		}
+	}
+	delete(cluster.replicas, newNode)
+	if old != cluster.self {
+		cluster.replicas[old] = newNode
+	}
+	primary := cluster.primary
+	switch {
+	case newNode == cluster.self:
+		primary = ""
+	case old == cluster.self || primary == old:
+		primary = newNode
+	}
+	changed := primary != cluster.primary
+	cluster.primary = primary
+	cluster.topologyLock.Unlock()
+
+	if changed {
+		cluster.replicate(primary)
+	}
+}
+
+// checkFailover 本节点是从库且主库被标记为 FAIL 时，等待排名对应的时间后提升为主库
+// 其他从库先完成提升时本节点会改为复制它，主库不再处于 FAIL 状态，故障转移自然取消
+func (bus *clusterBus) checkFailover() {
+	cluster := bus.cluster
+	primary := cluster.primaryNode()
+	if primary == "" || !bus.isFailing(primary) {
+		bus.failoverPrimary = ""
+		return
+	}
+	now := time.Now()
+	if bus.failoverPrimary != primary {
+		rank := bus.failoverRank(primary)
+		bus.failoverPrimary = primary
+		bus.failoverAt = now.Add(failoverDelay + time.Duration(rank)*failoverRankDelay)
+		logger.Info(fmt.Sprintf("cluster: primary %s failed, start failover at rank %d", primary, rank))
+		return
+	}
+	if now.Before(bus.failoverAt) {
+		return
+	}
+	if ret := cluster.promote(primary); reply.IsErrorReply(ret) {
+		logger.Warn(fmt.Sprintf("cluster: failover of %s failed: %s", primary, string(ret.ToBytes())))
+		bus.failoverAt = now.Add(bus.nodeTimeout)
+	}
+}
+
+// failoverRank 返回本节点在 primary 的从库中按复制偏移量的排名，偏移量相同时地址较小的优先
+func (bus *clusterBus) failoverRank(primary string) int {
+	self := bus.cluster.self
+	offset := bus.cluster.ReplOffset()
+	siblings := bus.cluster.replicasOf(primary)
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	rank := 0
+	for _, sibling := range siblings {
+		state, ok := bus.nodes[sibling]
+		if sibling == self || !ok || state.fail {
+			continue
+		}
+		if state.offset > offset || (state.offset == offset && sibling < self) {
+			rank++
+		}
+	}
+	return rank
+}
+
+// execReadOnly 处理 READONLY，此后连接上的只读命令可以由从库执行
+func execReadOnly(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) != 1 {
+		return reply.MakeArgNumErrReply("readonly")
+	}
+	cluster.readonly.Store(c, true)
+	return reply.MakeOkReply()
+}
+
+// execReadWrite 处理 READWRITE，取消 READONLY
+func execReadWrite(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) != 1 {
+		return reply.MakeArgNumErrReply("readwrite")
+	}
+	cluster.readonly.Delete(c)
+	return reply.MakeOkReply()
+}
+
+// readLocally 判断是否可以在本节点执行只读命令：连接发送过 READONLY，且本节点是负责这些键的 owner 的从库
+func (cluster *ClusterDatabase) readLocally(c resp.Connection, cmdName []byte, owner string) bool {
+	if _, ok := cluster.readonly.Load(c); !ok || owner == "" {
+		return false
+	}
+	return owner == cluster.primaryNode() && database.IsReadOnlyCommand(string(cmdName))
+}
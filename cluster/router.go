@@ -1,6 +1,11 @@
 package cluster
 
-import "goredis/interface/resp"
+import (
+	"goredis/database"
+	"goredis/interface/resp"
+	"goredis/resp/reply"
+	"strings"
+)
 
 // CmdLine 是 [][]byte 的别名，表示一条命令及其参数（例如：["set", "key", "value"]）
 type CmdLine = [][]byte
@@ -14,36 +19,114 @@ func makeRouter() map[string]CmdFunc {
 
 	// ping 命令，检查连接是否正常
 	routerMap["ping"] = ping
+	// select 在本节点执行，转发命令时会先向目标节点发送 SELECT
+	routerMap["select"] = execSelect
 
-	// 删除命令，支持跨节点删除多个键
-	routerMap["del"] = Del
+	// 迁移键使用的命令，总是在当前连接的节点上执行
+	routerMap["dump"] = execLocal
+	routerMap["restore"] = execLocal
+	routerMap["migrate"] = execMigrate
 
-	// 以下命令默认只作用于一个 key，因此可以使用 defaultFunc 统一处理
-	routerMap["exists"] = defaultFunc // 检查 key 是否存在
-	routerMap["type"] = defaultFunc   // 返回 key 的数据类型
-	routerMap["rename"] = Rename      // 重命名 key，要求两个 key 在同一节点
-	routerMap["renamenx"] = Rename    // 同上，但只在目标 key 不存在时才执行
+	// 复制相关的命令在本节点执行，从库通过它们复制本节点负责的键
+	routerMap["psync"] = execLocal
+	routerMap["replconf"] = execLocal
+	routerMap["wait"] = execLocal
+	routerMap["info"] = execInfo
 
-	routerMap["set"] = defaultFunc    // 设置 key 的值
-	routerMap["setnx"] = defaultFunc  // 仅在 key 不存在时设置
-	routerMap["get"] = defaultFunc    // 获取 key 的值
-	routerMap["getset"] = defaultFunc // 设置新值并返回旧值
+	// 管理命令只作用于当前连接的节点
+	routerMap["bgrewriteaof"] = execLocal
+	// 集群中的主从关系由 CLUSTER REPLICATE 维护，不允许直接修改
+	routerMap["replicaof"] = execReplicaOf
+	routerMap["slaveof"] = execReplicaOf
+
+	// 多键命令，键按所在节点分组后并行执行
+	routerMap["del"] = Del       // 删除多个键
+	routerMap["exists"] = Exists // 统计存在的键
+	routerMap["mget"] = MGet     // 批量获取
+	routerMap["mset"] = MSet     // 批量设置
+	routerMap["msetnx"] = MSetNX // 所有键都不存在时批量设置
+
+	// 两个 key 不在同一节点时通过两阶段提交完成
+	routerMap["rename"] = Rename   // 重命名 key
+	routerMap["renamenx"] = Rename // 同上，但只在目标 key 不存在时才执行
 
 	// 清空当前数据库中的所有 key，会广播给所有节点
 	routerMap["flushdb"] = FlushDB
+	routerMap["flushall"] = FlushDB
+
+	// 没有键的查询命令，广播给所有节点后合并结果
+	routerMap["keys"] = Keys
+	routerMap["dbsize"] = DBSize
+	routerMap["randomkey"] = RandomKey
+	routerMap["scan"] = Scan
+	// 广播的命令在接收节点本地执行
+	routerMap["execlocal"] = execExecLocal
 
+	// 跨节点事务的两阶段提交，由协调者发送给参与者
+	routerMap["prepare"] = execPrepare
+	routerMap["commit"] = execCommit
+	routerMap["rollback"] = execRollback
+	routerMap["release"] = execRelease
+	routerMap["txstatus"] = execTxStatus
+
+	// 查看集群状态，例如 CLUSTER DISTRIBUTION
+	routerMap["cluster"] = execCluster
+	// 允许或禁止在从库上执行只读命令
+	routerMap["readonly"] = execReadOnly
+	routerMap["readwrite"] = execReadWrite
+
+	// 其余注册过的命令根据键的位置路由：有键时转发到键所在的节点，没有键时在本节点执行
+	for _, name := range database.CommandNames() {
+		if _, ok := routerMap[name]; !ok {
+			routerMap[name] = defaultFunc
+		}
+	}
 	return routerMap
 }
 
-// defaultFunc 是默认的命令处理函数，适用于只操作一个 key 的命令
-// 它会将命令转发到 key 所在的节点（由一致性哈希确定），并返回该节点的响应
+// defaultFunc 是默认的命令处理函数，根据命令注册时声明的键位置找出它访问的键
+// 所有键都在同一个节点上时将命令转发到该节点（由一致性哈希确定），并返回该节点的响应
+// 没有键的命令在本节点执行，参数不足时也在本节点执行以便返回参数错误
 func defaultFunc(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
-	// 提取 key（通常位于参数 args[1]，例如 set key value）
-	key := string(args[1])
+	keys, _ := database.GetCommandKeys(args)
+	if len(keys) == 0 {
+		if cluster.proxy {
+			// 代理没有本地数据库，需要键的命令缺少参数时直接返回参数错误
+			return reply.MakeArgNumErrReply(strings.ToLower(string(args[0])))
+		}
+		return execLocal(cluster, c, args)
+	}
+
+	// 通过一致性哈希找到负责这些 key 的节点，迁移期间键还在旧节点上时先拉取过来
+	groups := cluster.groupByNode(c, keys)
+	if len(groups) > 1 {
+		return makeCrossNodeReply()
+	}
+	var peer string
+	for node := range groups {
+		peer = node
+	}
 
-	// 通过一致性哈希找到负责该 key 的节点
-	peer := cluster.peerPicker.PickNode(key)
+	// 发送过 READONLY 的连接在从库上直接读取本地的副本
+	if cluster.readLocally(c, args[0], peer) {
+		return cluster.execLocked(c, args)
+	}
 
 	// 将命令转发给目标节点，并获取结果
 	return cluster.relay(peer, c, args)
 }
+
+// makeCrossNodeReply 命令的多个键不在同一个节点上，并且不能跨节点执行
+func makeCrossNodeReply() resp.Reply {
+	return reply.MakeErrReply("CROSSSLOT Keys in request don't hash to the same node")
+}
+
+// execReplicaOf 拒绝集群模式下的 REPLICAOF/SLAVEOF
+func execReplicaOf(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	return reply.MakeErrReply("ERR REPLICAOF not allowed in cluster mode, use CLUSTER REPLICATE instead")
+}
+
+// execLocal 在本节点执行命令，不根据键转发
+func execLocal(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	return cluster.db.Exec(c, args)
+}
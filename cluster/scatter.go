@@ -0,0 +1,183 @@
+package cluster
+
+import (
+	"context"
+	"goredis/interface/resp"
+	"goredis/resp/reply"
+	"strconv"
+)
+
+/*
+ * 多键命令的分散-聚合执行
+ * 按负责的节点将键分组，每个节点发送一条只包含它的键的子命令，并行执行后按键在原命令中的顺序组装结果。
+ * 所有键都在同一个节点上时直接转发原命令，写命令跨节点时通过两阶段提交执行（见 tcc.go）
+ */
+
+// groupByNode 按负责的节点将键分组，返回 节点 -> 键在 keys 中的下标（保持原有顺序）
+// 迁移期间先把还留在旧节点上的键拉取过来
+func (cluster *ClusterDatabase) groupByNode(c resp.Connection, keys []string) map[string][]int {
+	cluster.prepareKeys(c, keys...)
+	cluster.topologyLock.RLock()
+	defer cluster.topologyLock.RUnlock()
+	groups := make(map[string][]int)
+	for i, key := range keys {
+		node := cluster.peerPicker.PickNode(key)
+		groups[node] = append(groups[node], i)
+	}
+	return groups
+}
+
+// scatter 并行地向每个节点发送 makeCmd 根据该节点的键下标生成的子命令，返回 节点 -> 回复
+// 超过 broadcastTimeout 没有回复的节点记为超时
+func (cluster *ClusterDatabase) scatter(c resp.Connection, groups map[string][]int,
+	makeCmd func(indexes []int) [][]byte) map[string]resp.Reply {
+	nodes := make([]string, 0, len(groups))
+	for node := range groups {
+		nodes = append(nodes, node)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), broadcastTimeout)
+	defer cancel()
+	return gather(ctx, nodes, func(node string) resp.Reply {
+		cmdLine := makeCmd(groups[node])
+		if cluster.readLocally(c, cmdLine[0], node) {
+			return cluster.execLocked(c, cmdLine)
+		}
+		return cluster.relay(node, c, cmdLine)
+	})
+}
+
+// keysOf 返回命令中从 args[1] 开始每隔 step 个参数出现的键
+func keysOf(args [][]byte, step int) []string {
+	keys := make([]string, 0, (len(args)-1)/step)
+	for i := 1; i < len(args); i += step {
+		keys = append(keys, string(args[i]))
+	}
+	return keys
+}
+
+// makeSubCmd 生成只包含指定下标的键（以及键后面 step-1 个参数）的子命令
+func makeSubCmd(args [][]byte, step int, indexes []int) [][]byte {
+	cmdLine := make([][]byte, 0, 1+len(indexes)*step)
+	cmdLine = append(cmdLine, args[0])
+	for _, i := range indexes {
+		cmdLine = append(cmdLine, args[1+i*step:1+(i+1)*step]...)
+	}
+	return cmdLine
+}
+
+// sumIntReplies 将每个节点回复的整数相加，用于 DEL、EXISTS 等返回键数量的命令
+func sumIntReplies(replies map[string]resp.Reply) resp.Reply {
+	if errReply := collectErrors(replies); errReply != nil {
+		return errReply
+	}
+	var total int64
+	for node, ret := range replies {
+		intReply, ok := ret.(*reply.IntReply)
+		if !ok {
+			return makeNodeError(node, "unexpected reply "+strconv.Quote(string(ret.ToBytes())))
+		}
+		total += intReply.Code
+	}
+	return reply.MakeIntReply(total)
+}
+
+// Exists 统计多个键中存在的数量，键可以分布在不同的节点上
+func Exists(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) < 2 {
+		return reply.MakeArgNumErrReply("exists")
+	}
+	groups := cluster.groupByNode(c, keysOf(args, 1))
+	if len(groups) == 1 {
+		for node := range groups {
+			return cluster.relay(node, c, args)
+		}
+	}
+	return sumIntReplies(cluster.scatter(c, groups, func(indexes []int) [][]byte {
+		return makeSubCmd(args, 1, indexes)
+	}))
+}
+
+// MGet 批量获取多个键的值，结果按键在命令中的顺序排列
+func MGet(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) < 2 {
+		return reply.MakeArgNumErrReply("mget")
+	}
+	keys := keysOf(args, 1)
+	groups := cluster.groupByNode(c, keys)
+	replies := cluster.scatter(c, groups, func(indexes []int) [][]byte {
+		return makeSubCmd(args, 1, indexes)
+	})
+	if errReply := collectErrors(replies); errReply != nil {
+		return errReply
+	}
+	values := make([][]byte, len(keys))
+	for node, indexes := range groups {
+		sub, ok := replies[node].(*reply.MultiBulkReply)
+		if !ok || len(sub.Args) != len(indexes) {
+			return makeNodeError(node, "unexpected reply "+strconv.Quote(string(replies[node].ToBytes())))
+		}
+		for j, i := range indexes {
+			values[i] = sub.Args[j]
+		}
+	}
+	return reply.MakeMultiBulkReply(values)
+}
+
+// splitByNode 根据键的分组生成每个节点的子命令
+func splitByNode(args [][]byte, step int, groups map[string][]int) map[string][][]byte {
+	parts := make(map[string][][]byte, len(groups))
+	for node, indexes := range groups {
+		parts[node] = makeSubCmd(args, step, indexes)
+	}
+	return parts
+}
+
+// MSet 批量设置多个键值对，键分布在多个节点上时通过两阶段提交保证全部设置或全部不设置
+func MSet(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return reply.MakeArgNumErrReply("mset")
+	}
+	groups := cluster.groupByNode(c, keysOf(args, 2))
+	if len(groups) == 1 {
+		for node := range groups {
+			return cluster.relay(node, c, args)
+		}
+	}
+	if cluster.proxy {
+		// 代理的后端不支持两阶段提交，分别在每个后端上设置
+		replies := cluster.scatter(c, groups, func(indexes []int) [][]byte {
+			return makeSubCmd(args, 2, indexes)
+		})
+		if errReply := collectErrors(replies); errReply != nil {
+			return errReply
+		}
+		return reply.MakeOkReply()
+	}
+	if _, errReply := cluster.execTx(c, splitByNode(args, 2, groups)); errReply != nil {
+		return errReply
+	}
+	return reply.MakeOkReply()
+}
+
+// MSetNX 只有所有键都不存在时才设置它们，跨节点时参与者在准备阶段检查键是否存在，任何一个存在时整个事务回滚
+func MSetNX(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return reply.MakeArgNumErrReply("msetnx")
+	}
+	groups := cluster.groupByNode(c, keysOf(args, 2))
+	if len(groups) == 1 {
+		for node := range groups {
+			return cluster.relay(node, c, args)
+		}
+	}
+	if cluster.proxy {
+		return makeCrossNodeReply()
+	}
+	if _, errReply := cluster.execTx(c, splitByNode(args, 2, groups)); errReply != nil {
+		if isBusyKey(errReply) {
+			return reply.MakeIntReply(0)
+		}
+		return errReply
+	}
+	return reply.MakeIntReply(1)
+}
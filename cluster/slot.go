@@ -0,0 +1,187 @@
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"goredis/database"
+	"goredis/interface/resp"
+	"goredis/lib/crc16"
+	"goredis/lib/utils"
+	"goredis/resp/reply"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+ * 槽位模式（cluster-enabled yes）
+ * 与 Redis Cluster 相同，键按 CRC16(key) mod 16384 映射到槽位，每个槽位属于一个节点。
+ * 节点只执行属于自己的槽位上的命令，其他命令回复 MOVED 让客户端重定向；
+ * 槽位迁移期间，源节点上不存在的键回复 ASK，客户端先发送 ASKING 再到目标节点执行
+ */
+
+// SlotCount 槽位数量
+const SlotCount = 16384
+
+// KeySlot 计算键所在的槽位，支持 {hashtag}
+func KeySlot(key string) int {
+	return int(crc16.Checksum([]byte(utils.HashTag(key)))) % SlotCount
+}
+
+// makeNodeId 根据节点地址生成 40 个十六进制字符的节点 ID，所有节点计算出的结果相同
+func makeNodeId(addr string) string {
+	sum := sha1.Sum([]byte(addr))
+	return hex.EncodeToString(sum[:])
+}
+
+// slotTable 记录每个槽位所属的节点以及正在迁移的槽位
+type slotTable struct {
+	mu         sync.RWMutex
+	owners     [SlotCount]string // 槽位 -> 节点地址，空字符串表示没有节点负责
+	migrating  map[int]string    // 本节点正在迁出的槽位 -> 目标节点地址
+	importing  map[int]string    // 本节点正在迁入的槽位 -> 源节点地址
+	nodeIds    map[string]string // 节点 ID -> 节点地址，包括从库
+	replacedBy map[string]string // 被从库取代的主库 -> 取代它的节点
+}
+
+// makeSlotTable 将槽位平均分配给按地址排序后的各个节点，每个节点得到一段连续的槽位
+func makeSlotTable(nodes []string) *slotTable {
+	table := &slotTable{
+		migrating:  make(map[int]string),
+		importing:  make(map[int]string),
+		nodeIds:    make(map[string]string),
+		replacedBy: make(map[string]string),
+	}
+	sorted := make([]string, len(nodes))
+	copy(sorted, nodes)
+	sort.Strings(sorted)
+	for i, node := range sorted {
+		table.nodeIds[makeNodeId(node)] = node
+		begin := i * SlotCount / len(sorted)
+		end := (i + 1) * SlotCount / len(sorted)
+		for slot := begin; slot < end; slot++ {
+			table.owners[slot] = node
+		}
+	}
+	return table
+}
+
+// slotRange 一段属于同一个节点的连续槽位
+type slotRange struct {
+	begin int
+	end   int // 包含
+	node  string
+}
+
+// ranges 返回所有已分配的连续槽位段，调用者需要持有读锁
+func (table *slotTable) ranges() []*slotRange {
+	var result []*slotRange
+	for slot := 0; slot < SlotCount; slot++ {
+		node := table.owners[slot]
+		if node == "" {
+			continue
+		}
+		last := len(result) - 1
+		if last >= 0 && result[last].node == node && result[last].end == slot-1 {
+			result[last].end = slot
+			continue
+		}
+		result = append(result, &slotRange{begin: slot, end: slot, node: node})
+	}
+	return result
+}
+
+// nodes 返回所有已知节点的地址，按地址排序，调用者需要持有读锁
+func (table *slotTable) nodes() []string {
+	result := make([]string, 0, len(table.nodeIds))
+	for _, node := range table.nodeIds {
+		result = append(result, node)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// checkSlot 检查命令中的键是否由本节点负责，需要重定向时返回 MOVED/ASK 等错误回复
+// readonly 表示连接发送过 READONLY 且命令是只读的，此时本节点是槽位所属节点的从库也可以执行
+func (cluster *ClusterDatabase) checkSlot(c resp.Connection, keys []string, asking bool, readonly bool) resp.Reply {
+	slot := KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if KeySlot(key) != slot {
+			return reply.MakeErrReply("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+
+	table := cluster.slots
+	table.mu.RLock()
+	owner := table.owners[slot]
+	migratingTo, migrating := table.migrating[slot]
+	_, importing := table.importing[slot]
+	table.mu.RUnlock()
+
+	if owner == cluster.self {
+		if !migrating {
+			return nil
+		}
+		// 槽位正在迁出：所有键都还在本地时直接执行，都不在本地时让客户端到目标节点执行
+		missing := 0
+		for _, key := range keys {
+			ret := cluster.db.Exec(c, utils.ToCmdLine("exists", key))
+			if intReply, ok := ret.(*reply.IntReply); ok && intReply.Code == 0 {
+				missing++
+			}
+		}
+		if missing == 0 {
+			return nil
+		}
+		if missing == len(keys) {
+			return reply.MakeErrReply(fmt.Sprintf("ASK %d %s", slot, migratingTo))
+		}
+		return reply.MakeErrReply("TRYAGAIN Multiple keys request during rehashing of slot")
+	}
+	if importing && asking {
+		return nil
+	}
+	if readonly && owner != "" && owner == cluster.primaryNode() {
+		return nil
+	}
+	if owner == "" {
+		return reply.MakeErrReply("CLUSTERDOWN Hash slot not served")
+	}
+	if cluster.bus.isFailing(owner) {
+		return makeClusterDownReply(owner)
+	}
+	return reply.MakeErrReply(fmt.Sprintf("MOVED %d %s", slot, owner))
+}
+
+// execSlotMode 在槽位模式下执行命令：本节点负责的键在本地执行，其他键回复重定向
+func (cluster *ClusterDatabase) execSlotMode(c resp.Connection, cmdLine [][]byte) resp.Reply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	switch cmdName {
+	case "cluster":
+		return execCluster(cluster, c, cmdLine)
+	case "asking":
+		if len(cmdLine) != 1 {
+			return reply.MakeArgNumErrReply(cmdName)
+		}
+		cluster.asking.Store(c, true)
+		return reply.MakeOkReply()
+	case "readonly":
+		return execReadOnly(cluster, c, cmdLine)
+	case "readwrite":
+		return execReadWrite(cluster, c, cmdLine)
+	case "info":
+		return execInfo(cluster, c, cmdLine)
+	}
+	// ASKING 只对紧接着的一条命令有效
+	_, asking := cluster.asking.LoadAndDelete(c)
+	keys, _ := database.GetCommandKeys(cmdLine)
+	if len(keys) > 0 {
+		_, readonly := cluster.readonly.Load(c)
+		readonly = readonly && database.IsReadOnlyCommand(cmdName)
+		if redirect := cluster.checkSlot(c, keys, asking, readonly); redirect != nil {
+			return redirect
+		}
+	}
+	return cluster.db.Exec(c, cmdLine)
+}
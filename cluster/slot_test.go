@@ -0,0 +1,45 @@
+package cluster
+
+import (
+	"goredis/lib/crc16"
+	"testing"
+)
+
+// TestKeySlot 与 Redis CLUSTER KEYSLOT 的结果相同
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key    string
+		expect int
+	}{
+		{key: "foo", expect: 12182},
+		{key: "somekey", expect: 11058},
+		{key: "123456789", expect: 0x31C3},
+	}
+	for _, tt := range tests {
+		if got := KeySlot(tt.key); got != tt.expect {
+			t.Errorf("KeySlot(%q) = %d, expect %d", tt.key, got, tt.expect)
+		}
+	}
+}
+
+// TestKeySlotHashTag 只对第一个 { 与之后第一个 } 之间的非空内容计算槽位
+func TestKeySlotHashTag(t *testing.T) {
+	tests := []struct {
+		key  string
+		same string // 与 key 在同一个槽位的键
+	}{
+		{key: "{user1000}.following", same: "{user1000}.followers"},
+		{key: "{user1000}.following", same: "user1000"},
+		{key: "foo{{bar}}zap", same: "{bar"},
+		{key: "foo{bar}{zap}", same: "bar"},
+	}
+	for _, tt := range tests {
+		if KeySlot(tt.key) != KeySlot(tt.same) {
+			t.Errorf("KeySlot(%q) = %d, expect KeySlot(%q) = %d", tt.key, KeySlot(tt.key), tt.same, KeySlot(tt.same))
+		}
+	}
+	// 第一个 {} 为空时对整个键计算
+	if got, expect := KeySlot("foo{}{bar}"), int(crc16.Checksum([]byte("foo{}{bar}")))%SlotCount; got != expect || got == KeySlot("bar") {
+		t.Errorf("KeySlot(%q) = %d, expect %d", "foo{}{bar}", got, expect)
+	}
+}
@@ -0,0 +1,536 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"goredis/database"
+	"goredis/interface/resp"
+	"goredis/lib/logger"
+	"goredis/lib/utils"
+	"goredis/resp/connection"
+	"goredis/resp/reply"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * 跨节点写命令的两阶段提交
+ * 协调者（收到客户端命令的节点）按节点地址顺序向每个参与者发送 Prepare <txid> <参与者列表> <子命令>：
+ * 参与者锁住子命令涉及的键，检查前置条件（例如 MSETNX 要求键不存在），记录恢复这些键的 undo log，回复键当前的快照。
+ * 所有参与者都准备成功后并行发送 Commit <txid>，参与者执行子命令，但是继续锁住键；
+ * 所有参与者都提交成功后协调者发送 Release <txid>，参与者释放锁，事务结束。
+ * 任何一步失败时向所有参与者发送 Rollback <txid>，未提交的事务直接释放锁，
+ * 已提交的事务执行 undo log 恢复原来的值后再释放锁，键在此期间一直被锁住，不会覆盖其他客户端的写入。
+ *
+ * 协调者只有在所有参与者都准备成功后才会发送 Commit，因此只要有一个参与者已经提交，事务的结果就是提交。
+ * 参与者在 txTimeout 内没有收到 Commit 时通过 TxStatus <txid> 询问其他参与者：有参与者已经提交时自己也提交，
+ * 否则回滚；已提交但没有收到 Release 或 Rollback 时释放锁并保留提交的结果。
+ * 结束的事务的结果保留 txTimeout，其他参与者超时时仍然可以查询到。
+ * 协调者在提交阶段下线时，各个参与者因此得到相同的结果；协调者没有下线但是超过 txTimeout 才发送 Commit 时，
+ * 参与者可能已经自行结束事务，协调者收到错误后回滚，已经自行提交并释放的参与者无法回滚，此时会记录警告
+ */
+
+const (
+	txCallTimeout = 3 * time.Second  // 协调者等待参与者回复的时间
+	txLockTimeout = time.Second      // 参与者等待键锁的时间，超时时准备失败，避免事务之间互相等待
+	txTimeout     = 10 * time.Second // 参与者保留事务的时间，超时未提交的事务询问其他参与者后提交或回滚
+	lockStripes   = 1024             // 键锁的分段数量
+)
+
+const (
+	txPrepared   = iota // 已经准备，锁住键
+	txCommitted         // 已经执行子命令，仍然锁住键，等待 Release 或 Rollback
+	txReleased          // 已经提交并释放锁
+	txRolledBack        // 已经回滚并释放锁
+)
+
+// txStatusNames TxStatus 回复的事务状态
+var txStatusNames = map[int]string{
+	txPrepared:   "prepared",
+	txCommitted:  "committed",
+	txReleased:   "released",
+	txRolledBack: "rolledback",
+}
+
+// transaction 参与者上的一个事务
+type transaction struct {
+	id       string
+	nodes    []string // 事务的所有参与者，超时时向它们询问事务的结果
+	cmdLine  [][]byte // 提交时执行的子命令
+	dbIndex  int
+	keys     []string
+	undoLogs [][][]byte // 按顺序执行可以恢复事务开始前的键
+
+	mu     sync.Mutex
+	status int
+	timer  *time.Timer
+}
+
+// execLocked 在本地执行命令，执行期间锁住命令涉及的键，准备好的事务锁住的键需要等待事务结束
+func (cluster *ClusterDatabase) execLocked(c resp.Connection, cmdLine [][]byte) resp.Reply {
+	keys, _ := database.GetCommandKeys(cmdLine)
+	if len(keys) == 0 {
+		return cluster.db.Exec(c, cmdLine)
+	}
+	if database.IsReadOnlyCommand(string(cmdLine[0])) {
+		cluster.keyLocks.RWLocks(nil, keys)
+		defer cluster.keyLocks.RWUnLocks(nil, keys)
+	} else {
+		cluster.keyLocks.RWLocks(keys, nil)
+		defer cluster.keyLocks.RWUnLocks(keys, nil)
+	}
+	return cluster.db.Exec(c, cmdLine)
+}
+
+// execPrepare 处理 Prepare <txid> <nodes> <command> [args...]，nodes 是以逗号分隔的所有参与者
+// 锁住键并记录 undo log，回复每个键的快照 [payload, pttl, ...]，键不存在时 payload 为空
+func execPrepare(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) < 4 {
+		return reply.MakeArgNumErrReply("prepare")
+	}
+	id := string(args[1])
+	cmdLine := args[3:]
+	keys, ok := database.GetCommandKeys(cmdLine)
+	if !ok {
+		return reply.MakeErrReply("ERR unknown command '" + strings.ToLower(string(cmdLine[0])) + "'")
+	}
+	tx := &transaction{
+		id:      id,
+		nodes:   strings.Split(string(args[2]), ","),
+		cmdLine: cmdLine,
+		dbIndex: c.GetDBIndex(),
+		keys:    keys,
+	}
+	// 检查 id 和放入事务表在同一次持有 txLock 时完成，相同 id 的 Prepare 只有一个能继续
+	// 准备期间持有 tx.mu，同时到达的 Commit 或 Rollback 等待准备结束
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	cluster.txLock.Lock()
+	if _, exists := cluster.transactions[id]; exists {
+		cluster.txLock.Unlock()
+		return reply.MakeErrReply("ERR transaction " + id + " already exists")
+	}
+	cluster.transactions[id] = tx
+	cluster.txLock.Unlock()
+	if !cluster.keyLocks.TryRWLocks(keys, nil, txLockTimeout) {
+		cluster.abortPrepare(tx)
+		return reply.MakeErrReply("ERR transaction " + id + " timed out waiting for key locks")
+	}
+
+	conn := &connection.FakeConn{}
+	conn.SelectDB(tx.dbIndex)
+	snapshot := make([][]byte, 0, 2*len(keys))
+	for _, key := range keys {
+		payload, ttl, errReply := cluster.snapshotKey(conn, key)
+		if errReply != nil {
+			// 无法记录 undo log 的键不能参与事务
+			cluster.keyLocks.RWUnLocks(keys, nil)
+			cluster.abortPrepare(tx)
+			return errReply
+		}
+		snapshot = append(snapshot, payload, []byte(strconv.FormatInt(ttl, 10)))
+		if payload == nil {
+			tx.undoLogs = append(tx.undoLogs, utils.ToCmdLine("DEL", key))
+		} else {
+			if ttl < 0 {
+				ttl = 0
+			}
+			tx.undoLogs = append(tx.undoLogs, utils.ToCmdLine2("RESTORE", []byte(key),
+				[]byte(strconv.FormatInt(ttl, 10)), payload, []byte("REPLACE")))
+		}
+	}
+	if errReply := checkPrecondition(cmdLine, snapshot); errReply != nil {
+		cluster.keyLocks.RWUnLocks(keys, nil)
+		cluster.abortPrepare(tx)
+		return errReply
+	}
+
+	tx.timer = time.AfterFunc(txTimeout, func() {
+		cluster.expireTx(tx)
+	})
+	return reply.MakeMultiBulkReply(snapshot)
+}
+
+// abortPrepare 准备失败时将事务从事务表中删除，调用者需要持有 tx.mu，此时还没有锁住键
+func (cluster *ClusterDatabase) abortPrepare(tx *transaction) {
+	cluster.txLock.Lock()
+	delete(cluster.transactions, tx.id)
+	cluster.txLock.Unlock()
+	tx.status = txRolledBack
+}
+
+// snapshotKey 返回键的 DUMP 结果和剩余的过期时间（毫秒，-1 表示不过期），键不存在时 payload 为 nil
+func (cluster *ClusterDatabase) snapshotKey(conn resp.Connection, key string) ([]byte, int64, resp.Reply) {
+	ret := cluster.db.Exec(conn, utils.ToCmdLine("DUMP", key))
+	if reply.IsErrorReply(ret) {
+		return nil, 0, ret
+	}
+	dump, ok := ret.(*reply.BulkReply)
+	if !ok {
+		return nil, -2, nil
+	}
+	ttl, ok := cluster.db.Exec(conn, utils.ToCmdLine("PTTL", key)).(*reply.IntReply)
+	if !ok {
+		return dump.Arg, -1, nil
+	}
+	return dump.Arg, ttl.Code, nil
+}
+
+// checkPrecondition 检查子命令在键当前的状态下能否执行，提交时不会因为键已经存在而失败
+func checkPrecondition(cmdLine [][]byte, snapshot [][]byte) resp.Reply {
+	busy := false
+	switch strings.ToLower(string(cmdLine[0])) {
+	case "msetnx":
+		busy = true
+	case "restore":
+		busy = true
+		for _, arg := range cmdLine[4:] {
+			if strings.ToUpper(string(arg)) == "REPLACE" {
+				busy = false
+			}
+		}
+	}
+	if !busy {
+		return nil
+	}
+	for i := 0; i < len(snapshot); i += 2 {
+		if snapshot[i] != nil {
+			return reply.MakeErrReply("BUSYKEY Target key name already exists.")
+		}
+	}
+	return nil
+}
+
+// execCommit 处理 Commit <txid> [command [args...]]，执行事务的子命令，回复子命令的结果
+// 提交时可以替换准备时的子命令，新的子命令只能访问准备时锁住的键，用于准备时还不知道参数的子命令
+// 提交后仍然锁住键，协调者确认所有参与者都提交成功后发送 Release，有参与者失败时发送 Rollback
+func execCommit(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) < 2 {
+		return reply.MakeArgNumErrReply("commit")
+	}
+	tx := cluster.getTx(string(args[1]))
+	if tx == nil {
+		return reply.MakeErrReply("ERR transaction " + string(args[1]) + " not found")
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	switch tx.status {
+	case txCommitted, txReleased:
+		return reply.MakeErrReply("ERR transaction " + tx.id + " already committed")
+	case txRolledBack:
+		return reply.MakeErrReply("ERR transaction " + tx.id + " already rolled back")
+	}
+	if len(args) > 2 {
+		keys, ok := database.GetCommandKeys(args[2:])
+		if !ok || !slices.Equal(keys, tx.keys) {
+			return reply.MakeErrReply("ERR transaction " + tx.id + " commit command must access the prepared keys")
+		}
+		tx.cmdLine = args[2:]
+	}
+	return cluster.commitLocked(tx)
+}
+
+// commitLocked 执行事务的子命令，调用者需要持有 tx.mu
+func (cluster *ClusterDatabase) commitLocked(tx *transaction) resp.Reply {
+	conn := &connection.FakeConn{}
+	conn.SelectDB(tx.dbIndex)
+	ret := cluster.db.Exec(conn, tx.cmdLine)
+	tx.status = txCommitted
+	return ret
+}
+
+// execTxStatus 处理 TxStatus <txid>，回复事务在本节点的状态，事务不存在并且没有结束的记录时回复 unknown
+func execTxStatus(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) != 2 {
+		return reply.MakeArgNumErrReply("txstatus")
+	}
+	id := string(args[1])
+	if tx := cluster.getTx(id); tx != nil {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		return reply.MakeStatusReply(txStatusNames[tx.status])
+	}
+	cluster.txLock.Lock()
+	status, ok := cluster.finishedTx[id]
+	cluster.txLock.Unlock()
+	if !ok {
+		return reply.MakeStatusReply("unknown")
+	}
+	return reply.MakeStatusReply(txStatusNames[status])
+}
+
+// execRelease 处理 Release <txid>，所有参与者都已经提交，释放键锁并结束事务
+// 事务不存在时（已经超时）直接回复 OK
+func execRelease(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) != 2 {
+		return reply.MakeArgNumErrReply("release")
+	}
+	tx := cluster.getTx(string(args[1]))
+	if tx == nil {
+		return reply.MakeOkReply()
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	switch tx.status {
+	case txPrepared:
+		return reply.MakeErrReply("ERR transaction " + tx.id + " not committed")
+	case txRolledBack:
+		return reply.MakeErrReply("ERR transaction " + tx.id + " already rolled back")
+	case txCommitted:
+		cluster.releaseLocked(tx)
+	}
+	return reply.MakeOkReply()
+}
+
+// execRollback 处理 Rollback <txid>，事务不存在时（已经超时或从未准备成功）直接回复 OK
+func execRollback(cluster *ClusterDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) != 2 {
+		return reply.MakeArgNumErrReply("rollback")
+	}
+	tx := cluster.getTx(string(args[1]))
+	if tx == nil {
+		return reply.MakeOkReply()
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	cluster.rollbackLocked(tx)
+	return reply.MakeOkReply()
+}
+
+func (cluster *ClusterDatabase) getTx(id string) *transaction {
+	cluster.txLock.Lock()
+	defer cluster.txLock.Unlock()
+	return cluster.transactions[id]
+}
+
+// removeTx 将结束的事务从事务表中删除，结果在 finishedTx 中保留 txTimeout，供超时的其他参与者查询
+func (cluster *ClusterDatabase) removeTx(tx *transaction) {
+	cluster.txLock.Lock()
+	delete(cluster.transactions, tx.id)
+	cluster.finishedTx[tx.id] = tx.status
+	cluster.txLock.Unlock()
+	if tx.timer != nil {
+		tx.timer.Stop()
+	}
+	time.AfterFunc(txTimeout, func() {
+		cluster.txLock.Lock()
+		delete(cluster.finishedTx, tx.id)
+		cluster.txLock.Unlock()
+	})
+}
+
+// releaseLocked 结束已经提交的事务并释放键锁，调用者需要持有 tx.mu
+func (cluster *ClusterDatabase) releaseLocked(tx *transaction) {
+	tx.status = txReleased
+	cluster.removeTx(tx)
+	cluster.keyLocks.RWUnLocks(tx.keys, nil)
+}
+
+// rollbackLocked 回滚事务并释放键锁，调用者需要持有 tx.mu
+// 已提交的事务在释放锁之前执行 undo log，期间其他客户端不能修改这些键
+func (cluster *ClusterDatabase) rollbackLocked(tx *transaction) {
+	switch tx.status {
+	case txReleased, txRolledBack:
+		return
+	case txCommitted:
+		conn := &connection.FakeConn{}
+		conn.SelectDB(tx.dbIndex)
+		for i := len(tx.undoLogs) - 1; i >= 0; i-- {
+			if ret := cluster.db.Exec(conn, tx.undoLogs[i]); reply.IsErrorReply(ret) {
+				logger.Warn(fmt.Sprintf("cluster: undo transaction %s failed: %s", tx.id, string(ret.ToBytes())))
+			}
+		}
+	}
+	tx.status = txRolledBack
+	cluster.removeTx(tx)
+	cluster.keyLocks.RWUnLocks(tx.keys, nil)
+}
+
+// expireTx 事务超时：未提交的事务询问其他参与者，有参与者已经提交时提交，否则回滚；
+// 已提交的事务保留提交的结果并释放锁
+// 询问时不持有 tx.mu，其他参与者同时超时并询问本节点时不会互相等待；
+// 之后判断状态和提交或回滚在同一次持有 tx.mu 时完成，不会与 Commit、Release 或 Rollback 交错
+func (cluster *ClusterDatabase) expireTx(tx *transaction) {
+	tx.mu.Lock()
+	status := tx.status
+	tx.mu.Unlock()
+	committedBy := ""
+	if status == txPrepared {
+		committedBy = cluster.findCommitted(tx)
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	nodes := strings.Join(tx.nodes, ",")
+	switch tx.status {
+	case txPrepared:
+		if committedBy == "" {
+			logger.Warn(fmt.Sprintf("cluster: transaction %s (nodes %s) not committed in time, rolling back", tx.id, nodes))
+			cluster.rollbackLocked(tx)
+			return
+		}
+		logger.Warn(fmt.Sprintf("cluster: transaction %s (nodes %s) not committed in time, committing because %s committed",
+			tx.id, nodes, committedBy))
+		if ret := cluster.commitLocked(tx); reply.IsErrorReply(ret) {
+			logger.Warn(fmt.Sprintf("cluster: commit transaction %s failed: %s", tx.id, string(ret.ToBytes())))
+		}
+		cluster.releaseLocked(tx)
+	case txCommitted:
+		logger.Warn(fmt.Sprintf("cluster: transaction %s (nodes %s) not released in time, keeping the committed writes", tx.id, nodes))
+		cluster.releaseLocked(tx)
+	}
+}
+
+// findCommitted 向事务的其他参与者查询状态，返回已经提交的参与者，没有时返回空字符串
+func (cluster *ClusterDatabase) findCommitted(tx *transaction) string {
+	cmdLine := utils.ToCmdLine("TxStatus", tx.id)
+	for _, node := range tx.nodes {
+		if node == cluster.self {
+			continue
+		}
+		ret, ok := cluster.relayTimeout(node, &connection.FakeConn{}, cmdLine, txCallTimeout).(*reply.StatusReply)
+		if ok && (ret.Status == txStatusNames[txCommitted] || ret.Status == txStatusNames[txReleased]) {
+			return node
+		}
+	}
+	return ""
+}
+
+// coordinator 协调一个跨节点事务
+type coordinator struct {
+	cluster    *ClusterDatabase
+	conn       resp.Connection
+	id         string
+	nodes      []string            // 所有参与者，按地址排序，也是准备的顺序
+	prepared   []string            // 已经准备成功的节点
+	commitArgs map[string][][]byte // 提交时替换子命令的节点 -> 新的子命令
+}
+
+// newCoordinator 创建事务的协调者，nodes 是所有参与者
+func (cluster *ClusterDatabase) newCoordinator(c resp.Connection, nodes []string) *coordinator {
+	nodes = slices.Clone(nodes)
+	sort.Strings(nodes)
+	return &coordinator{
+		cluster:    cluster,
+		conn:       c,
+		nodes:      nodes,
+		commitArgs: make(map[string][][]byte),
+		id:         cluster.self + "-" + cluster.runId + "-" + strconv.FormatUint(atomic.AddUint64(&cluster.txSeq, 1), 10),
+	}
+}
+
+// makeRunId 生成本次启动的随机 ID，加入事务 ID 后重启前后的事务 ID 不会重复
+func makeRunId() string {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// txHandlers 参与者处理事务命令的函数，协调者自己也是参与者时直接调用
+var txHandlers = map[string]CmdFunc{
+	"prepare":  execPrepare,
+	"commit":   execCommit,
+	"rollback": execRollback,
+	"release":  execRelease,
+}
+
+// call 向参与者发送事务命令，本节点直接调用处理函数
+func (tx *coordinator) call(node string, cmdLine [][]byte) resp.Reply {
+	if node == tx.cluster.self {
+		return txHandlers[strings.ToLower(string(cmdLine[0]))](tx.cluster, tx.conn, cmdLine)
+	}
+	return tx.cluster.relayTimeout(node, tx.conn, cmdLine, txCallTimeout)
+}
+
+// prepare 让 node 准备执行 cmdLine，回复键的快照 [payload, pttl, ...]
+func (tx *coordinator) prepare(node string, cmdLine [][]byte) ([][]byte, resp.Reply) {
+	header := [][]byte{[]byte(tx.id), []byte(strings.Join(tx.nodes, ","))}
+	ret := tx.call(node, utils.ToCmdLine2("Prepare", append(header, cmdLine...)...))
+	snapshot, ok := ret.(*reply.MultiBulkReply)
+	if !ok {
+		if reply.IsErrorReply(ret) {
+			return nil, ret
+		}
+		return nil, reply.MakeErrReply("ERR unexpected prepare reply " + string(ret.ToBytes()))
+	}
+	tx.prepared = append(tx.prepared, node)
+	return snapshot.Args, nil
+}
+
+// prepareAll 按节点地址顺序准备所有子命令，失败时回滚已经准备的节点
+// 所有协调者都按相同的顺序锁住各个节点，事务之间不会互相等待
+func (tx *coordinator) prepareAll(parts map[string][][]byte) resp.Reply {
+	for _, node := range tx.nodes {
+		if _, errReply := tx.prepare(node, parts[node]); errReply != nil {
+			tx.rollback()
+			return errReply
+		}
+	}
+	return nil
+}
+
+// commit 并行提交所有准备好的节点，返回 节点 -> 子命令的结果
+// 所有节点都提交成功后释放各个节点的锁，有节点提交失败时回滚所有节点，返回错误
+func (tx *coordinator) commit() (map[string]resp.Reply, resp.Reply) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	replies := make(map[string]resp.Reply, len(tx.prepared))
+	for _, node := range tx.prepared {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			ret := tx.call(node, utils.ToCmdLine2("Commit", append([][]byte{[]byte(tx.id)}, tx.commitArgs[node]...)...))
+			mu.Lock()
+			replies[node] = ret
+			mu.Unlock()
+		}(node)
+	}
+	wg.Wait()
+	if errReply := collectErrors(replies); errReply != nil {
+		tx.rollback()
+		return nil, errReply
+	}
+	tx.finish("Release")
+	return replies, nil
+}
+
+// rollback 回滚所有准备过的节点
+func (tx *coordinator) rollback() {
+	tx.finish("Rollback")
+}
+
+// finish 向所有准备过的节点并行发送 Release 或 Rollback，结束事务
+func (tx *coordinator) finish(command string) {
+	var wg sync.WaitGroup
+	cmdLine := utils.ToCmdLine(command, tx.id)
+	for _, node := range tx.prepared {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			if ret := tx.call(node, cmdLine); reply.IsErrorReply(ret) {
+				// 参与者会在超时后自动结束事务
+				logger.Warn(fmt.Sprintf("cluster: %s transaction %s on %s failed: %s",
+					strings.ToLower(command), tx.id, node, string(ret.ToBytes())))
+			}
+		}(node)
+	}
+	wg.Wait()
+}
+
+// execTx 以事务的方式在各个节点上执行子命令，返回 节点 -> 子命令的结果
+func (cluster *ClusterDatabase) execTx(c resp.Connection, parts map[string][][]byte) (map[string]resp.Reply, resp.Reply) {
+	nodes := make([]string, 0, len(parts))
+	for node := range parts {
+		nodes = append(nodes, node)
+	}
+	tx := cluster.newCoordinator(c, nodes)
+	if errReply := tx.prepareAll(parts); errReply != nil {
+		return nil, errReply
+	}
+	return tx.commit()
+}
@@ -0,0 +1,86 @@
+// aof-check 校验 AOF 文件，并可以将其修复到最后一条完整命令
+//
+// 用法：aof-check [--fix] <file.aof|file.manifest>
+// 传入清单文件时按顺序校验其中的所有文件，只有最后一个文件允许尾部不完整
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"goredis/aof"
+	"os"
+	"strings"
+)
+
+func main() {
+	fix := flag.Bool("fix", false, "truncate the file to the last valid command")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [--fix] <file.aof|file.manifest>\n", os.Args[0])
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	filename := flag.Arg(0)
+
+	files := []string{filename}
+	if strings.HasSuffix(filename, ".manifest") {
+		var err error
+		files, err = aof.ManifestFiles(filename)
+		if err != nil {
+			fmt.Println("Cannot read manifest:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Manifest %s lists %d file(s)\n", filename, len(files))
+	}
+	for i, file := range files {
+		checkFile(file, *fix, i == len(files)-1)
+	}
+}
+
+// checkFile 校验单个文件，last 表示它是否为最后一个文件
+func checkFile(filename string, fix bool, last bool) {
+	result, err := aof.CheckAof(filename)
+	if err != nil {
+		fmt.Println("Cannot open file:", err)
+		os.Exit(1)
+	}
+	diff := result.Size - result.ValidSize
+	fmt.Printf("AOF analyzed: filename=%s, size=%d, ok_up_to=%d, commands=%d, diff=%d\n",
+		filename, result.Size, result.ValidSize, result.Commands, diff)
+	if result.Err == nil {
+		fmt.Println("AOF is valid")
+		return
+	}
+
+	// 不是最后一个文件时，尾部不完整也说明文件已损坏
+	truncated := result.Truncated() && last
+	if truncated {
+		fmt.Printf("AOF is truncated: the last command starting at offset %d is incomplete\n", result.ValidSize)
+	} else {
+		fmt.Printf("AOF is corrupted: first bad record at offset %d (%v)\n", result.ValidSize, result.Err)
+	}
+	if !fix {
+		fmt.Println("AOF is not valid. Use the --fix option to try fixing it.")
+		os.Exit(1)
+	}
+
+	if !truncated {
+		// 文件中间损坏时，修复会丢弃损坏位置之后的所有命令，需要用户确认
+		fmt.Printf("This will shrink the AOF from %d bytes, with %d bytes, to %d bytes\n",
+			result.Size, diff, result.ValidSize)
+		fmt.Print("Continue? [y/N]: ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			fmt.Println("Aborting...")
+			os.Exit(1)
+		}
+	}
+	if err := aof.FixAof(filename, result.ValidSize); err != nil {
+		fmt.Println("Failed to truncate AOF:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Successfully truncated AOF")
+}
@@ -12,32 +12,71 @@ import (
 
 // ServerProperties defines global config properties
 type ServerProperties struct {
-	Bind           string `cfg:"bind"`
-	Port           int    `cfg:"port"`
-	AppendOnly     bool   `cfg:"appendOnly"`
-	AppendFilename string `cfg:"appendFilename"`
-	MaxClients     int    `cfg:"maxclients"`
-	RequirePass    string `cfg:"requirepass"`
-	Databases      int    `cfg:"databases"`
+	Bind               string `cfg:"bind"`
+	Port               int    `cfg:"port"`
+	AppendOnly         bool   `cfg:"appendOnly"`
+	AppendFilename     string `cfg:"appendFilename"`
+	AppendDirname      string `cfg:"appenddirname"`
+	AofLoadTruncated   bool   `cfg:"aof-load-truncated"`
+	MaxClients         int    `cfg:"maxclients"`
+	RequirePass        string `cfg:"requirepass"`
+	ProtoMaxBulkLen    int    `cfg:"proto-max-bulk-len"` // 单个批量字符串的最大字节数
+	Databases          int    `cfg:"databases"`
+	ReplicaOf          string `cfg:"replicaof"`
+	ReplBacklogSize    int    `cfg:"repl-backlog-size"`
+	ReplicaReadOnly    bool   `cfg:"replica-read-only"`
+	MinReplicasToWrite int    `cfg:"min-replicas-to-write"`
+	MinReplicasMaxLag  int    `cfg:"min-replicas-max-lag"`
 
-	Peers []string `cfg:"peers"`
-	Self  string   `cfg:"self"`
+	ClientOutputBufferLimit []string `cfg:"client-output-buffer-limit"` // 每类客户端的输出缓冲区限制：<class> <hard> <soft> <soft seconds>,...
+
+	Peers          []string `cfg:"peers"`
+	Self           string   `cfg:"self"`
+	ClusterEnabled bool     `cfg:"cluster-enabled"`
+	VirtualNodes   int      `cfg:"virtual-nodes"`
+	NodeWeights    []string `cfg:"node-weights"`
+	NodeTimeout    int      `cfg:"cluster-node-timeout"`
+	ClusterSecret  string   `cfg:"cluster-secret"` // 节点之间认证使用的密钥，为空时使用 requirepass
+
+	PeerPoolMaxTotal      int  `cfg:"peer-pool-max-total"`      // 到每个节点的最大连接数
+	PeerPoolMaxIdle       int  `cfg:"peer-pool-max-idle"`       // 到每个节点的最大空闲连接数
+	PeerPoolBorrowTimeout int  `cfg:"peer-pool-borrow-timeout"` // 连接用尽时等待空闲连接的毫秒数
+	PeerPoolIdleTimeout   int  `cfg:"peer-pool-idle-timeout"`   // 空闲超过这么多秒的连接被关闭，0 表示不关闭
+	PeerPoolTestOnBorrow  bool `cfg:"peer-pool-test-on-borrow"` // 借出连接前先 PING 检查
+
+	Proxy bool `cfg:"proxy"` // 代理模式，按键将命令转发给 peers 中的后端，本地不存储数据
+
+	Sentinel                bool     `cfg:"sentinel"`
+	SentinelMonitor         []string `cfg:"sentinel-monitor"`
+	SentinelAuthPass        []string `cfg:"sentinel-auth-pass"` // 连接主库和从库使用的密码：<name> <password>,...
+	SentinelPeers           []string `cfg:"sentinel-peers"`
+	SentinelDownAfter       int      `cfg:"sentinel-down-after-milliseconds"`
+	SentinelFailoverTimeout int      `cfg:"sentinel-failover-timeout"`
 }
 
 // Properties holds global config properties
 var Properties *ServerProperties
 
-func init() {
-	// default config
-	Properties = &ServerProperties{
-		Bind:       "127.0.0.1",
-		Port:       6379,
-		AppendOnly: false,
+// DefaultProperties 返回默认配置，没有配置文件时直接使用，读取配置文件时在默认配置的基础上覆盖
+// 所有配置项的默认值都只在这里定义
+func DefaultProperties() *ServerProperties {
+	return &ServerProperties{
+		Bind:              "0.0.0.0",
+		Port:              6379,
+		AofLoadTruncated:  true,
+		ProtoMaxBulkLen:   512 * 1024 * 1024,
+		Databases:         16,
+		ReplicaReadOnly:   true,
+		MinReplicasMaxLag: 10,
 	}
 }
 
+func init() {
+	Properties = DefaultProperties()
+}
+
 func parse(src io.Reader) *ServerProperties {
-	config := &ServerProperties{}
+	config := DefaultProperties()
 
 	// read config file
 	rawMap := make(map[string]string)
@@ -6,17 +6,77 @@ import (
 
 var cmdTable = make(map[string]*command)
 
+// 命令标志
+const (
+	flagWrite    = 1 << iota // 会修改数据的命令，只读从库上会被拒绝
+	flagReadOnly             // 只读取数据的命令
+)
+
 type command struct {
 	executor ExecFunc
 	arity    int // 参数数量
+	flags    int // 命令标志
+	firstKey int // 第一个键在命令行中的位置，0 表示命令没有键
+	lastKey  int // 最后一个键的位置，负数表示从命令行末尾倒数
+	keyStep  int // 相邻两个键之间的距离
 }
 
 // RegisterCommand
 // arity允许命令参数数量,如果arity < 0 就意味着len()args >= -arity
-func RegisterCommand(name string, executor ExecFunc, arity int) {
+// flags 为 flagWrite、flagReadOnly 等命令标志的组合
+// firstKey、lastKey、keyStep 描述键在命令行中的位置，与 Redis COMMAND 的输出含义相同
+func RegisterCommand(name string, executor ExecFunc, arity int, flags int, firstKey int, lastKey int, keyStep int) {
 	name = strings.ToLower(name)
 	cmdTable[name] = &command{
 		executor: executor,
 		arity:    arity,
+		flags:    flags,
+		firstKey: firstKey,
+		lastKey:  lastKey,
+		keyStep:  keyStep,
+	}
+}
+
+// GetCommandKeys 返回命令行中的所有键，集群模式使用它确定命令需要访问的槽位
+// 命令不存在时 ok 为 false
+func GetCommandKeys(cmdLine [][]byte) (keys []string, ok bool) {
+	cmd, ok := cmdTable[strings.ToLower(string(cmdLine[0]))]
+	if !ok {
+		return nil, false
+	}
+	if cmd.firstKey <= 0 || cmd.firstKey >= len(cmdLine) {
+		return nil, true
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last = len(cmdLine) + last
+	}
+	if last >= len(cmdLine) {
+		last = len(cmdLine) - 1
 	}
+	for i := cmd.firstKey; i <= last; i += cmd.keyStep {
+		keys = append(keys, string(cmdLine[i]))
+	}
+	return keys, true
+}
+
+// CommandNames 返回所有已注册的命令名（小写），集群模式根据它们的键位置生成路由
+func CommandNames() []string {
+	names := make([]string, 0, len(cmdTable))
+	for name := range cmdTable {
+		names = append(names, name)
+	}
+	return names
+}
+
+// isWriteCommand 判断命令是否会修改数据
+func isWriteCommand(name string) bool {
+	cmd, ok := cmdTable[name]
+	return ok && cmd.flags&flagWrite != 0
+}
+
+// IsReadOnlyCommand 判断命令是否只读取数据，集群模式下客户端发送 READONLY 后只读命令可以由从库执行
+func IsReadOnlyCommand(name string) bool {
+	cmd, ok := cmdTable[strings.ToLower(name)]
+	return ok && cmd.flags&flagReadOnly != 0
 }
@@ -5,17 +5,27 @@ import (
 	"goredis/datastruct/dict"
 	"goredis/interface/database"
 	"goredis/interface/resp"
+	"goredis/lib/lock"
 	"goredis/resp/reply"
 	"strings"
+	"sync"
 	"time"
 )
 
+// keyLockCount 每个 DB 中写命令使用的键锁的段数
+const keyLockCount = 1024
+
 // DB stores data and execute user's commands
 type DB struct {
 	index  int
-	data   dict.Dict
+	data   *dict.BucketDict // SCAN 需要按游标遍历，只有 BucketDict 支持
 	addAof func(CmdLine)
 
+	// 写命令的执行与写入 AOF、追加到复制流必须作为一个整体，
+	// 同一个键上的写命令按执行的顺序进入 AOF 和复制流，从库与主库的执行顺序一致
+	writeLock sync.RWMutex // 有键的写命令持有读锁，没有键的写命令（如 FLUSHDB）持有写锁
+	keyLocks  *lock.Locks  // 有键的写命令对自己的键加锁
+
 	// used for checking expiration
 	ttlKeys dict.Dict // key -> expireTime
 }
@@ -29,9 +39,10 @@ type CmdLine = [][]byte
 // makeDB 创建DB实例
 func makeDB() *DB {
 	db := &DB{
-		data:    dict.MakeSyncDict(),
-		addAof:  func(line CmdLine) {},
-		ttlKeys: dict.MakeSyncDict(),
+		data:     dict.MakeBucketDict(),
+		addAof:   func(line CmdLine) {},
+		keyLocks: lock.Make(keyLockCount),
+		ttlKeys:  dict.MakeSyncDict(),
 	}
 	return db
 }
@@ -47,10 +58,35 @@ func (db *DB) Exec(c resp.Connection, cmdLine [][]byte) resp.Reply {
 	if !validateArity(cmd.arity, cmdLine) {
 		return reply.MakeArgNumErrReply(cmdName)
 	}
+	if cmd.flags&flagWrite != 0 {
+		keys, _ := GetCommandKeys(cmdLine)
+		db.lockWrite(keys)
+		defer db.unlockWrite(keys)
+	}
 	fun := cmd.executor
 	return fun(db, cmdLine[1:])
 }
 
+// lockWrite 写命令执行前加锁，keys 为空时锁住整个 DB
+func (db *DB) lockWrite(keys []string) {
+	if len(keys) == 0 {
+		db.writeLock.Lock()
+		return
+	}
+	db.writeLock.RLock()
+	db.keyLocks.RWLocks(keys, nil)
+}
+
+// unlockWrite 释放 lockWrite 加的锁
+func (db *DB) unlockWrite(keys []string) {
+	if len(keys) == 0 {
+		db.writeLock.Unlock()
+		return
+	}
+	db.keyLocks.RWUnLocks(keys, nil)
+	db.writeLock.RUnlock()
+}
+
 func validateArity(arity int, cmdArgs [][]byte) bool {
 	argNum := len(cmdArgs)
 	if arity >= 0 {
@@ -115,3 +151,15 @@ func (db *DB) Removes(keys ...string) (deleted int) {
 func (db *DB) Flush() {
 	db.data.Clear()
 }
+
+// ForEach 遍历所有未过期的键
+func (db *DB) ForEach(cb func(key string, entity *database.DataEntity) bool) {
+	now := time.Now().UnixNano() / 1e6
+	db.data.ForEach(func(key string, raw interface{}) bool {
+		entity, _ := raw.(*database.DataEntity)
+		if entity.ExpireTime > 0 && entity.ExpireTime <= now {
+			return true
+		}
+		return cb(key, entity)
+	})
+}
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"encoding/binary"
+	"goredis/aof"
+	"goredis/interface/database"
+	"goredis/interface/resp"
+	"goredis/resp/reply"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * DUMP/RESTORE 用于在节点之间迁移键
+ * 序列化格式：[类型 1 字节][数据][版本 1 字节][CRC32 4 字节，小端]
+ * 与 Redis 相同，DUMP 的结果不包含过期时间，由调用者通过 PTTL 获取后传给 RESTORE
+ */
+
+const (
+	dumpVersion    = 1
+	dumpTypeString = 0
+)
+
+var errBadPayload = reply.MakeErrReply("ERR DUMP payload version or checksum are wrong")
+
+// dumpEntity 序列化数据实体，不支持的类型返回 nil
+func dumpEntity(entity *database.DataEntity) []byte {
+	var payload []byte
+	switch val := entity.Data.(type) {
+	case []byte:
+		payload = make([]byte, 0, len(val)+6)
+		payload = append(payload, dumpTypeString)
+		payload = append(payload, val...)
+	default:
+		return nil
+	}
+	payload = append(payload, dumpVersion)
+	return binary.LittleEndian.AppendUint32(payload, crc32.ChecksumIEEE(payload))
+}
+
+// loadEntity 反序列化 dumpEntity 的结果，校验失败返回 nil
+func loadEntity(payload []byte) *database.DataEntity {
+	if len(payload) < 6 {
+		return nil
+	}
+	body, sum := payload[:len(payload)-4], payload[len(payload)-4:]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(sum) || body[len(body)-1] != dumpVersion {
+		return nil
+	}
+	data := body[1 : len(body)-1]
+	switch body[0] {
+	case dumpTypeString:
+		value := make([]byte, len(data))
+		copy(value, data)
+		return &database.DataEntity{Data: value}
+	}
+	return nil
+}
+
+// execDump 返回键的序列化结果，键不存在时返回 nil
+func execDump(db *DB, args [][]byte) resp.Reply {
+	entity, exists := db.GetEntity(string(args[0]))
+	if !exists {
+		return &reply.NullBulkReply{}
+	}
+	payload := dumpEntity(entity)
+	if payload == nil {
+		return reply.MakeErrReply("ERR unsupported data type")
+	}
+	return reply.MakeBulkReply(payload)
+}
+
+// execRestore 处理 RESTORE key ttl payload [REPLACE] [ABSTTL]
+// ttl 为 0 表示不过期，ABSTTL 表示 ttl 是以毫秒为单位的 Unix 时间戳
+func execRestore(db *DB, args [][]byte) resp.Reply {
+	key := string(args[0])
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return reply.MakeErrReply("ERR Invalid TTL value, must be >= 0")
+	}
+	replace, absTTL := false, false
+	for _, arg := range args[3:] {
+		switch strings.ToUpper(string(arg)) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		default:
+			return &reply.SyntaxErrReply{}
+		}
+	}
+	entity := loadEntity(args[2])
+	if entity == nil {
+		return errBadPayload
+	}
+	if _, exists := db.GetEntity(key); exists && !replace {
+		return reply.MakeErrReply("BUSYKEY Target key name already exists.")
+	}
+	if ttl > 0 {
+		if absTTL {
+			entity.ExpireTime = ttl
+		} else {
+			entity.ExpireTime = time.Now().UnixNano()/1e6 + ttl
+		}
+		if entity.ExpireTime <= time.Now().UnixNano()/1e6 {
+			// 已经过期的键不需要恢复
+			return &reply.OkReply{}
+		}
+	}
+	db.PutEntity(key, entity)
+	// 以 SET + PEXPIREAT 记录，重放时不依赖 RESTORE 的相对过期时间
+	db.addAof(aof.EntityToCmd(key, entity))
+	if entity.ExpireTime > 0 {
+		db.addAof(aof.MakeExpireCmd(key, entity.ExpireTime))
+	}
+	return &reply.OkReply{}
+}
+
+func init() {
+	RegisterCommand("Dump", execDump, 2, flagReadOnly, 1, 1, 1)
+	RegisterCommand("Restore", execRestore, -4, flagWrite, 1, 1, 1)
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"fmt"
+	"goredis/config"
+	databaseface "goredis/interface/database"
+	"goredis/interface/resp"
+	"goredis/resp/reply"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// serverStartTime 服务启动时间，用于计算 uptime
+	serverStartTime = time.Now()
+	// serverRunId 每次启动随机生成的 ID，sentinel 用它区分实例
+	serverRunId = makeReplId()
+)
+
+// infoSection INFO 命令输出的一个部分，新增部分只需要追加到 infoSections 中
+type infoSection struct {
+	name  string // INFO <section> 使用的名称
+	title string // 输出中 "# " 之后的标题
+	gen   func(mdb *StandaloneDatabase, builder *strings.Builder)
+}
+
+var infoSections = []*infoSection{
+	{name: "server", title: "Server", gen: genServerInfo},
+	{name: "replication", title: "Replication", gen: genReplicationInfo},
+	{name: "keyspace", title: "Keyspace", gen: genKeyspaceInfo},
+}
+
+// execInfo 处理 INFO [section ...]，不指定或指定 all/default/everything 时输出所有部分
+func execInfo(mdb *StandaloneDatabase, args [][]byte) resp.Reply {
+	all := len(args) == 0
+	wanted := make(map[string]bool)
+	for _, arg := range args {
+		name := strings.ToLower(string(arg))
+		if name == "all" || name == "default" || name == "everything" {
+			all = true
+		}
+		wanted[name] = true
+	}
+	builder := &strings.Builder{}
+	for _, section := range infoSections {
+		if !all && !wanted[section.name] {
+			continue
+		}
+		if builder.Len() > 0 {
+			builder.WriteString(reply.CRLF)
+		}
+		builder.WriteString("# " + section.title + reply.CRLF)
+		section.gen(mdb, builder)
+	}
+	// RESP3 中编码为 txt 格式的 verbatim string，RESP2 中仍然是 bulk string
+	return reply.MakeVerbatimReply("txt", []byte(builder.String()))
+}
+
+// writeInfoField 写入一行 key:value
+func writeInfoField(builder *strings.Builder, key string, value interface{}) {
+	builder.WriteString(fmt.Sprintf("%s:%v%s", key, value, reply.CRLF))
+}
+
+func genServerInfo(mdb *StandaloneDatabase, builder *strings.Builder) {
+	uptime := time.Since(serverStartTime)
+	writeInfoField(builder, "process_id", os.Getpid())
+	writeInfoField(builder, "run_id", serverRunId)
+	writeInfoField(builder, "tcp_port", config.Properties.Port)
+	writeInfoField(builder, "uptime_in_seconds", int64(uptime.Seconds()))
+	writeInfoField(builder, "uptime_in_days", int64(uptime.Hours()/24))
+}
+
+func genReplicationInfo(mdb *StandaloneDatabase, builder *strings.Builder) {
+	mdb.replLock.Lock()
+	slave := mdb.slave
+	mdb.replLock.Unlock()
+	if slave != nil {
+		slave.info(builder)
+	} else {
+		writeInfoField(builder, "role", "master")
+	}
+	mdb.master.info(builder)
+}
+
+func genKeyspaceInfo(mdb *StandaloneDatabase, builder *strings.Builder) {
+	for i, db := range mdb.dbSet {
+		keys, expires := 0, 0
+		db.ForEach(func(key string, entity *databaseface.DataEntity) bool {
+			keys++
+			if entity.ExpireTime > 0 {
+				expires++
+			}
+			return true
+		})
+		if keys > 0 {
+			writeInfoField(builder, fmt.Sprintf("db%d", i), fmt.Sprintf("keys=%d,expires=%d", keys, expires))
+		}
+	}
+}
@@ -1,12 +1,15 @@
 package database
 
 import (
+	"goredis/aof"
 	"goredis/datastruct/sortedset"
+	"goredis/interface/database"
 	"goredis/interface/resp"
 	"goredis/lib/utils"
 	"goredis/lib/wildcard"
 	"goredis/resp/reply"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -134,6 +137,90 @@ func execKeys(db *DB, args [][]byte) resp.Reply {
 	return reply.MakeMultiBulkReply(result)
 }
 
+// execDBSize 返回当前数据库中未过期的键的数量
+func execDBSize(db *DB, args [][]byte) resp.Reply {
+	count := 0
+	db.ForEach(func(key string, entity *database.DataEntity) bool {
+		count++
+		return true
+	})
+	return reply.MakeIntReply(int64(count))
+}
+
+// randomKeyTries RANDOMKEY 最多取样的次数，取到的键都已经过期时返回 nil
+const randomKeyTries = 100
+
+// execRandomKey 随机返回一个未过期的键，数据库为空时返回 nil
+// 从哈希表中取样，取到已经过期的键时删除后重新取样
+func execRandomKey(db *DB, args [][]byte) resp.Reply {
+	for i := 0; i < randomKeyTries; i++ {
+		keys := db.data.RandomKeys(1)
+		if len(keys) == 0 {
+			break
+		}
+		if _, ok := db.GetEntity(keys[0]); ok {
+			return reply.MakeBulkReply([]byte(keys[0]))
+		}
+	}
+	return reply.MakeNullBulkReply()
+}
+
+// execScan 增量遍历数据库中的键：SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+// 游标是哈希表的反向二进制游标，每次只访问大约 COUNT 个键，遍历期间一直存在的键一定会被返回
+// 遍历结束时返回的游标为 0
+func execScan(db *DB, args [][]byte) resp.Reply {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR invalid cursor")
+	}
+	count := 10
+	var pattern *wildcard.Pattern
+	typeName := ""
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return reply.MakeSyntaxErrReply()
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = wildcard.CompilePattern(string(args[i+1]))
+		case "count":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if count < 1 {
+				return reply.MakeSyntaxErrReply()
+			}
+		case "type":
+			typeName = strings.ToLower(string(args[i+1]))
+		default:
+			return reply.MakeSyntaxErrReply()
+		}
+	}
+
+	keys, next := db.data.Scan(cursor, count)
+	result := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		if pattern != nil && !pattern.IsMatch(key) {
+			continue
+		}
+		if _, ok := db.GetEntity(key); !ok {
+			// 已经过期
+			continue
+		}
+		if typeName != "" {
+			if status, ok := execType(db, [][]byte{[]byte(key)}).(*reply.StatusReply); !ok || status.Status != typeName {
+				continue
+			}
+		}
+		result = append(result, []byte(key))
+	}
+	return reply.MakeMultiRawReply([]resp.Reply{
+		reply.MakeBulkReply([]byte(strconv.FormatUint(next, 10))),
+		reply.MakeMultiBulkReply(result),
+	})
+}
+
 // execExpire 设置指定键的过期时间
 func execExpire(db *DB, args [][]byte) resp.Reply {
 	key := string(args[0])
@@ -162,8 +249,39 @@ func execExpire(db *DB, args [][]byte) resp.Reply {
 	// 将更新后的实体存入数据库
 	db.PutEntity(key, entity)
 
+	// 记录 AOF 操作日志，使用绝对时间避免重放时过期时间被延长
+	db.addAof(aof.MakeExpireCmd(key, expireTime))
+	return reply.MakeIntReply(1) // 返回 1，表示设置成功
+}
+
+// execPExpireAt 以 Unix 时间戳（毫秒）设置指定键的过期时间
+func execPExpireAt(db *DB, args [][]byte) resp.Reply {
+	key := string(args[0])
+
+	// 解析过期时间戳（毫秒）
+	expireTime, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+
+	// 获取实体
+	entity, exists := db.GetEntity(key)
+	if !exists {
+		return reply.MakeIntReply(0) // 键不存在，返回 0
+	}
+
+	if expireTime <= time.Now().UnixNano()/1e6 {
+		// 过期时间已经过去，直接删除该键
+		db.Remove(key)
+		db.addAof(utils.ToCmdLine("del", key))
+		return reply.MakeIntReply(1)
+	}
+
+	entity.ExpireTime = expireTime
+	db.PutEntity(key, entity)
+
 	// 记录 AOF 操作日志
-	db.addAof(utils.ToCmdLine2("expire", args...))
+	db.addAof(utils.ToCmdLine2("pexpireat", args...))
 	return reply.MakeIntReply(1) // 返回 1，表示设置成功
 }
 
@@ -196,15 +314,38 @@ func execTTL(db *DB, args [][]byte) resp.Reply {
 	return reply.MakeIntReply(remaining / 1000) // 转换为秒
 }
 
+// execPTTL 返回指定键以毫秒为单位的剩余过期时间
+func execPTTL(db *DB, args [][]byte) resp.Reply {
+	key := string(args[0])
+	entity, exists := db.GetEntity(key)
+	if !exists {
+		return reply.MakeIntReply(-2)
+	}
+	if entity.ExpireTime == 0 {
+		return reply.MakeIntReply(-1)
+	}
+	remaining := entity.ExpireTime - time.Now().UnixNano()/1e6
+	if remaining <= 0 {
+		db.Remove(key)
+		return reply.MakeIntReply(-2)
+	}
+	return reply.MakeIntReply(remaining)
+}
+
 func init() {
 	// 注册各个命令及其对应的执行函数
-	RegisterCommand("Del", execDel, -2)
-	RegisterCommand("Exists", execExists, -2)
-	RegisterCommand("Keys", execKeys, 2)
-	RegisterCommand("FlushDB", execFlushDB, -1)
-	RegisterCommand("Type", execType, 2)
-	RegisterCommand("Rename", execRename, 3)
-	RegisterCommand("RenameNx", execRenameNx, 3)
-	RegisterCommand("Expire", execExpire, 3)
-	RegisterCommand("TTL", execTTL, 2)
+	RegisterCommand("Del", execDel, -2, flagWrite, 1, -1, 1)
+	RegisterCommand("Exists", execExists, -2, flagReadOnly, 1, -1, 1)
+	RegisterCommand("Keys", execKeys, 2, flagReadOnly, 0, 0, 0)
+	RegisterCommand("FlushDB", execFlushDB, -1, flagWrite, 0, 0, 0)
+	RegisterCommand("DBSize", execDBSize, 1, flagReadOnly, 0, 0, 0)
+	RegisterCommand("RandomKey", execRandomKey, 1, flagReadOnly, 0, 0, 0)
+	RegisterCommand("Scan", execScan, -2, flagReadOnly, 0, 0, 0)
+	RegisterCommand("Type", execType, 2, flagReadOnly, 1, 1, 1)
+	RegisterCommand("Rename", execRename, 3, flagWrite, 1, 2, 1)
+	RegisterCommand("RenameNx", execRenameNx, 3, flagWrite, 1, 2, 1)
+	RegisterCommand("Expire", execExpire, 3, flagWrite, 1, 1, 1)
+	RegisterCommand("PExpireAt", execPExpireAt, 3, flagWrite, 1, 1, 1)
+	RegisterCommand("TTL", execTTL, 2, flagReadOnly, 1, 1, 1)
+	RegisterCommand("PTTL", execPTTL, 2, flagReadOnly, 1, 1, 1)
 }
@@ -0,0 +1,635 @@
+package database
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"goredis/aof"
+	"goredis/config"
+	databaseface "goredis/interface/database"
+	"goredis/interface/resp"
+	"goredis/lib/logger"
+	"goredis/lib/utils"
+	"goredis/resp/connection"
+	"goredis/resp/reply"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * 主库一侧的复制逻辑
+ * 所有写命令在写入 AOF 的同时追加到复制流（与 addAof 产生的 CmdLine 相同），写命令执行期间持有 DB 的键锁，
+ * 同一个键上的写命令进入复制流的顺序与执行顺序相同。
+ * 复制流保存在积压缓冲区中，并异步发送给每个从库。
+ * 从库通过 PSYNC <replid> <offset> 请求同步：偏移量仍在积压缓冲区中时只发送缺失的部分，否则发送全量快照。
+ * 节点作为从库时不产生自己的复制流，而是将主库的复制流原样追加到积压缓冲区，复制 ID 和偏移量与主库相同，
+ * 下级从库可以从它同步；提升为主库时旧的复制 ID 保存为 replid2，原来同一个主库的其他从库切换过来后仍然可以部分重同步。
+ * 从库定期通过 REPLCONF ACK 上报已经执行的偏移量，WAIT 和 min-replicas-to-write 依赖这些确认
+ */
+
+const (
+	defaultReplBacklogSize = 1 << 20          // 默认积压缓冲区大小 1MB
+	replPingPeriod         = 10 * time.Second // 主库向从库发送 PING 的间隔
+	replicaSendQueueSize   = 1 << 14          // 每个从库等待发送的复制流数据块数量上限
+)
+
+// replBacklog 复制积压缓冲区，是一个环形缓冲区，保存复制流最近的数据
+type replBacklog struct {
+	buf     []byte
+	idx     int // 下一个字节写入的位置
+	histLen int // 缓冲区中的有效数据长度
+}
+
+func makeReplBacklog(size int) *replBacklog {
+	if size <= 0 {
+		size = defaultReplBacklogSize
+	}
+	return &replBacklog{
+		buf: make([]byte, size),
+	}
+}
+
+// write 追加数据，超出容量时覆盖最旧的数据
+func (b *replBacklog) write(data []byte) {
+	size := len(b.buf)
+	if len(data) >= size {
+		copy(b.buf, data[len(data)-size:])
+		b.idx = 0
+		b.histLen = size
+		return
+	}
+	n := copy(b.buf[b.idx:], data)
+	if n < len(data) {
+		copy(b.buf, data[n:])
+	}
+	b.idx = (b.idx + len(data)) % size
+	b.histLen += len(data)
+	if b.histLen > size {
+		b.histLen = size
+	}
+}
+
+// tail 返回缓冲区中最后 n 个字节的副本
+func (b *replBacklog) tail(n int) []byte {
+	size := len(b.buf)
+	result := make([]byte, n)
+	start := (b.idx - n + size) % size
+	if start+n <= size {
+		copy(result, b.buf[start:start+n])
+	} else {
+		k := copy(result, b.buf[start:])
+		copy(result[k:], b.buf[:n-k])
+	}
+	return result
+}
+
+// replica 表示一个已经完成 PSYNC 的从库连接
+type replica struct {
+	conn          resp.Connection
+	ip            string
+	listeningPort int
+	online        bool                      // 快照或积压数据已经发送完毕
+	ackOffset     int64                     // 从库通过 REPLCONF ACK 确认的偏移量
+	ackTime       time.Time                 // 最近一次收到 ACK 的时间
+	sendCh        chan []byte               // 等待发送给从库的复制流
+	pending       atomic.Int64              // sendCh 中还没有发送的字节数
+	outLimiter    *connection.OutputLimiter // client-output-buffer-limit 中 replica 类的限制
+	done          chan struct{}             // 从库被移除时关闭
+	closeOnce     sync.Once
+}
+
+// sendLoop 将复制流按顺序写入从库连接
+func (r *replica) sendLoop(master *replMaster) {
+	for {
+		select {
+		case data := <-r.sendCh:
+			err := r.conn.Write(data)
+			r.pending.Add(-int64(len(data)))
+			if err != nil {
+				logger.Warn("replication: write to replica failed: " + err.Error())
+				master.removeReplica(r.conn)
+				return
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// close 关闭从库连接，从库会重新发起同步
+func (r *replica) close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		if closer, ok := r.conn.(io.Closer); ok {
+			// 关闭连接会等待正在进行的写入，异步执行避免阻塞复制流
+			go func() {
+				_ = closer.Close()
+			}()
+		}
+	})
+}
+
+// replMaster 记录主库的复制状态
+type replMaster struct {
+	mu             sync.Mutex
+	replId         string       // 复制 ID，标识一段连续的复制流
+	replId2        string       // 上一个复制 ID，提升为主库或者主库切换复制 ID 之前的 replId
+	secondOffset   int64        // replId2 有效的最后一个字节的下一个位置（从 1 开始计数，与 PSYNC 的参数相同），-1 表示没有 replId2
+	offset         int64        // master_repl_offset，复制流的总字节数
+	upstream       bool         // 当前节点是从库，复制流来自主库，本地的写命令不进入复制流
+	backlog        *replBacklog // 积压缓冲区
+	currentDB      int          // 复制流中当前选中的 DB，-1 表示下一条命令之前需要 SELECT
+	replicas       map[resp.Connection]*replica
+	listeningPorts sync.Map      // 已发送 REPLCONF listening-port 但还没有 PSYNC 的连接 -> 端口
+	ackSignal      chan struct{} // 收到 ACK 时关闭并替换，用于唤醒 WAIT
+	stopCh         chan struct{}
+	stopOnce       sync.Once
+}
+
+func makeReplMaster() *replMaster {
+	m := &replMaster{
+		replId:       makeReplId(),
+		secondOffset: -1,
+		backlog:      makeReplBacklog(config.Properties.ReplBacklogSize),
+		currentDB:    -1,
+		replicas:     make(map[resp.Connection]*replica),
+		ackSignal:    make(chan struct{}),
+		stopCh:       make(chan struct{}),
+	}
+	go m.pingLoop()
+	return m
+}
+
+// makeReplId 生成 40 个十六进制字符的随机复制 ID
+func makeReplId() string {
+	buf := make([]byte, 20)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// feed 将一条写命令追加到复制流
+func (m *replMaster) feed(dbIndex int, cmdLine CmdLine) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.upstream {
+		// 从库的复制流只能来自主库，可写从库上客户端的写命令不发送给下级从库，与 Redis 相同
+		return
+	}
+	var buf bytes.Buffer
+	if dbIndex != m.currentDB {
+		buf.Write(reply.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(dbIndex))).ToBytes())
+		m.currentDB = dbIndex
+	}
+	buf.Write(reply.MakeMultiBulkReply(cmdLine).ToBytes())
+	m.appendStream(buf.Bytes())
+}
+
+// proxy 从库将主库复制流中的一条命令原样追加到自己的复制流，dbIndex 是执行后复制流中选中的 DB
+func (m *replMaster) proxy(data []byte, dbIndex int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.appendStream(data)
+	m.currentDB = dbIndex
+}
+
+// follow 从库完成全量同步后使用主库的复制 ID 和偏移量，之前的复制流失效，断开所有下级从库
+func (m *replMaster) follow(replId string, offset int64, dbIndex int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.upstream = true
+	m.replId = replId
+	m.replId2 = ""
+	m.secondOffset = -1
+	m.offset = offset
+	m.backlog.idx = 0
+	m.backlog.histLen = 0
+	m.currentDB = dbIndex
+	m.disconnectReplicas()
+}
+
+// shiftReplId 开始一段新的复制流，旧的复制 ID 保存为 replId2，调用者需要持有 m.mu
+// 断开所有下级从库，它们重新 PSYNC 时通过 replId2 部分重同步并得到新的复制 ID
+func (m *replMaster) shiftReplId(replId string) {
+	m.replId2 = m.replId
+	m.secondOffset = m.offset + 1
+	m.replId = replId
+	m.disconnectReplicas()
+	logger.Info(fmt.Sprintf("replication: replication id set to %s, replid2 %s valid up to offset %d",
+		m.replId, m.replId2, m.secondOffset))
+}
+
+// switchUpstream 主库切换了复制 ID（例如它刚刚被提升为主库），从库跟随新的复制 ID
+func (m *replMaster) switchUpstream(replId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if replId != m.replId {
+		m.shiftReplId(replId)
+	}
+}
+
+// promote 从库提升为主库，使用新的复制 ID，之前的复制流仍然可以通过 replId2 继续
+func (m *replMaster) promote() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.upstream = false
+	m.shiftReplId(makeReplId())
+}
+
+// demote 成为从库，返回当前的复制 ID、偏移量和复制流中选中的 DB，从库用它们尝试部分重同步
+// 新的主库是原来的从库时，它保存了这段复制流的 replId2，不需要全量同步
+func (m *replMaster) demote() (replId string, offset int64, dbIndex int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.upstream = true
+	return m.replId, m.offset, m.currentDB
+}
+
+// disconnectReplicas 断开所有下级从库，调用者需要持有 m.mu
+func (m *replMaster) disconnectReplicas() {
+	for conn, r := range m.replicas {
+		delete(m.replicas, conn)
+		r.close()
+	}
+}
+
+// appendStream 写入积压缓冲区并发送给所有从库，调用者需要持有 m.mu
+func (m *replMaster) appendStream(data []byte) {
+	m.backlog.write(data)
+	m.offset += int64(len(data))
+	for conn, r := range m.replicas {
+		if r.outLimiter.Exceeded(r.pending.Add(int64(len(data)))) {
+			// 从库的输出缓冲区超过 client-output-buffer-limit 的 replica 限制，断开后由从库重新发起同步
+			logger.Warn("replication: replica output buffer limit reached, disconnecting")
+			delete(m.replicas, conn)
+			r.close()
+			continue
+		}
+		select {
+		case r.sendCh <- data:
+		default:
+			// 从库消费过慢，断开后由从库重新发起同步
+			logger.Warn("replication: replica send queue overflow, disconnecting")
+			delete(m.replicas, conn)
+			r.close()
+		}
+	}
+}
+
+// pingLoop 定期向从库发送 PING，让从库能够判断主库是否存活
+func (m *replMaster) pingLoop() {
+	ticker := time.NewTicker(replPingPeriod)
+	defer ticker.Stop()
+	pingBytes := reply.MakeMultiBulkReply(utils.ToCmdLine("PING")).ToBytes()
+	for {
+		select {
+		case <-ticker.C:
+			m.mu.Lock()
+			// 从库转发主库的 PING，不能自己插入数据，否则偏移量与主库不一致
+			if len(m.replicas) > 0 && !m.upstream {
+				m.appendStream(pingBytes)
+			}
+			m.mu.Unlock()
+		case <-m.stopCh:
+			return
+		}
+	}
+}
+
+// addReplica 注册从库并返回它，调用者需要持有 m.mu
+func (m *replMaster) addReplica(c resp.Connection) *replica {
+	if old, ok := m.replicas[c]; ok {
+		old.close()
+	}
+	r := &replica{
+		conn:       c,
+		ackTime:    time.Now(),
+		sendCh:     make(chan []byte, replicaSendQueueSize),
+		outLimiter: connection.MakeOutputLimiter(connection.ClassReplica),
+		done:       make(chan struct{}),
+	}
+	if addr, ok := c.(interface{ RemoteAddr() net.Addr }); ok {
+		if host, _, err := net.SplitHostPort(addr.RemoteAddr().String()); err == nil {
+			r.ip = host
+		}
+	}
+	if port, ok := m.listeningPorts.LoadAndDelete(c); ok {
+		r.listeningPort = port.(int)
+	}
+	m.replicas[c] = r
+	return r
+}
+
+// removeReplica 移除从库并关闭连接，连接不是从库时只清理握手信息
+func (m *replMaster) removeReplica(c resp.Connection) {
+	m.listeningPorts.Delete(c)
+	m.mu.Lock()
+	r, ok := m.replicas[c]
+	delete(m.replicas, c)
+	m.mu.Unlock()
+	if ok {
+		r.close()
+	}
+}
+
+// setOnline 标记从库已经完成同步
+func (m *replMaster) setOnline(r *replica) {
+	m.mu.Lock()
+	r.online = true
+	m.mu.Unlock()
+}
+
+// ack 记录从库通过 REPLCONF ACK 确认的偏移量，并唤醒等待中的 WAIT
+func (m *replMaster) ack(c resp.Connection, offset int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.replicas[c]
+	if !ok {
+		return
+	}
+	if offset > r.ackOffset {
+		r.ackOffset = offset
+	}
+	r.ackTime = time.Now()
+	close(m.ackSignal)
+	m.ackSignal = make(chan struct{})
+}
+
+// countAcked 返回确认偏移量不小于 offset 的从库数量，调用者需要持有 m.mu
+func (m *replMaster) countAcked(offset int64) int {
+	n := 0
+	for _, r := range m.replicas {
+		if r.online && r.ackOffset >= offset {
+			n++
+		}
+	}
+	return n
+}
+
+// goodReplicas 返回延迟不超过 min-replicas-max-lag 秒的从库数量
+func (m *replMaster) goodReplicas() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.countGood()
+}
+
+// countGood 统计延迟不超过 min-replicas-max-lag 秒的从库，调用者需要持有 m.mu
+func (m *replMaster) countGood() int {
+	// 与 Redis 相同，延迟按整秒计算
+	maxLag := time.Duration(config.Properties.MinReplicasMaxLag+1) * time.Second
+	n := 0
+	for _, r := range m.replicas {
+		if r.online && time.Since(r.ackTime) < maxLag {
+			n++
+		}
+	}
+	return n
+}
+
+// wait 等待至少 numReplicas 个从库确认当前的复制偏移量，timeout 为 0 时一直等待，返回已确认的从库数量
+func (m *replMaster) wait(numReplicas int, timeout time.Duration) int {
+	m.mu.Lock()
+	target := m.offset
+	acked := m.countAcked(target)
+	if acked >= numReplicas {
+		m.mu.Unlock()
+		return acked
+	}
+	// 要求从库立即回复 ACK，不必等待下一次定期确认
+	if !m.upstream {
+		m.appendStream(reply.MakeMultiBulkReply(utils.ToCmdLine("REPLCONF", "GETACK", "*")).ToBytes())
+	}
+	m.mu.Unlock()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for {
+		m.mu.Lock()
+		acked = m.countAcked(target)
+		signal := m.ackSignal
+		m.mu.Unlock()
+		if acked >= numReplicas {
+			return acked
+		}
+		select {
+		case <-signal:
+		case <-deadline:
+			return acked
+		case <-m.stopCh:
+			return acked
+		}
+	}
+}
+
+// tryPartialResync 尝试从积压缓冲区继续同步，psyncOffset 是从库期望的下一个字节（从 1 开始计数）
+// 从库的复制 ID 是 replId2 时，只有 secondOffset 之前的复制流是相同的
+func (m *replMaster) tryPartialResync(c resp.Connection, replId string, psyncOffset int64) bool {
+	m.mu.Lock()
+	if replId != m.replId && (replId != m.replId2 || psyncOffset > m.secondOffset) {
+		m.mu.Unlock()
+		return false
+	}
+	replId = m.replId
+	// 从库已经拥有的字节数
+	have := psyncOffset - 1
+	missing := m.offset - have
+	if missing < 0 || missing > int64(m.backlog.histLen) {
+		m.mu.Unlock()
+		return false
+	}
+	data := m.backlog.tail(int(missing))
+	r := m.addReplica(c)
+	m.mu.Unlock()
+
+	if err := c.Write([]byte("+CONTINUE " + replId + reply.CRLF)); err != nil {
+		m.removeReplica(c)
+		return true
+	}
+	if len(data) > 0 {
+		if err := c.Write(data); err != nil {
+			m.removeReplica(c)
+			return true
+		}
+	}
+	m.setOnline(r)
+	go r.sendLoop(m)
+	logger.Info(fmt.Sprintf("replication: partial resync accepted, sending %d bytes of backlog", len(data)))
+	return true
+}
+
+// fullResync 发送全量快照，之后的写命令通过复制流发送
+func (m *replMaster) fullResync(c resp.Connection, mdb *StandaloneDatabase) {
+	// 暂停所有命令的执行，保证快照与复制偏移量一致
+	mdb.execLock.Lock()
+	m.mu.Lock()
+	replId, offset := m.replId, m.offset
+	// 快照最后选中复制流当前的 DB，从库转发的复制流中不能插入 SELECT
+	snapshot := makeSnapshot(mdb, max(m.currentDB, 0))
+	r := m.addReplica(c)
+	m.mu.Unlock()
+	mdb.execLock.Unlock()
+
+	header := fmt.Sprintf("+FULLRESYNC %s %d\r\n$%d\r\n", replId, offset, len(snapshot))
+	if err := c.Write(append([]byte(header), snapshot...)); err != nil {
+		m.removeReplica(c)
+		return
+	}
+	m.setOnline(r)
+	go r.sendLoop(m)
+	logger.Info(fmt.Sprintf("replication: full resync with replica, snapshot %d bytes at offset %d", len(snapshot), offset))
+}
+
+// close 停止心跳并断开所有从库
+func (m *replMaster) close() {
+	m.stopOnce.Do(func() {
+		close(m.stopCh)
+	})
+	m.mu.Lock()
+	replicas := m.replicas
+	m.replicas = make(map[resp.Connection]*replica)
+	m.mu.Unlock()
+	for _, r := range replicas {
+		r.close()
+	}
+}
+
+// makeSnapshot 将所有 DB 的数据序列化为命令，格式与 AOF 文件相同，最后选中 streamDB，从库加载后从这个 DB 继续执行复制流
+func makeSnapshot(mdb *StandaloneDatabase, streamDB int) []byte {
+	var buf bytes.Buffer
+	for i := range mdb.dbSet {
+		selected := false
+		mdb.ForEach(i, func(key string, entity *databaseface.DataEntity) bool {
+			cmdLine := aof.EntityToCmd(key, entity)
+			if cmdLine == nil {
+				return true
+			}
+			if !selected {
+				buf.Write(reply.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(i))).ToBytes())
+				selected = true
+			}
+			buf.Write(reply.MakeMultiBulkReply(cmdLine).ToBytes())
+			if entity.ExpireTime > 0 {
+				buf.Write(reply.MakeMultiBulkReply(aof.MakeExpireCmd(key, entity.ExpireTime)).ToBytes())
+			}
+			return true
+		})
+	}
+	buf.Write(reply.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(streamDB))).ToBytes())
+	return buf.Bytes()
+}
+
+// info 输出 INFO replication 中主库部分的信息
+func (m *replMaster) info(builder *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writeInfoField(builder, "connected_slaves", len(m.replicas))
+	if config.Properties.MinReplicasToWrite > 0 {
+		writeInfoField(builder, "min_slaves_good_slaves", m.countGood())
+	}
+	i := 0
+	for _, r := range m.replicas {
+		state := "wait_bgsave"
+		if r.online {
+			state = "online"
+		}
+		writeInfoField(builder, fmt.Sprintf("slave%d", i), fmt.Sprintf("ip=%s,port=%d,state=%s,offset=%d,lag=%d",
+			r.ip, r.listeningPort, state, r.ackOffset, int64(time.Since(r.ackTime).Seconds())))
+		i++
+	}
+	writeInfoField(builder, "master_replid", m.replId)
+	writeInfoField(builder, "master_replid2", replId2Info(m.replId2))
+	writeInfoField(builder, "master_repl_offset", m.offset)
+	writeInfoField(builder, "second_repl_offset", m.secondOffset)
+	writeInfoField(builder, "repl_backlog_active", 1)
+	writeInfoField(builder, "repl_backlog_size", len(m.backlog.buf))
+	writeInfoField(builder, "repl_backlog_first_byte_offset", m.offset-int64(m.backlog.histLen)+1)
+	writeInfoField(builder, "repl_backlog_histlen", m.backlog.histLen)
+}
+
+// replId2Info 没有 replId2 时与 Redis 相同输出 40 个 0
+func replId2Info(replId2 string) string {
+	if replId2 == "" {
+		return strings.Repeat("0", 40)
+	}
+	return replId2
+}
+
+// execPSync 处理从库发送的 PSYNC <replid> <offset>
+func execPSync(mdb *StandaloneDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) != 2 {
+		return reply.MakeArgNumErrReply("psync")
+	}
+	replId := string(args[0])
+	psyncOffset, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if replId != "?" && mdb.master.tryPartialResync(c, replId, psyncOffset) {
+		return &reply.NoReply{}
+	}
+	mdb.master.fullResync(c, mdb)
+	return &reply.NoReply{}
+}
+
+// execReplConf 处理从库在握手阶段发送的 REPLCONF，以及同步完成后定期发送的 REPLCONF ACK
+func execReplConf(mdb *StandaloneDatabase, c resp.Connection, args [][]byte) resp.Reply {
+	if len(args)%2 != 0 {
+		return reply.MakeSyntaxErrReply()
+	}
+	if strings.ToLower(string(args[0])) == "ack" {
+		// ACK 不需要回复，否则回复会混入从库接收的复制流
+		offset, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err == nil {
+			mdb.master.ack(c, offset)
+		}
+		return &reply.NoReply{}
+	}
+	for i := 0; i < len(args); i += 2 {
+		option := string(bytes.ToLower(args[i]))
+		switch option {
+		case "listening-port":
+			port, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			mdb.master.listeningPorts.Store(c, port)
+		case "capa", "ip-address":
+			// 只支持 psync2，忽略其他能力声明
+		default:
+			return reply.MakeErrReply("ERR Unrecognized REPLCONF option: " + option)
+		}
+	}
+	return reply.MakeOkReply()
+}
+
+// execWait 处理 WAIT numreplicas timeout，阻塞直到足够多的从库确认之前的写命令或超时
+func execWait(mdb *StandaloneDatabase, args [][]byte) resp.Reply {
+	if len(args) != 2 {
+		return reply.MakeArgNumErrReply("wait")
+	}
+	numReplicas, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	timeout, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR timeout is not an integer or out of range")
+	}
+	if timeout < 0 {
+		return reply.MakeErrReply("ERR timeout is negative")
+	}
+	if mdb.IsReplica() {
+		return reply.MakeErrReply("ERR WAIT cannot be used with replica instances.")
+	}
+	acked := mdb.master.wait(numReplicas, time.Duration(timeout)*time.Millisecond)
+	return reply.MakeIntReply(int64(acked))
+}
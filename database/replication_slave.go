@@ -0,0 +1,450 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"goredis/aof"
+	"goredis/config"
+	"goredis/interface/resp"
+	"goredis/lib/logger"
+	"goredis/lib/utils"
+	"goredis/resp/connection"
+	"goredis/resp/reply"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * 从库一侧的复制逻辑
+ * REPLICAOF host port 启动同步协程：握手后发送 PSYNC，主库返回 FULLRESYNC 时加载快照，
+ * 返回 CONTINUE 时直接接收缺失的复制流，之后持续执行主库发来的命令。
+ * 连接断开后使用记录下来的复制 ID 和偏移量重连，短暂的断线只需要部分重同步。
+ * 主库降级为从库时使用自己的复制 ID 和偏移量发起 PSYNC，新的主库是原来的从库时可以通过 replid2 部分重同步。
+ * 执行的复制流原样转发到自己的复制流，下级从库和提升为主库之后都与原来的主库使用相同的偏移量。
+ * 同步完成后每秒通过 REPLCONF ACK 向主库上报偏移量，收到 REPLCONF GETACK 时立即上报
+ */
+
+const (
+	replDialTimeout = 5 * time.Second
+	replTimeout     = 60 * time.Second // 超过这个时间没有收到主库的数据视为连接断开
+	replRetryPeriod = time.Second
+	replAckPeriod   = time.Second // 向主库发送 REPLCONF ACK 的间隔
+)
+
+// 从库与主库之间的连接状态，与 INFO replication 中的 master_link_status 对应
+const (
+	replStateConnect    = "connect"
+	replStateConnecting = "connecting"
+	replStateSync       = "sync"
+	replStateConnected  = "connected"
+)
+
+// replSlave 记录从库的复制状态
+type replSlave struct {
+	mu         sync.Mutex
+	masterHost string
+	masterPort int
+	replId     string // 主库的复制 ID，"?" 表示需要全量同步
+	offset     int64  // 已经执行的复制流字节数，-1 表示未知
+	dbIndex    int    // 复制流中当前选中的 DB，部分重同步后需要延续
+	state      string
+	lastIO     time.Time // 最近一次收到主库数据的时间
+	conn       net.Conn
+	stopCh     chan struct{}
+	done       chan struct{} // 同步协程退出后关闭
+}
+
+func (s *replSlave) masterAddr() string {
+	return net.JoinHostPort(s.masterHost, strconv.Itoa(s.masterPort))
+}
+
+func (s *replSlave) setState(state string) {
+	s.mu.Lock()
+	s.state = state
+	s.mu.Unlock()
+}
+
+func (s *replSlave) stopped() bool {
+	select {
+	case <-s.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop 停止同步协程并等待它退出
+func (s *replSlave) stop() {
+	close(s.stopCh)
+	s.mu.Lock()
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+	s.mu.Unlock()
+	<-s.done
+}
+
+// IsReplica 当前节点是否是从库
+func (mdb *StandaloneDatabase) IsReplica() bool {
+	mdb.replLock.Lock()
+	defer mdb.replLock.Unlock()
+	return mdb.slave != nil
+}
+
+// ReplOffset 返回复制偏移量：从库返回已经执行的复制流偏移量，主库返回 master_repl_offset
+// 集群模式下用于在多个从库中选出数据最新的一个提升为主库
+func (mdb *StandaloneDatabase) ReplOffset() int64 {
+	mdb.replLock.Lock()
+	s := mdb.slave
+	mdb.replLock.Unlock()
+	if s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.offset
+	}
+	mdb.master.mu.Lock()
+	defer mdb.master.mu.Unlock()
+	return mdb.master.offset
+}
+
+// startReplication 成为 host:port 的从库，已经是它的从库时不做任何事
+func (mdb *StandaloneDatabase) startReplication(host string, port int) {
+	mdb.replLock.Lock()
+	defer mdb.replLock.Unlock()
+	if mdb.slave != nil {
+		if mdb.slave.masterHost == host && mdb.slave.masterPort == port {
+			return
+		}
+		mdb.slave.stop()
+	}
+	s := &replSlave{
+		masterHost: host,
+		masterPort: port,
+		replId:     "?",
+		offset:     -1,
+		state:      replStateConnect,
+		stopCh:     make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	// 复制流中选中的 DB 未知时（还没有任何写命令）无法继续，只能全量同步
+	if replId, offset, dbIndex := mdb.master.demote(); dbIndex >= 0 {
+		s.replId, s.offset, s.dbIndex = replId, offset, dbIndex
+	}
+	mdb.slave = s
+	go mdb.syncLoop(s)
+	logger.Info("replication: replica of " + s.masterAddr() + " enabled")
+}
+
+// stopReplication 断开与主库的连接，重新成为主库，已有的数据保留
+func (mdb *StandaloneDatabase) stopReplication() {
+	mdb.replLock.Lock()
+	defer mdb.replLock.Unlock()
+	if mdb.slave == nil {
+		return
+	}
+	mdb.slave.stop()
+	mdb.master.promote()
+	logger.Info("replication: master mode enabled, disconnected from " + mdb.slave.masterAddr())
+	mdb.slave = nil
+}
+
+// syncLoop 持续与主库保持同步，出错后稍后重试，直到 stop 被调用
+func (mdb *StandaloneDatabase) syncLoop(s *replSlave) {
+	defer close(s.done)
+	for {
+		err := mdb.syncWithMaster(s)
+		if s.stopped() {
+			return
+		}
+		s.setState(replStateConnect)
+		logger.Warn("replication: connection with master lost: " + err.Error())
+		select {
+		case <-s.stopCh:
+			return
+		case <-time.After(replRetryPeriod):
+		}
+	}
+}
+
+// syncWithMaster 连接主库、完成握手和同步，然后执行复制流直到连接断开
+func (mdb *StandaloneDatabase) syncWithMaster(s *replSlave) error {
+	s.setState(replStateConnecting)
+	conn, err := net.DialTimeout("tcp", s.masterAddr(), replDialTimeout)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+	defer conn.Close()
+	if s.stopped() {
+		return errors.New("replication stopped")
+	}
+	reader := bufio.NewReader(conn)
+
+	// 握手
+	_ = conn.SetDeadline(time.Now().Add(replTimeout))
+	if config.Properties.RequirePass != "" {
+		// 主库和从库使用相同的 requirepass
+		if _, err := sendReplCommand(conn, reader, "AUTH", config.Properties.RequirePass); err != nil {
+			return err
+		}
+	}
+	if _, err := sendReplCommand(conn, reader, "PING"); err != nil {
+		return err
+	}
+	port := strconv.Itoa(config.Properties.Port)
+	if _, err := sendReplCommand(conn, reader, "REPLCONF", "listening-port", port); err != nil {
+		return err
+	}
+	if _, err := sendReplCommand(conn, reader, "REPLCONF", "capa", "psync2"); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	replId, psyncOffset := s.replId, s.offset+1
+	if s.offset < 0 {
+		psyncOffset = -1
+	}
+	s.mu.Unlock()
+	s.setState(replStateSync)
+	line, err := sendReplCommand(conn, reader, "PSYNC", replId, strconv.FormatInt(psyncOffset, 10))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return errors.New("invalid FULLRESYNC reply: " + line)
+		}
+		dbIndex, err := mdb.loadSnapshotFromMaster(reader)
+		if err != nil {
+			return err
+		}
+		mdb.master.follow(fields[1], offset, dbIndex)
+		s.mu.Lock()
+		s.replId = fields[1]
+		s.offset = offset
+		s.dbIndex = dbIndex
+		s.mu.Unlock()
+		logger.Info(fmt.Sprintf("replication: full resync from master %s finished, replid %s offset %d",
+			s.masterAddr(), fields[1], offset))
+	case len(fields) >= 1 && fields[0] == "CONTINUE":
+		if len(fields) == 2 {
+			mdb.master.switchUpstream(fields[1])
+			s.mu.Lock()
+			s.replId = fields[1]
+			s.mu.Unlock()
+		}
+		logger.Info("replication: partial resync with master " + s.masterAddr() + " accepted")
+	default:
+		return errors.New("unexpected PSYNC reply: " + line)
+	}
+
+	s.setState(replStateConnected)
+	getAck := make(chan struct{}, 1)
+	streamDone := make(chan struct{})
+	defer close(streamDone)
+	go s.ackLoop(conn, getAck, streamDone)
+	return mdb.receiveStream(s, conn, reader, getAck)
+}
+
+// ackLoop 定期向主库发送 REPLCONF ACK，收到 getAck 信号时立即发送，直到 done 被关闭
+func (s *replSlave) ackLoop(conn net.Conn, getAck <-chan struct{}, done <-chan struct{}) {
+	ticker := time.NewTicker(replAckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-getAck:
+		case <-done:
+			return
+		}
+		s.mu.Lock()
+		offset := s.offset
+		s.mu.Unlock()
+		cmdLine := utils.ToCmdLine("REPLCONF", "ACK", strconv.FormatInt(offset, 10))
+		_ = conn.SetWriteDeadline(time.Now().Add(replTimeout))
+		if _, err := conn.Write(reply.MakeMultiBulkReply(cmdLine).ToBytes()); err != nil {
+			// 关闭连接让 receiveStream 返回，由 syncLoop 重连
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// sendReplCommand 发送一条命令并读取单行回复，错误回复转换为 error
+func sendReplCommand(conn net.Conn, reader *bufio.Reader, args ...string) (string, error) {
+	if _, err := conn.Write(reply.MakeMultiBulkReply(utils.ToCmdLine(args...)).ToBytes()); err != nil {
+		return "", err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return "", errors.New("empty reply from master")
+	}
+	if line[0] == '-' {
+		return "", errors.New("master replied to " + args[0] + ": " + line[1:])
+	}
+	return line[1:], nil
+}
+
+// loadSnapshotFromMaster 读取 $<len>\r\n<payload> 格式的快照，清空本地数据后加载
+// 返回快照最后选中的 DB，也就是之后的复制流中选中的 DB
+func (mdb *StandaloneDatabase) loadSnapshotFromMaster(reader *bufio.Reader) (int, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 3 || line[0] != '$' {
+		return 0, errors.New("invalid snapshot header: " + line)
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	if err != nil || size < 0 {
+		return 0, errors.New("invalid snapshot header: " + line)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, err
+	}
+
+	conn := &connection.FakeConn{}
+	for i := range mdb.dbSet {
+		mdb.dbSet[i].Exec(conn, utils.ToCmdLine("flushdb"))
+	}
+	cmdReader := aof.NewCmdReader(bytes.NewReader(payload))
+	for {
+		cmdLine, err := cmdReader.ReadCommand()
+		if err == io.EOF {
+			return conn.GetDBIndex(), nil
+		}
+		if err != nil {
+			return 0, errors.New("invalid snapshot from master: " + err.Error())
+		}
+		mdb.execReplicated(conn, cmdLine, nil)
+	}
+}
+
+// receiveStream 持续执行主库发送的复制流，并记录已执行的偏移量
+// 收到 REPLCONF GETACK 时通知 ackLoop 立即上报偏移量
+func (mdb *StandaloneDatabase) receiveStream(s *replSlave, conn net.Conn, reader *bufio.Reader, getAck chan<- struct{}) error {
+	s.mu.Lock()
+	baseOffset := s.offset
+	fakeConn := &connection.FakeConn{}
+	fakeConn.SelectDB(s.dbIndex)
+	s.mu.Unlock()
+
+	cmdReader := aof.NewCmdReader(reader)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(replTimeout))
+		cmdLine, err := cmdReader.ReadCommand()
+		if err != nil {
+			return err
+		}
+		if isGetAck(cmdLine) {
+			select {
+			case getAck <- struct{}{}:
+			default:
+			}
+		}
+		// 复制流中的命令都是 MakeMultiBulkReply 的编码，重新编码得到的字节与主库发送的相同
+		mdb.execReplicated(fakeConn, cmdLine, reply.MakeMultiBulkReply(cmdLine).ToBytes())
+		s.mu.Lock()
+		s.offset = baseOffset + cmdReader.Offset()
+		s.dbIndex = fakeConn.GetDBIndex()
+		s.lastIO = time.Now()
+		s.mu.Unlock()
+	}
+}
+
+// isGetAck 判断是否是主库发送的 REPLCONF GETACK
+func isGetAck(cmdLine CmdLine) bool {
+	return len(cmdLine) >= 2 &&
+		strings.ToLower(string(cmdLine[0])) == "replconf" &&
+		strings.ToLower(string(cmdLine[1])) == "getack"
+}
+
+// execReplicated 执行来自主库的命令，只读从库也需要执行写命令
+// raw 是命令在复制流中的字节，执行后原样追加到自己的复制流，加载快照时为空
+// 执行和追加在同一个 execLock 读锁中完成，下级从库全量同步时快照与复制偏移量一致
+func (mdb *StandaloneDatabase) execReplicated(c resp.Connection, cmdLine CmdLine, raw []byte) {
+	mdb.execLock.RLock()
+	defer mdb.execLock.RUnlock()
+	if raw != nil {
+		defer func() {
+			mdb.master.proxy(raw, c.GetDBIndex())
+		}()
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Error(fmt.Sprintf("replication: exec panic: %v", err))
+		}
+	}()
+	switch strings.ToLower(string(cmdLine[0])) {
+	case "ping", "replconf":
+		return // 主库的心跳和 GETACK，只需要计入偏移量
+	}
+	ret := mdb.execCommandLocked(c, cmdLine)
+	if reply.IsErrorReply(ret) {
+		logger.Error("replication: exec err", string(ret.ToBytes()))
+	}
+}
+
+// info 输出 INFO replication 中从库部分的信息
+func (s *replSlave) info(builder *strings.Builder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	linkStatus := "down"
+	if s.state == replStateConnected {
+		linkStatus = "up"
+	}
+	lastIO := int64(-1)
+	if !s.lastIO.IsZero() {
+		lastIO = int64(time.Since(s.lastIO).Seconds())
+	}
+	syncInProgress := 0
+	if s.state == replStateSync {
+		syncInProgress = 1
+	}
+	readOnly := 0
+	if config.Properties.ReplicaReadOnly {
+		readOnly = 1
+	}
+	writeInfoField(builder, "role", "slave")
+	writeInfoField(builder, "master_host", s.masterHost)
+	writeInfoField(builder, "master_port", s.masterPort)
+	writeInfoField(builder, "master_link_status", linkStatus)
+	writeInfoField(builder, "master_last_io_seconds_ago", lastIO)
+	writeInfoField(builder, "master_sync_in_progress", syncInProgress)
+	writeInfoField(builder, "slave_repl_offset", s.offset)
+	writeInfoField(builder, "slave_read_only", readOnly)
+}
+
+// execReplicaOf 处理 REPLICAOF host port 和 REPLICAOF NO ONE
+func execReplicaOf(mdb *StandaloneDatabase, args [][]byte) resp.Reply {
+	if len(args) != 2 {
+		return reply.MakeArgNumErrReply("replicaof")
+	}
+	host := string(args[0])
+	if strings.ToLower(host) == "no" && strings.ToLower(string(args[1])) == "one" {
+		mdb.stopReplication()
+		return reply.MakeOkReply()
+	}
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil || port <= 0 || port > 65535 {
+		return reply.MakeErrReply("ERR Invalid master port")
+	}
+	mdb.startReplication(host, port)
+	return reply.MakeOkReply()
+}
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"goredis/interface/database"
+	"goredis/lib/utils"
+	"goredis/resp/connection"
+	"goredis/resp/parser"
+	"goredis/resp/reply"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// serveForTest 在随机端口上为 mdb 提供服务，返回端口
+func serveForTest(t *testing.T, mdb *StandaloneDatabase) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				client := connection.NewConn(conn)
+				defer func() {
+					_ = client.Close()
+					mdb.AfterClientClose(client)
+				}()
+				for payload := range parser.ParseStream(conn) {
+					if payload.Err != nil {
+						return
+					}
+					r, ok := payload.Data.(*reply.MultiBulkReply)
+					if !ok {
+						continue
+					}
+					if err := client.Write(mdb.Exec(client, r.Args).ToBytes()); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// execForTest 执行一条命令，返回回复的编码
+func execForTest(mdb *StandaloneDatabase, args ...string) string {
+	return string(mdb.Exec(&connection.FakeConn{}, utils.ToCmdLine(args...)).ToBytes())
+}
+
+// waitForValue 等待 key 的值变为 value
+func waitForValue(t *testing.T, mdb *StandaloneDatabase, key, value string) {
+	expect := string(reply.MakeBulkReply([]byte(value)).ToBytes())
+	deadline := time.Now().Add(5 * time.Second)
+	for execForTest(mdb, "GET", key) != expect {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is %q, expect %q", key, execForTest(mdb, "GET", key), expect)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// replOffsetForTest 返回复制流的偏移量
+func replOffsetForTest(mdb *StandaloneDatabase) int64 {
+	mdb.master.mu.Lock()
+	defer mdb.master.mu.Unlock()
+	return mdb.master.offset
+}
+
+// putMarker 绕过复制直接写入一个键，全量同步会清空它，部分重同步不会
+func putMarker(mdb *StandaloneDatabase) {
+	mdb.dbSet[0].PutEntity("marker", &database.DataEntity{Data: []byte("1")})
+}
+
+func hasMarker(mdb *StandaloneDatabase) bool {
+	_, ok := mdb.dbSet[0].GetEntity("marker")
+	return ok
+}
+
+// TestReplicationResync 全量同步之后断线重连通过积压缓冲区部分重同步，
+// 从库提升为主库后原来的主库成为它的从库，通过 replid2 部分重同步
+func TestReplicationResync(t *testing.T) {
+	master := NewStandaloneDatabase()
+	defer master.Close()
+	replica := NewStandaloneDatabase()
+	defer replica.Close()
+	masterPort := serveForTest(t, master)
+	replicaPort := serveForTest(t, replica)
+
+	// 全量同步
+	execForTest(master, "SET", "k1", "v1")
+	putMarker(replica)
+	execForTest(replica, "REPLICAOF", "127.0.0.1", strconv.Itoa(masterPort))
+	waitForValue(t, replica, "k1", "v1")
+	if hasMarker(replica) {
+		t.Fatal("full resync should flush the replica")
+	}
+
+	// 断开从库，期间的写命令只进入积压缓冲区，从库重连后部分重同步
+	putMarker(replica)
+	master.master.mu.Lock()
+	master.master.disconnectReplicas()
+	master.master.mu.Unlock()
+	execForTest(master, "SET", "k2", "v2")
+	waitForValue(t, replica, "k2", "v2")
+	if !hasMarker(replica) {
+		t.Fatal("expect partial resync from backlog, got full resync")
+	}
+
+	// 从库提升为主库，原来的主库使用旧的复制 ID 同步
+	deadline := time.Now().Add(5 * time.Second)
+	for replOffsetForTest(replica) != replOffsetForTest(master) {
+		if time.Now().After(deadline) {
+			t.Fatalf("replica offset %d, master offset %d", replOffsetForTest(replica), replOffsetForTest(master))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	execForTest(replica, "REPLICAOF", "NO", "ONE")
+	execForTest(replica, "SET", "k3", "v3")
+	putMarker(master)
+	execForTest(master, "REPLICAOF", "127.0.0.1", strconv.Itoa(replicaPort))
+	waitForValue(t, master, "k3", "v3")
+	if !hasMarker(master) {
+		t.Fatal("expect partial resync with replid2, got full resync")
+	}
+	replica.master.mu.Lock()
+	newReplId := replica.master.replId
+	replica.master.mu.Unlock()
+	master.master.mu.Lock()
+	defer master.master.mu.Unlock()
+	if master.master.replId != newReplId {
+		t.Errorf("expect demoted master to follow replid %s, got %s", newReplId, master.master.replId)
+	}
+}
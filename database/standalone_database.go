@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"goredis/aof"
 	"goredis/config"
+	databaseface "goredis/interface/database"
 	"goredis/interface/resp"
 	"goredis/lib/logger"
 	"goredis/resp/reply"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // StandaloneDatabase 表示单机版 Redis 数据库
@@ -17,39 +19,65 @@ import (
 type StandaloneDatabase struct {
 	dbSet      []*DB           // 数据库集合，存储多个数据库实例
 	aofHandler *aof.AofHandler // AOF 持久化处理器
+
+	execLock sync.RWMutex // 普通命令持有读锁，需要一致快照（如全量复制）时持有写锁
+	master   *replMaster  // 主库复制状态，所有写命令都会进入复制流
+	replLock sync.Mutex   // 保护 slave
+	slave    *replSlave   // 作为从库时的复制状态，为空表示当前是主库
 }
 
 // NewStandaloneDatabase 创建一个新的 StandaloneDatabase 实例
 func NewStandaloneDatabase() *StandaloneDatabase {
-	// 初始化 StandaloneDatabase 实例
-	mdb := &StandaloneDatabase{}
-	// 如果配置文件中的数据库数量为 0，设置默认值为 16
-	if config.Properties.Databases == 0 {
-		config.Properties.Databases = 16
-	}
-	// 根据配置的数据库数量，创建多个数据库实例
-	mdb.dbSet = make([]*DB, config.Properties.Databases)
-	for i := range mdb.dbSet {
-		singleDB := makeDB()    // 创建单个数据库实例
-		singleDB.index = i      // 设置数据库的索引
-		mdb.dbSet[i] = singleDB // 将数据库实例添加到数据库集合中
-	}
+	mdb := makeStandaloneDatabase()
 	// 如果配置了 AOF 持久化，初始化 AOF 处理器
 	if config.Properties.AppendOnly {
-		aofHandler, err := aof.NewAOFHandler(mdb) // 创建 AOF 处理器
+		aofHandler, err := aof.NewAOFHandler(mdb, func() databaseface.DBEngine {
+			// 重写 AOF 时使用的临时数据库，不开启持久化
+			return makeStandaloneDatabase()
+		}) // 创建 AOF 处理器
 		if err != nil {
 			panic(err) // 如果 AOF 处理器创建失败，触发 panic
 		}
 		mdb.aofHandler = aofHandler
-		// 为每个数据库实例设置 AOF 写入方法
-		for _, db := range mdb.dbSet {
-			// 避免闭包捕获
-			singleDB := db
-			singleDB.addAof = func(line CmdLine) {
+	}
+	mdb.master = makeReplMaster()
+	// 为每个数据库实例设置写命令的回调：写入 AOF 并追加到复制流
+	for _, db := range mdb.dbSet {
+		// 避免闭包捕获
+		singleDB := db
+		singleDB.addAof = func(line CmdLine) {
+			if mdb.aofHandler != nil {
 				// 将 AOF 命令行写入 AOF 文件
 				mdb.aofHandler.AddAof(singleDB.index, line)
 			}
+			mdb.master.feed(singleDB.index, line)
+		}
+	}
+	// 配置了 replicaof 时启动后立即开始同步
+	if config.Properties.ReplicaOf != "" {
+		fields := strings.Fields(config.Properties.ReplicaOf)
+		port := 0
+		if len(fields) == 2 {
+			port, _ = strconv.Atoi(fields[1])
+		}
+		if port <= 0 {
+			panic("invalid replicaof config: " + config.Properties.ReplicaOf)
 		}
+		mdb.startReplication(fields[0], port)
+	}
+	return mdb
+}
+
+// makeStandaloneDatabase 创建只存在于内存中的数据库实例
+func makeStandaloneDatabase() *StandaloneDatabase {
+	// 初始化 StandaloneDatabase 实例
+	mdb := &StandaloneDatabase{}
+	// 根据配置的数据库数量，创建多个数据库实例
+	mdb.dbSet = make([]*DB, config.Properties.Databases)
+	for i := range mdb.dbSet {
+		singleDB := makeDB()    // 创建单个数据库实例
+		singleDB.index = i      // 设置数据库的索引
+		mdb.dbSet[i] = singleDB // 将数据库实例添加到数据库集合中
 	}
 	return mdb
 }
@@ -67,6 +95,47 @@ func (mdb *StandaloneDatabase) Exec(c resp.Connection, cmdLine [][]byte) (result
 	}()
 
 	// 获取命令名称，转换为小写
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	if cmdName == "bgrewriteaof" {
+		// 在后台重写 AOF 文件
+		return execBGRewriteAof(mdb)
+	}
+	// 复制相关的命令，不能持有 execLock，全量同步时需要暂停其他命令
+	switch cmdName {
+	case "replicaof", "slaveof":
+		return execReplicaOf(mdb, cmdLine[1:])
+	case "psync":
+		return execPSync(mdb, c, cmdLine[1:])
+	case "replconf":
+		return execReplConf(mdb, c, cmdLine[1:])
+	case "wait":
+		return execWait(mdb, cmdLine[1:])
+	case "info":
+		return execInfo(mdb, cmdLine[1:])
+	case "flushall":
+		if errReply := mdb.checkWritable(); errReply != nil {
+			return errReply
+		}
+		return execFlushAll(mdb, cmdLine[1:])
+	}
+	// 只读从库拒绝客户端的写命令，主库在健康的从库不足时拒绝写命令
+	if isWriteCommand(cmdName) {
+		if errReply := mdb.checkWritable(); errReply != nil {
+			return errReply
+		}
+	}
+	return mdb.execCommand(c, cmdLine)
+}
+
+// execCommand 在客户端选中的 DB 中执行命令，不做读写权限检查
+func (mdb *StandaloneDatabase) execCommand(c resp.Connection, cmdLine [][]byte) resp.Reply {
+	mdb.execLock.RLock()
+	defer mdb.execLock.RUnlock()
+	return mdb.execCommandLocked(c, cmdLine)
+}
+
+// execCommandLocked 与 execCommand 相同，从库执行复制流时也使用它，调用者需要持有 execLock 的读锁
+func (mdb *StandaloneDatabase) execCommandLocked(c resp.Connection, cmdLine [][]byte) resp.Reply {
 	cmdName := strings.ToLower(string(cmdLine[0]))
 	if cmdName == "select" {
 		// 处理 select 命令
@@ -89,14 +158,48 @@ func (mdb *StandaloneDatabase) Exec(c resp.Connection, cmdLine [][]byte) (result
 	return selectedDB.Exec(c, cmdLine)
 }
 
+// checkWritable 检查当前是否允许执行写命令，不允许时返回错误回复
+func (mdb *StandaloneDatabase) checkWritable() resp.Reply {
+	if mdb.IsReplica() {
+		if config.Properties.ReplicaReadOnly {
+			return reply.MakeErrReply("READONLY You can't write against a read only replica.")
+		}
+		return nil
+	}
+	minReplicas := config.Properties.MinReplicasToWrite
+	if minReplicas > 0 && mdb.master.goodReplicas() < minReplicas {
+		return reply.MakeErrReply("NOREPLICAS Not enough good replicas to write.")
+	}
+	return nil
+}
+
 // Close 关闭 StandaloneDatabase 实例，进行资源清理
 func (mdb *StandaloneDatabase) Close() {
-	// 关闭操作可以在这里进行（此示例没有具体实现）
+	// 停止复制
+	if mdb.master != nil {
+		mdb.stopReplication()
+		mdb.master.close()
+	}
+	// 将缓冲区中的 AOF 命令写入文件并关闭
+	if mdb.aofHandler != nil {
+		mdb.aofHandler.Close()
+	}
+}
+
+// ForEach 遍历指定 DB 中所有未过期的键
+func (mdb *StandaloneDatabase) ForEach(dbIndex int, cb func(key string, entity *databaseface.DataEntity) bool) {
+	if dbIndex < 0 || dbIndex >= len(mdb.dbSet) {
+		return
+	}
+	mdb.dbSet[dbIndex].ForEach(cb)
 }
 
 // AfterClientClose 客户端连接关闭后的回调函数
 func (mdb *StandaloneDatabase) AfterClientClose(c resp.Connection) {
-	// 客户端关闭后的操作（此示例没有具体实现）
+	// 如果关闭的是从库连接，将其从复制列表中移除
+	if mdb.master != nil {
+		mdb.master.removeReplica(c)
+	}
 }
 
 // execSelect 处理 select 命令，选择数据库
@@ -117,3 +220,29 @@ func execSelect(c resp.Connection, mdb *StandaloneDatabase, args [][]byte) resp.
 	// 返回成功回复
 	return reply.MakeOkReply()
 }
+
+// execFlushAll 清空所有数据库，每个数据库分别记录一条 FLUSHDB，AOF 重放和复制时按数据库执行
+func execFlushAll(mdb *StandaloneDatabase, args [][]byte) resp.Reply {
+	if len(args) > 1 {
+		return reply.MakeArgNumErrReply("flushall")
+	}
+	mdb.execLock.RLock()
+	defer mdb.execLock.RUnlock()
+	for _, db := range mdb.dbSet {
+		db.lockWrite(nil)
+		execFlushDB(db, nil)
+		db.unlockWrite(nil)
+	}
+	return reply.MakeOkReply()
+}
+
+// execBGRewriteAof 处理 bgrewriteaof 命令，在后台重写 AOF 文件
+func execBGRewriteAof(mdb *StandaloneDatabase) resp.Reply {
+	if mdb.aofHandler == nil {
+		return reply.MakeErrReply("ERR append only file is not enabled")
+	}
+	if err := mdb.aofHandler.StartRewrite(); err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+	return reply.MakeStatusReply("Background append only file rewriting started")
+}
@@ -564,19 +564,19 @@ func execGetRange(db *DB, args [][]byte) resp.Reply {
 }
 
 func init() {
-	RegisterCommand("Set", execSet, -3)
-	RegisterCommand("SetNx", execSetNX, 3)
-	RegisterCommand("MSet", execMSet, -3)
-	RegisterCommand("MGet", execMGet, -2)
-	RegisterCommand("MSetNX", execMSetNX, -3)
-	RegisterCommand("Get", execGet, 2)
-	RegisterCommand("GetSet", execGetSet, 3)
-	RegisterCommand("Incr", execIncr, 2)
-	RegisterCommand("IncrBy", execIncrBy, 3)
-	RegisterCommand("Decr", execDecr, 2)
-	RegisterCommand("DecrBy", execDecrBy, 3)
-	RegisterCommand("StrLen", execStrLen, 2)
-	RegisterCommand("Append", execAppend, 3)
-	RegisterCommand("SetRange", execSetRange, 4)
-	RegisterCommand("GetRange", execGetRange, 4)
+	RegisterCommand("Set", execSet, -3, flagWrite, 1, 1, 1)
+	RegisterCommand("SetNx", execSetNX, 3, flagWrite, 1, 1, 1)
+	RegisterCommand("MSet", execMSet, -3, flagWrite, 1, -1, 2)
+	RegisterCommand("MGet", execMGet, -2, flagReadOnly, 1, -1, 1)
+	RegisterCommand("MSetNX", execMSetNX, -3, flagWrite, 1, -1, 2)
+	RegisterCommand("Get", execGet, 2, flagReadOnly, 1, 1, 1)
+	RegisterCommand("GetSet", execGetSet, 3, flagWrite, 1, 1, 1)
+	RegisterCommand("Incr", execIncr, 2, flagWrite, 1, 1, 1)
+	RegisterCommand("IncrBy", execIncrBy, 3, flagWrite, 1, 1, 1)
+	RegisterCommand("Decr", execDecr, 2, flagWrite, 1, 1, 1)
+	RegisterCommand("DecrBy", execDecrBy, 3, flagWrite, 1, 1, 1)
+	RegisterCommand("StrLen", execStrLen, 2, flagReadOnly, 1, 1, 1)
+	RegisterCommand("Append", execAppend, 3, flagWrite, 1, 1, 1)
+	RegisterCommand("SetRange", execSetRange, 4, flagWrite, 1, 1, 1)
+	RegisterCommand("GetRange", execGetRange, 4, flagReadOnly, 1, 1, 1)
 }
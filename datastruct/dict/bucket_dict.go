@@ -0,0 +1,300 @@
+package dict
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ * BucketDict 使用链地址法的哈希表，与 Redis 的 dict 相同，桶的数量是 2 的幂
+ * sync.Map 只能从头遍历，BucketDict 可以从任意一个桶继续遍历，SCAN 每次只访问 COUNT 个左右的键，
+ * RANDOMKEY 随机选择一个桶取样，不需要遍历所有的键
+ *
+ * 遍历使用反向二进制游标：游标的二进制位从高位开始加一，哈希表扩容或者缩容后，
+ * 扩容前已经访问过的桶拆分出的桶在新表中也已经访问过，因此遍历期间一直存在的键一定会被返回；
+ * 扩容不会重复返回键，缩容可能重复返回，ForEach 进行期间不缩容
+ */
+
+const (
+	// minBuckets 桶的最小数量
+	minBuckets = 16
+	// shrinkRatio 键的数量少于桶数量的 1/shrinkRatio 时缩容
+	shrinkRatio = 8
+	// scanEmptyVisits Scan 每需要返回一个键最多访问的空桶数量，与 Redis 的 SCAN 相同，避免稀疏的表一次访问过多的桶
+	scanEmptyVisits = 10
+	// forEachBatch ForEach 每次在持有锁时复制的键的数量
+	forEachBatch = 64
+)
+
+type entry struct {
+	key  string
+	val  interface{}
+	next *entry
+}
+
+// BucketDict 线程安全的哈希表，支持按游标增量遍历
+type BucketDict struct {
+	mu        sync.RWMutex
+	buckets   []*entry
+	count     int
+	seed      maphash.Seed
+	iterating atomic.Int32 // 正在进行的 ForEach 数量，不为 0 时不缩容
+}
+
+// MakeBucketDict 创建一个新的 BucketDict 实例
+func MakeBucketDict() *BucketDict {
+	return &BucketDict{
+		buckets: make([]*entry, minBuckets),
+		seed:    maphash.MakeSeed(),
+	}
+}
+
+// bucketIndex 返回键所在的桶，调用者需要持有锁
+func (dict *BucketDict) bucketIndex(key string) uint64 {
+	return maphash.String(dict.seed, key) & uint64(len(dict.buckets)-1)
+}
+
+// find 查找键，调用者需要持有锁
+func (dict *BucketDict) find(key string) *entry {
+	for e := dict.buckets[dict.bucketIndex(key)]; e != nil; e = e.next {
+		if e.key == key {
+			return e
+		}
+	}
+	return nil
+}
+
+// insert 插入一个不存在的键，键的数量超过桶的数量时扩容为两倍，调用者需要持有写锁
+func (dict *BucketDict) insert(key string, val interface{}) {
+	if dict.count >= len(dict.buckets) {
+		dict.resize(len(dict.buckets) * 2)
+	}
+	index := dict.bucketIndex(key)
+	dict.buckets[index] = &entry{key: key, val: val, next: dict.buckets[index]}
+	dict.count++
+}
+
+// resize 将所有的键重新分配到 size 个桶中，调用者需要持有写锁
+func (dict *BucketDict) resize(size int) {
+	old := dict.buckets
+	dict.buckets = make([]*entry, size)
+	for _, e := range old {
+		for e != nil {
+			next := e.next
+			index := dict.bucketIndex(e.key)
+			e.next = dict.buckets[index]
+			dict.buckets[index] = e
+			e = next
+		}
+	}
+}
+
+// Get 根据键获取对应的值，返回值和是否存在的标志
+func (dict *BucketDict) Get(key string) (val interface{}, exists bool) {
+	dict.mu.RLock()
+	defer dict.mu.RUnlock()
+	if e := dict.find(key); e != nil {
+		return e.val, true
+	}
+	return nil, false
+}
+
+// Len 获取字典中键值对的数量
+func (dict *BucketDict) Len() int {
+	dict.mu.RLock()
+	defer dict.mu.RUnlock()
+	return dict.count
+}
+
+// Put 插入或者更新键值对，新插入时返回 1
+func (dict *BucketDict) Put(key string, val interface{}) (result int) {
+	dict.mu.Lock()
+	defer dict.mu.Unlock()
+	if e := dict.find(key); e != nil {
+		e.val = val
+		return 0
+	}
+	dict.insert(key, val)
+	return 1
+}
+
+// PutIfAbsent 只有当键不存在时才插入键值对
+func (dict *BucketDict) PutIfAbsent(key string, val interface{}) (result int) {
+	dict.mu.Lock()
+	defer dict.mu.Unlock()
+	if dict.find(key) != nil {
+		return 0
+	}
+	dict.insert(key, val)
+	return 1
+}
+
+// PutIfExists 只有当键已存在时才更新值
+func (dict *BucketDict) PutIfExists(key string, val interface{}) (result int) {
+	dict.mu.Lock()
+	defer dict.mu.Unlock()
+	if e := dict.find(key); e != nil {
+		e.val = val
+		return 1
+	}
+	return 0
+}
+
+// Remove 从字典中移除指定的键，键的数量过少时缩容
+func (dict *BucketDict) Remove(key string) (result int) {
+	dict.mu.Lock()
+	defer dict.mu.Unlock()
+	index := dict.bucketIndex(key)
+	for p := &dict.buckets[index]; *p != nil; p = &(*p).next {
+		if (*p).key != key {
+			continue
+		}
+		*p = (*p).next
+		dict.count--
+		if len(dict.buckets) > minBuckets && dict.count*shrinkRatio < len(dict.buckets) && dict.iterating.Load() == 0 {
+			dict.resize(max(minBuckets, 1<<bits.Len(uint(dict.count))))
+		}
+		return 1
+	}
+	return 0
+}
+
+// Keys 获取字典中所有键的列表
+func (dict *BucketDict) Keys() []string {
+	dict.mu.RLock()
+	defer dict.mu.RUnlock()
+	result := make([]string, 0, dict.count)
+	for _, e := range dict.buckets {
+		for ; e != nil; e = e.next {
+			result = append(result, e.key)
+		}
+	}
+	return result
+}
+
+// ForEach 遍历字典中的所有键值对，consumer 返回 false 时停止
+// 每次在持有锁时复制一批键值对，调用 consumer 时不持有锁，consumer 可以修改字典
+func (dict *BucketDict) ForEach(consumer Consumer) {
+	dict.iterating.Add(1)
+	defer dict.iterating.Add(-1)
+	type pair struct {
+		key string
+		val interface{}
+	}
+	batch := make([]pair, 0, forEachBatch)
+	cursor := uint64(0)
+	for {
+		batch = batch[:0]
+		dict.mu.RLock()
+		for len(batch) < forEachBatch {
+			for e := dict.buckets[cursor&uint64(len(dict.buckets)-1)]; e != nil; e = e.next {
+				batch = append(batch, pair{key: e.key, val: e.val})
+			}
+			cursor = nextCursor(cursor, len(dict.buckets))
+			if cursor == 0 {
+				break
+			}
+		}
+		dict.mu.RUnlock()
+		for _, p := range batch {
+			if !consumer(p.key, p.val) {
+				return
+			}
+		}
+		if cursor == 0 {
+			return
+		}
+	}
+}
+
+// Scan 从游标 cursor 开始返回大约 count 个键和下一次遍历的游标，游标为 0 表示遍历结束
+// 第一次遍历时 cursor 为 0；游标不依赖于桶的数量，两次调用之间哈希表扩容或者缩容后仍然有效
+func (dict *BucketDict) Scan(cursor uint64, count int) ([]string, uint64) {
+	dict.mu.RLock()
+	defer dict.mu.RUnlock()
+	keys := make([]string, 0, min(count, dict.count))
+	visits := min(count, len(dict.buckets)) * scanEmptyVisits
+	for {
+		for e := dict.buckets[cursor&uint64(len(dict.buckets)-1)]; e != nil; e = e.next {
+			keys = append(keys, e.key)
+		}
+		cursor = nextCursor(cursor, len(dict.buckets))
+		visits--
+		if cursor == 0 || len(keys) >= count || visits <= 0 {
+			return keys, cursor
+		}
+	}
+}
+
+// nextCursor 反向二进制游标加一：先将游标中桶下标以外的位置为 1，反转后加一再反转回来
+func nextCursor(cursor uint64, size int) uint64 {
+	cursor |= ^uint64(size - 1)
+	return bits.Reverse64(bits.Reverse64(cursor) + 1)
+}
+
+// randomKey 随机选择一个非空的桶，再从桶中随机选择一个键，调用者需要持有锁并且字典不为空
+func (dict *BucketDict) randomKey() string {
+	var head *entry
+	for head == nil {
+		head = dict.buckets[rand.Intn(len(dict.buckets))]
+	}
+	length := 0
+	for e := head; e != nil; e = e.next {
+		length++
+	}
+	e := head
+	for i := rand.Intn(length); i > 0; i-- {
+		e = e.next
+	}
+	return e.key
+}
+
+// RandomKeys 随机选择 limit 个键，可能重复，字典为空时返回空列表
+func (dict *BucketDict) RandomKeys(limit int) []string {
+	dict.mu.RLock()
+	defer dict.mu.RUnlock()
+	if dict.count == 0 {
+		return nil
+	}
+	result := make([]string, limit)
+	for i := range result {
+		result[i] = dict.randomKey()
+	}
+	return result
+}
+
+// RandomDistinctKeys 随机选择最多 limit 个不同的键
+func (dict *BucketDict) RandomDistinctKeys(limit int) []string {
+	dict.mu.RLock()
+	defer dict.mu.RUnlock()
+	if limit >= dict.count {
+		result := make([]string, 0, dict.count)
+		for _, e := range dict.buckets {
+			for ; e != nil; e = e.next {
+				result = append(result, e.key)
+			}
+		}
+		return result
+	}
+	selected := make(map[string]struct{}, limit)
+	result := make([]string, 0, limit)
+	for len(result) < limit {
+		key := dict.randomKey()
+		if _, ok := selected[key]; !ok {
+			selected[key] = struct{}{}
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// Clear 清空字典
+func (dict *BucketDict) Clear() {
+	dict.mu.Lock()
+	defer dict.mu.Unlock()
+	dict.buckets = make([]*entry, minBuckets)
+	dict.count = 0
+}
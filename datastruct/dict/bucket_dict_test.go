@@ -0,0 +1,119 @@
+package dict
+
+import (
+	"strconv"
+	"testing"
+)
+
+// TestNextCursor 从 0 开始的游标恰好访问每个桶一次，最后回到 0
+func TestNextCursor(t *testing.T) {
+	for _, size := range []int{1, 2, 16, 1024} {
+		seen := make(map[uint64]bool, size)
+		cursor := uint64(0)
+		for i := 0; i < size; i++ {
+			index := cursor & uint64(size-1)
+			if seen[index] {
+				t.Fatalf("size %d: bucket %d visited twice", size, index)
+			}
+			seen[index] = true
+			cursor = nextCursor(cursor, size)
+		}
+		if cursor != 0 {
+			t.Errorf("size %d: expect cursor to wrap to 0, got %d", size, cursor)
+		}
+	}
+}
+
+// TestScanResize 遍历期间哈希表扩容和缩容，一直存在的键都会被返回
+func TestScanResize(t *testing.T) {
+	dict := MakeBucketDict()
+	const stable = 100
+	for i := 0; i < stable; i++ {
+		dict.Put("stable-"+strconv.Itoa(i), i)
+	}
+
+	seen := make(map[string]bool)
+	cursor := uint64(0)
+	for round := 0; ; round++ {
+		if round > 10000 {
+			t.Fatal("scan does not finish")
+		}
+		var keys []string
+		keys, cursor = dict.Scan(cursor, 10)
+		for _, key := range keys {
+			seen[key] = true
+		}
+		if cursor == 0 {
+			break
+		}
+		// 奇数轮插入大量的键触发扩容，偶数轮删除这些键触发缩容
+		for i := 0; i < 1000; i++ {
+			key := "temp-" + strconv.Itoa(i)
+			if round%2 == 0 {
+				dict.Put(key, i)
+			} else {
+				dict.Remove(key)
+			}
+		}
+	}
+	for i := 0; i < stable; i++ {
+		if key := "stable-" + strconv.Itoa(i); !seen[key] {
+			t.Errorf("%s not returned by scan", key)
+		}
+	}
+}
+
+// TestScanComplete 遍历期间没有修改时每个键都会被返回
+func TestScanComplete(t *testing.T) {
+	dict := MakeBucketDict()
+	for i := 0; i < 1000; i++ {
+		dict.Put(strconv.Itoa(i), i)
+	}
+	seen := make(map[string]int)
+	cursor := uint64(0)
+	for {
+		var keys []string
+		keys, cursor = dict.Scan(cursor, 7)
+		for _, key := range keys {
+			seen[key]++
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	if len(seen) != 1000 {
+		t.Fatalf("expect 1000 keys, got %d", len(seen))
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Errorf("%s returned %d times", key, n)
+		}
+	}
+}
+
+// TestRandomDistinctKeys 返回的键互不相同并且都存在，limit 不小于键的数量时返回所有的键
+func TestRandomDistinctKeys(t *testing.T) {
+	dict := MakeBucketDict()
+	if keys := dict.RandomDistinctKeys(3); len(keys) != 0 {
+		t.Fatalf("expect no keys from empty dict, got %v", keys)
+	}
+	for i := 0; i < 100; i++ {
+		dict.Put(strconv.Itoa(i), i)
+	}
+	for _, limit := range []int{1, 10, 99, 100, 200} {
+		keys := dict.RandomDistinctKeys(limit)
+		if expect := min(limit, 100); len(keys) != expect {
+			t.Errorf("limit %d: expect %d keys, got %d", limit, expect, len(keys))
+		}
+		seen := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			if seen[key] {
+				t.Errorf("limit %d: duplicate key %s", limit, key)
+			}
+			seen[key] = true
+			if _, ok := dict.Get(key); !ok {
+				t.Errorf("limit %d: key %s does not exist", limit, key)
+			}
+		}
+	}
+}
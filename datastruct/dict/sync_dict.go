@@ -86,8 +86,7 @@ func (dict *SyncDict) Keys() []string {
 func (dict *SyncDict) ForEach(consumer Consumer) {
 	// 遍历字典中的每个键值对
 	dict.m.Range(func(key, value interface{}) bool {
-		consumer(key.(string), value) // 执行回调函数
-		return true                   // 继续遍历
+		return consumer(key.(string), value) // 执行回调函数，返回 false 时停止遍历
 	})
 }
 
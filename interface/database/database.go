@@ -19,3 +19,25 @@ type DataEntity struct {
 	Data       interface{}
 	ExpireTime int64 // Unix timestamp in milliseconds, 0 means no expiration
 }
+
+// DBEngine 在 Database 的基础上提供遍历数据的能力，供 AOF 重写等内部模块使用
+type DBEngine interface {
+	Database
+	// ForEach 遍历指定 DB 中所有未过期的键，cb 返回 false 时停止
+	ForEach(dbIndex int, cb func(key string, entity *DataEntity) bool)
+}
+
+// Replicated 在 Database 的基础上提供复制状态，集群模式下用于在多个从库中选出数据最新的一个
+type Replicated interface {
+	Database
+	// ReplOffset 返回已经执行的复制流偏移量
+	ReplOffset() int64
+	// IsReplica 当前是否正在复制其他主库，REPLICAOF 和故障转移会改变这个状态
+	IsReplica() bool
+}
+
+// BatchExecutor 在 Database 的基础上一次执行客户端通过管道发送的多条命令，回复按命令的顺序返回
+type BatchExecutor interface {
+	Database
+	ExecBatch(client resp.Connection, cmdLines []CmdLine) []resp.Reply
+}
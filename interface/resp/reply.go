@@ -4,3 +4,9 @@ package resp
 type Reply interface {
 	ToBytes() []byte
 }
+
+// Resp3Reply 在 RESP3 中有不同编码的回复，ToBytes 返回 RESP2 中的编码
+type Resp3Reply interface {
+	Reply
+	ToResp3Bytes() []byte
+}
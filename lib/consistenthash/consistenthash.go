@@ -1,24 +1,42 @@
 package consistenthash
 
 import (
+	"goredis/lib/utils"
 	"hash/crc32"
 	"sort"
+	"strconv"
 )
 
 // HashFunc 定义用于生成hash的函数
 type HashFunc func(data []byte) uint32
 
 // NodeMap 存储节点，实现从NodeMap中选节点
+// 每个节点在环上有 replicas * weight 个虚拟节点，replicas <= 1 且权重为 1 时与只放置节点本身的旧版本位置相同
+// 虚拟节点的位置由加入时的节点名决定，ReplaceNode 可以把这些位置交给另一个节点，键的分布保持不变
 type NodeMap struct {
 	hashFunc    HashFunc
-	nodeHashs   []int // sorted
-	nodehashMap map[int]string
+	replicas    int               // 每单位权重的虚拟节点数量
+	weights     map[string]int    // 节点名 -> 权重，节点名决定虚拟节点在环上的位置
+	owners      map[string]string // 被替换的节点名 -> 当前负责这些位置的节点
+	nodeHashs   []int             // sorted
+	nodehashMap map[int]string    // 哈希值 -> 节点名
 }
 
-// NewNodeMap 创建新的NodeMap
+// NewNodeMap 创建新的NodeMap，每个节点只在环上放置一个点
 func NewNodeMap(fn HashFunc) *NodeMap {
+	return NewNodeMapWithReplicas(1, fn)
+}
+
+// NewNodeMapWithReplicas 创建每单位权重有 replicas 个虚拟节点的 NodeMap
+func NewNodeMapWithReplicas(replicas int, fn HashFunc) *NodeMap {
+	if replicas < 1 {
+		replicas = 1
+	}
 	m := &NodeMap{
 		hashFunc:    fn,
+		replicas:    replicas,
+		weights:     make(map[string]int),
+		owners:      make(map[string]string),
 		nodehashMap: make(map[int]string),
 	}
 	if m.hashFunc == nil {
@@ -32,26 +50,144 @@ func (m *NodeMap) IsEmpty() bool {
 	return len(m.nodeHashs) == 0
 }
 
-// AddNode 将给定的节点添加到一致的Hash
+// AddNode 将给定的节点添加到一致的Hash，权重为 1
 func (m *NodeMap) AddNode(keys ...string) {
 	for _, key := range keys {
 		if key == "" {
 			continue
 		}
-		hash := int(m.hashFunc([]byte(key)))
-		m.nodeHashs = append(m.nodeHashs, hash)
-		m.nodehashMap[hash] = key
+		m.weights[key] = 1
+	}
+	m.rebuild()
+}
+
+// AddWeightedNode 添加节点或修改已有节点的权重，权重越大分到的键越多
+func (m *NodeMap) AddWeightedNode(key string, weight int) {
+	if key == "" || weight < 1 {
+		return
+	}
+	m.weights[key] = weight
+	m.rebuild()
+}
+
+// RemoveNode 从环上移除节点，原本属于它的键分散到相邻的节点
+func (m *NodeMap) RemoveNode(keys ...string) {
+	for _, key := range keys {
+		delete(m.weights, key)
+		delete(m.owners, key)
+	}
+	m.rebuild()
+}
+
+// ReplaceNode 让 newNode 接管 oldNode 在环上的所有位置，原本属于 oldNode 的键都由 newNode 负责
+// 用于从库提升为主库：键的分布不变，不需要迁移数据
+func (m *NodeMap) ReplaceNode(oldNode string, newNode string) {
+	for _, name := range m.Names() {
+		if m.Owner(name) == oldNode {
+			m.SetOwner(name, newNode)
+		}
+	}
+}
+
+// SetOwner 设置负责节点名 name 对应位置的节点
+func (m *NodeMap) SetOwner(name string, owner string) {
+	if _, ok := m.weights[name]; !ok {
+		return
+	}
+	if name == owner {
+		delete(m.owners, name)
+	} else {
+		m.owners[name] = owner
+	}
+}
+
+// Names 返回加入环时使用的所有节点名，按名称排序
+func (m *NodeMap) Names() []string {
+	names := make([]string, 0, len(m.weights))
+	for name := range m.weights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Owner 返回当前负责节点名 name 对应位置的节点，name 不存在时返回空字符串
+func (m *NodeMap) Owner(name string) string {
+	if _, ok := m.weights[name]; !ok {
+		return ""
+	}
+	if owner, ok := m.owners[name]; ok {
+		return owner
+	}
+	return name
+}
+
+// Nodes 返回所有当前负责键的节点，按名称排序
+func (m *NodeMap) Nodes() []string {
+	seen := make(map[string]struct{}, len(m.weights))
+	nodes := make([]string, 0, len(m.weights))
+	for _, name := range m.Names() {
+		owner := m.Owner(name)
+		if _, ok := seen[owner]; !ok {
+			seen[owner] = struct{}{}
+			nodes = append(nodes, owner)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// HasNode 判断节点当前是否负责环上的位置
+func (m *NodeMap) HasNode(node string) bool {
+	for _, name := range m.Names() {
+		if m.Owner(name) == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Weight 返回节点名的权重，不存在时返回 0
+func (m *NodeMap) Weight(name string) int {
+	return m.weights[name]
+}
+
+// pointKey 第 i 个虚拟节点用于计算哈希的名称，第 0 个使用节点名本身以兼容旧版本的位置
+func pointKey(node string, i int) string {
+	if i == 0 {
+		return node
+	}
+	return node + "#" + strconv.Itoa(i)
+}
+
+// rebuild 根据节点和权重重新生成哈希环
+// 虚拟节点的哈希冲突时保留名称较小的节点，结果与节点加入的顺序无关，所有节点计算出的环都相同
+func (m *NodeMap) rebuild() {
+	m.nodeHashs = m.nodeHashs[:0]
+	m.nodehashMap = make(map[int]string)
+	for _, node := range m.Names() {
+		points := m.replicas * m.weights[node]
+		for i := 0; i < points; i++ {
+			hash := int(m.hashFunc([]byte(pointKey(node, i))))
+			if _, ok := m.nodehashMap[hash]; ok {
+				// 节点按名称升序处理，已经占据该位置的节点名称更小
+				continue
+			}
+			m.nodeHashs = append(m.nodeHashs, hash)
+			m.nodehashMap[hash] = node
+		}
 	}
 	sort.Ints(m.nodeHashs)
 }
 
 // PickNode 获取hash中与提供的键最接近的项。
+// 键中包含 {tag} 时只对 tag 计算哈希，相同 tag 的键总是落在同一个节点
 func (m *NodeMap) PickNode(key string) string {
 	if m.IsEmpty() {
 		return ""
 	}
 
-	hash := int(m.hashFunc([]byte(key)))
+	hash := int(m.hashFunc([]byte(utils.HashTag(key))))
 
 	// 二进制搜索以查找适当的副本
 	idx := sort.Search(len(m.nodeHashs), func(i int) bool {
@@ -61,5 +197,43 @@ func (m *NodeMap) PickNode(key string) string {
 		idx = 0
 	}
 
-	return m.nodehashMap[m.nodeHashs[idx]]
+	return m.Owner(m.nodehashMap[m.nodeHashs[idx]])
+}
+
+// NodeShare 描述一个节点在环上占据的份额
+type NodeShare struct {
+	Node   string
+	Weight int
+	Points int     // 环上的虚拟节点数量（不包括因冲突丢弃的）
+	Share  float64 // 负责的哈希空间占整个环的比例
+}
+
+// Distribution 统计每个节点负责的哈希空间，用于检查键的分布是否均匀
+func (m *NodeMap) Distribution() []*NodeShare {
+	shares := make(map[string]*NodeShare)
+	for _, name := range m.Names() {
+		owner := m.Owner(name)
+		share, ok := shares[owner]
+		if !ok {
+			share = &NodeShare{Node: owner}
+			shares[owner] = share
+		}
+		share.Weight += m.weights[name]
+	}
+	const ringSize = float64(1 << 32)
+	for i, hash := range m.nodeHashs {
+		// 每个点负责 (前一个点, 当前点] 之间的哈希值，第一个点负责跨越 0 的部分
+		prev := m.nodeHashs[len(m.nodeHashs)-1] - (1 << 32)
+		if i > 0 {
+			prev = m.nodeHashs[i-1]
+		}
+		share := shares[m.Owner(m.nodehashMap[hash])]
+		share.Points++
+		share.Share += float64(hash-prev) / ringSize
+	}
+	result := make([]*NodeShare, 0, len(shares))
+	for _, node := range m.Nodes() {
+		result = append(result, shares[node])
+	}
+	return result
 }
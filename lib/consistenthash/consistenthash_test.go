@@ -0,0 +1,96 @@
+package consistenthash
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// baselinePick 只在环上放置节点本身的旧版本算法
+func baselinePick(nodes []string, key string) string {
+	hashes := make([]int, 0, len(nodes))
+	hashMap := make(map[int]string, len(nodes))
+	for _, node := range nodes {
+		hash := int(crc32.ChecksumIEEE([]byte(node)))
+		hashes = append(hashes, hash)
+		hashMap[hash] = node
+	}
+	sort.Ints(hashes)
+	hash := int(crc32.ChecksumIEEE([]byte(key)))
+	idx := sort.Search(len(hashes), func(i int) bool {
+		return hashes[i] >= hash
+	})
+	if idx == len(hashes) {
+		idx = 0
+	}
+	return hashMap[hashes[idx]]
+}
+
+// TestPickNodeBaseline 虚拟节点数量不超过 1 且权重为 1 时与旧版本选择相同的节点
+func TestPickNodeBaseline(t *testing.T) {
+	nodes := []string{"127.0.0.1:6379", "127.0.0.1:6380", "127.0.0.1:6381", "10.0.0.1:7000", "10.0.0.2:7000"}
+	tests := []struct {
+		name     string
+		m        *NodeMap
+		weighted bool
+	}{
+		{name: "NewNodeMap", m: NewNodeMap(nil)},
+		{name: "replicas 0", m: NewNodeMapWithReplicas(0, nil)},
+		{name: "replicas 1", m: NewNodeMapWithReplicas(1, nil)},
+		{name: "weight 1", m: NewNodeMapWithReplicas(1, nil), weighted: true},
+	}
+	for _, tt := range tests {
+		m := tt.m
+		if tt.weighted {
+			for _, node := range nodes {
+				m.AddWeightedNode(node, 1)
+			}
+		} else {
+			m.AddNode(nodes...)
+		}
+		for i := 0; i < 1000; i++ {
+			key := "key:" + strconv.Itoa(i)
+			if got, expect := m.PickNode(key), baselinePick(nodes, key); got != expect {
+				t.Errorf("%s: %s picked %s, expect %s", tt.name, key, got, expect)
+			}
+		}
+	}
+}
+
+// TestCollisionOrder 虚拟节点的哈希冲突时名称较小的节点占据该位置，与加入的顺序无关
+func TestCollisionOrder(t *testing.T) {
+	// "b" 与 "a" 的哈希相同
+	hashFunc := func(data []byte) uint32 {
+		if string(data) == "b" {
+			return crc32.ChecksumIEEE([]byte("a"))
+		}
+		return crc32.ChecksumIEEE(data)
+	}
+	orders := [][]string{{"a", "b", "c"}, {"b", "a", "c"}, {"c", "b", "a"}}
+	var expect []string
+	for _, order := range orders {
+		m := NewNodeMap(hashFunc)
+		for _, node := range order {
+			m.AddNode(node)
+		}
+		var picked []string
+		for i := 0; i < 200; i++ {
+			picked = append(picked, m.PickNode(strconv.Itoa(i)))
+		}
+		for _, node := range picked {
+			if node == "b" {
+				t.Fatalf("order %v: b should lose the collision with a", order)
+			}
+		}
+		if expect == nil {
+			expect = picked
+			continue
+		}
+		for i := range picked {
+			if picked[i] != expect[i] {
+				t.Fatalf("order %v: key %d picked %s, expect %s", order, i, picked[i], expect[i])
+			}
+		}
+	}
+}
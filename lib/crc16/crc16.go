@@ -0,0 +1,28 @@
+// Package crc16 实现 Redis Cluster 计算槽位使用的 CRC16（XMODEM）算法
+package crc16
+
+// table 多项式 0x1021 的查找表
+var table [256]uint16
+
+func init() {
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+}
+
+// Checksum 计算 data 的 CRC16 校验值
+func Checksum(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = crc<<8 ^ table[byte(crc>>8)^b]
+	}
+	return crc
+}
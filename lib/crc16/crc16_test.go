@@ -0,0 +1,19 @@
+package crc16
+
+import "testing"
+
+// TestChecksum CRC16/XMODEM 的标准测试向量，与 Redis Cluster 规范中的示例相同
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		data   string
+		expect uint16
+	}{
+		{data: "123456789", expect: 0x31C3},
+		{data: "", expect: 0},
+	}
+	for _, tt := range tests {
+		if got := Checksum([]byte(tt.data)); got != tt.expect {
+			t.Errorf("Checksum(%q) = %#04x, expect %#04x", tt.data, got, tt.expect)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package lock
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Locks 按键的哈希值分段的读写锁，不同的键可能共用同一段
+// 同时锁住多个键时按段的下标顺序加锁，避免互相等待造成死锁
+type Locks struct {
+	table []*sync.RWMutex
+}
+
+// Make 创建有 size 段的 Locks
+func Make(size int) *Locks {
+	if size < 1 {
+		size = 1
+	}
+	table := make([]*sync.RWMutex, size)
+	for i := 0; i < size; i++ {
+		table[i] = &sync.RWMutex{}
+	}
+	return &Locks{table: table}
+}
+
+func (locks *Locks) spread(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(locks.table)))
+}
+
+// indexes 返回键所在的段，升序排列，同时出现在读写键中的段需要加写锁
+func (locks *Locks) indexes(writeKeys []string, readKeys []string) ([]int, map[int]bool) {
+	writes := make(map[int]bool)
+	for _, key := range writeKeys {
+		writes[locks.spread(key)] = true
+	}
+	seen := make(map[int]struct{})
+	var result []int
+	for _, key := range append(append([]string{}, writeKeys...), readKeys...) {
+		index := locks.spread(key)
+		if _, ok := seen[index]; !ok {
+			seen[index] = struct{}{}
+			result = append(result, index)
+		}
+	}
+	sort.Ints(result)
+	return result, writes
+}
+
+// RWLocks 对 writeKeys 加写锁，对 readKeys 加读锁
+func (locks *Locks) RWLocks(writeKeys []string, readKeys []string) {
+	indexes, writes := locks.indexes(writeKeys, readKeys)
+	for _, index := range indexes {
+		if writes[index] {
+			locks.table[index].Lock()
+		} else {
+			locks.table[index].RLock()
+		}
+	}
+}
+
+// RWUnLocks 释放 RWLocks 加的锁
+func (locks *Locks) RWUnLocks(writeKeys []string, readKeys []string) {
+	indexes, writes := locks.indexes(writeKeys, readKeys)
+	for i := len(indexes) - 1; i >= 0; i-- {
+		if writes[indexes[i]] {
+			locks.table[indexes[i]].Unlock()
+		} else {
+			locks.table[indexes[i]].RUnlock()
+		}
+	}
+}
+
+// TryRWLocks 与 RWLocks 相同，但最多等待 timeout，超时时释放已经加上的锁并返回 false
+func (locks *Locks) TryRWLocks(writeKeys []string, readKeys []string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	indexes, writes := locks.indexes(writeKeys, readKeys)
+	for i, index := range indexes {
+		mu := locks.table[index]
+		for {
+			var ok bool
+			if writes[index] {
+				ok = mu.TryLock()
+			} else {
+				ok = mu.TryRLock()
+			}
+			if ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				for j := i - 1; j >= 0; j-- {
+					if writes[indexes[j]] {
+						locks.table[indexes[j]].Unlock()
+					} else {
+						locks.table[indexes[j]].RUnlock()
+					}
+				}
+				return false
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return true
+}
@@ -34,3 +34,27 @@ func ByteEquals(a []byte, b []byte) bool {
 	}
 	return true
 }
+
+// HashTag 返回键中用于计算槽位的部分
+// 键中包含 {tag} 且 tag 不为空时只使用第一个 { 与其后第一个 } 之间的内容，这样可以让多个键落在同一个槽位
+func HashTag(key string) string {
+	begin := -1
+	for i := 0; i < len(key); i++ {
+		if key[i] == '{' {
+			begin = i
+			break
+		}
+	}
+	if begin == -1 {
+		return key
+	}
+	for i := begin + 1; i < len(key); i++ {
+		if key[i] == '}' {
+			if i == begin+1 {
+				return key // {} 中没有内容时使用整个键
+			}
+			return key[begin+1 : i]
+		}
+	}
+	return key
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"goredis/config"
 	"goredis/lib/logger"
+	"goredis/resp/connection"
 	"goredis/resp/handler"
 	"goredis/tcp"
 	"os"
@@ -11,17 +13,19 @@ import (
 
 const configFile string = "redis.conf" //记录集群端口信息
 
-var defaultProperties = &config.ServerProperties{
-	Bind: "0.0.0.0",
-	Port: 6379,
-}
-
 func fileExists(filename string) bool {
 	info, err := os.Stat(filename)
 	return err == nil && !info.IsDir()
 }
 
+// sentinelMode 以 sentinel 模式启动，也可以在配置文件中使用 sentinel yes
+var sentinelMode = flag.Bool("sentinel", false, "run in sentinel mode")
+
+// proxyMode 以代理模式启动，将命令转发给 peers 中配置的后端，也可以在配置文件中使用 proxy yes
+var proxyMode = flag.Bool("proxy", false, "run in proxy mode")
+
 func main() {
+	flag.Parse()
 	logger.Setup(&logger.Settings{
 		Path:       "logs",
 		Name:       "goredis",
@@ -32,7 +36,17 @@ func main() {
 	if fileExists(configFile) {
 		config.SetupConfig(configFile)
 	} else {
-		config.Properties = defaultProperties
+		config.Properties = config.DefaultProperties()
+	}
+	if *sentinelMode {
+		config.Properties.Sentinel = true
+	}
+	if *proxyMode {
+		config.Properties.Proxy = true
+	}
+	// 在接受连接之前解析输出缓冲区限制，配置错误时直接退出
+	if err := connection.SetupOutputLimits(config.Properties.ClientOutputBufferLimit); err != nil {
+		logger.Fatal(err)
 	}
 
 	err := tcp.ListenAndServeWithSignal(
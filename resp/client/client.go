@@ -1,14 +1,19 @@
 package client
 
 import (
+	"bytes"
+	"errors"
 	"goredis/interface/resp"
 	"goredis/lib/logger"
 	"goredis/lib/sync/wait"
+	"goredis/lib/utils"
 	"goredis/resp/parser"
 	"goredis/resp/reply"
 	"net"
 	"runtime/debug"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,7 +24,9 @@ type Client struct {
 	waitingReqs chan *request   // 等待响应的请求队列
 	ticker      *time.Ticker    // 心跳定时器
 	addr        string          // Redis 服务地址
+	handshake   [][][]byte      // 每次建立连接后先同步发送的命令，例如 AUTH
 	working     *sync.WaitGroup // 用于跟踪正在进行的请求数（包括等待和待发送的请求）
+	selectedDB  atomic.Int64    // 连接当前选中的 DB，-1 表示未知，由发送请求的 goroutine 维护
 }
 
 // request 表示发送给 Redis 服务器的请求
@@ -30,6 +37,8 @@ type request struct {
 	heartbeat bool       // 是否为心跳请求
 	waiting   *wait.Wait // 等待响应的机制
 	err       error      // 错误信息
+	dbIndex   int        // 请求需要在哪个 DB 执行，-1 表示不关心
+	selectErr resp.Reply // 切换 DB 失败时 SELECT 的错误回复，此时请求没有发送
 }
 
 const (
@@ -37,14 +46,48 @@ const (
 	maxWait  = 3 * time.Second // 最大等待时间
 )
 
+// LinkError 连接层面的错误回复：请求超时、发送失败或者读取回复时连接出错，对方没有回复这个请求
+// 调用者通过 IsLinkError 与对方回复的错误区分，不需要比较错误信息
+type LinkError struct {
+	reply.StandardErrReply
+}
+
+var (
+	// ErrTimeout 等待回复超时
+	ErrTimeout = &LinkError{reply.StandardErrReply{Status: "server time out"}}
+	// ErrRequestFailed 重新连接之后仍然无法发送请求
+	ErrRequestFailed = &LinkError{reply.StandardErrReply{Status: "request failed"}}
+)
+
+// IsLinkError 判断 Send 返回的回复是否是连接层面的错误
+func IsLinkError(r resp.Reply) bool {
+	_, ok := r.(*LinkError)
+	return ok
+}
+
 // MakeClient 创建一个新的客户端实例
 func MakeClient(addr string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr) // 连接到指定的 Redis 服务
+	return MakeAuthClient(addr, "")
+}
+
+// MakeAuthClient 创建一个新的客户端实例，password 不为空时连接后先发送 AUTH，重新连接时同样先认证
+func MakeAuthClient(addr string, password string) (*Client, error) {
+	if password == "" {
+		return MakeHandshakeClient(addr)
+	}
+	return MakeHandshakeClient(addr, utils.ToCmdLine("AUTH", password))
+}
+
+// MakeHandshakeClient 创建一个新的客户端实例，每次建立连接（包括重新连接）后按顺序发送 handshake 中的命令
+// 这些命令的回复必须只有一行，任何一条返回错误时连接失败
+func MakeHandshakeClient(addr string, handshake ...[][]byte) (*Client, error) {
+	conn, err := dial(addr, handshake) // 连接到指定的 Redis 服务
 	if err != nil {
 		return nil, err
 	}
 	return &Client{
 		addr:        addr,
+		handshake:   handshake,
 		conn:        conn,
 		pendingReqs: make(chan *request, chanSize),
 		waitingReqs: make(chan *request, chanSize),
@@ -52,6 +95,45 @@ func MakeClient(addr string) (*Client, error) {
 	}, nil
 }
 
+// dial 建立连接，在交给读写 goroutine 之前同步发送 handshake 中的命令
+func dial(addr string, handshake [][][]byte) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	for _, cmdLine := range handshake {
+		if err := sendHandshake(conn, cmdLine); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// sendHandshake 发送一条命令并读取回复
+// 回复只有一行，逐字节读取到行尾，不会读走之后的数据，连接之后仍然可以交给 parser
+func sendHandshake(conn net.Conn, cmdLine [][]byte) error {
+	_ = conn.SetDeadline(time.Now().Add(maxWait))
+	defer func() {
+		_ = conn.SetDeadline(time.Time{})
+	}()
+	if _, err := conn.Write(reply.MakeMultiBulkReply(cmdLine).ToBytes()); err != nil {
+		return err
+	}
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) == 0 || line[len(line)-1] != '\n' {
+		if _, err := conn.Read(b); err != nil {
+			return err
+		}
+		line = append(line, b[0])
+	}
+	if line[0] == '-' {
+		return errors.New(string(bytes.TrimSpace(line[1:])))
+	}
+	return nil
+}
+
 // Start 启动客户端的异步 goroutine
 func (client *Client) Start() {
 	client.ticker = time.NewTicker(10 * time.Second) // 设置心跳定时器
@@ -91,12 +173,13 @@ func (client *Client) handleConnectionError(err error) error {
 		}
 	}
 	// 尝试重新连接
-	conn, err1 := net.Dial("tcp", client.addr)
+	conn, err1 := dial(client.addr, client.handshake)
 	if err1 != nil {
 		logger.Error(err1)
 		return err1
 	}
 	client.conn = conn
+	client.selectedDB.Store(0) // 新连接选中的是 0 号 DB
 	go func() {
 		_ = client.handleRead() // 重新启动读取响应的 goroutine
 	}()
@@ -117,25 +200,58 @@ func (client *Client) handleWrite() {
 	}
 }
 
-// Send 发送请求到 Redis 服务器
+// Send 发送请求到 Redis 服务器，在连接当前选中的 DB 中执行
 func (client *Client) Send(args [][]byte) resp.Reply {
+	return client.SendDB(-1, args)
+}
+
+// SendDB 在 dbIndex 号 DB 中执行命令
+// 连接当前选中的 DB 不同时先发送 SELECT 并等待它成功，再发送命令，命令不会在其他 DB 中执行
+// SELECT 失败时返回它的错误，命令不会发送，之后的请求会重新发送 SELECT
+func (client *Client) SendDB(dbIndex int, args [][]byte) resp.Reply {
+	return client.SendAsync(dbIndex, args).Wait()
+}
+
+// Pending 已经进入发送队列、还没有收到回复的请求
+type Pending struct {
+	client  *Client
+	request *request
+}
+
+// SendAsync 将请求放入发送队列后立即返回，不等待回复
+// 同一个连接上的请求按调用 SendAsync 的顺序发送和执行，每个 Pending 都需要调用一次 Wait
+func (client *Client) SendAsync(dbIndex int, args [][]byte) *Pending {
 	request := &request{
 		args:      args,
 		heartbeat: false, // 标记这是一个普通请求
 		waiting:   &wait.Wait{},
+		dbIndex:   dbIndex,
 	}
-	request.waiting.Add(1)                              // 等待响应
-	client.working.Add(1)                               // 增加工作计数
-	defer client.working.Done()                         // 请求完成后减少计数
-	client.pendingReqs <- request                       // 将请求加入待发送队列
-	timeout := request.waiting.WaitWithTimeout(maxWait) // 等待最大超时
+	request.waiting.Add(1)        // 等待响应
+	client.working.Add(1)         // 增加工作计数
+	client.pendingReqs <- request // 将请求加入待发送队列
+	return &Pending{client: client, request: request}
+}
+
+// Wait 等待请求的回复，最多等待 maxWait
+func (p *Pending) Wait() resp.Reply {
+	defer p.client.working.Done()                         // 请求完成后减少计数
+	timeout := p.request.waiting.WaitWithTimeout(maxWait) // 等待最大超时
 	if timeout {
-		return reply.MakeErrReply("server time out") // 超时返回错误
+		return ErrTimeout // 超时返回错误
+	}
+	if p.request.err != nil {
+		return ErrRequestFailed // 请求失败返回错误
 	}
-	if request.err != nil {
-		return reply.MakeErrReply("request failed") // 请求失败返回错误
+	if p.request.selectErr != nil {
+		return p.request.selectErr
 	}
-	return request.reply // 返回响应
+	return p.request.reply // 返回响应
+}
+
+// SelectedDB 返回连接当前选中的 DB，-1 表示连接的状态未知
+func (client *Client) SelectedDB() int {
+	return int(client.selectedDB.Load())
 }
 
 // doHeartbeat 执行心跳请求
@@ -144,6 +260,7 @@ func (client *Client) doHeartbeat() {
 		args:      [][]byte{[]byte("PING")}, // 心跳请求参数
 		heartbeat: true,                     // 标记这是一个心跳请求
 		waiting:   &wait.Wait{},
+		dbIndex:   -1,
 	}
 	request.waiting.Add(1)                   // 等待响应
 	client.working.Add(1)                    // 增加工作计数
@@ -153,30 +270,68 @@ func (client *Client) doHeartbeat() {
 }
 
 // doRequest 发送请求并处理可能的错误
+// 只有这个 goroutine 发送请求，因此可以根据 selectedDB 决定是否需要先发送 SELECT
 func (client *Client) doRequest(req *request) {
 	if req == nil || len(req.args) == 0 {
 		return
 	}
-	re := reply.MakeMultiBulkReply(req.args) // 创建多条命令的回复
-	bytes := re.ToBytes()                    // 转换为字节数组
-	_, err := client.conn.Write(bytes)       // 发送请求
+	bytes := reply.MakeMultiBulkReply(req.args).ToBytes() // 创建多条命令的回复
+	err := client.writeRequest(req, bytes)                // 发送请求
 	i := 0
 	// 如果连接出现错误，尝试重新连接并重发请求，最多尝试 3 次
 	for err != nil && i < 3 {
 		err = client.handleConnectionError(err)
 		if err == nil {
-			_, err = client.conn.Write(bytes)
+			// 重新连接后选中的是 0 号 DB，需要重新判断是否发送 SELECT
+			err = client.writeRequest(req, bytes)
 		}
 		i++
 	}
-	if err == nil {
-		client.waitingReqs <- req // 请求成功，加入等待响应队列
-	} else {
+	if err != nil {
+		client.selectedDB.Store(-1)
 		req.err = err      // 记录错误
 		req.waiting.Done() // 完成等待
 	}
 }
 
+// writeRequest 发送请求并加入等待响应队列，只有连接出现错误时返回 error
+// 请求需要的 DB 与连接当前选中的不同时先发送 SELECT 并等待回复，SELECT 失败时不发送请求，
+// 避免命令在原来的 DB 中执行；只有切换 DB 时才需要多一次往返
+func (client *Client) writeRequest(req *request, bytes []byte) error {
+	if req.dbIndex >= 0 && int64(req.dbIndex) != client.selectedDB.Load() {
+		selectReq := &request{
+			args:    utils.ToCmdLine("SELECT", strconv.Itoa(req.dbIndex)),
+			waiting: &wait.Wait{},
+			dbIndex: -1,
+		}
+		selectReq.waiting.Add(1)
+		if _, err := client.conn.Write(reply.MakeMultiBulkReply(selectReq.args).ToBytes()); err != nil {
+			return err
+		}
+		client.waitingReqs <- selectReq
+		if selectReq.waiting.WaitWithTimeout(maxWait) {
+			// SELECT 之后是否已经执行未知，下一个请求重新发送 SELECT
+			client.selectedDB.Store(-1)
+			req.selectErr = ErrTimeout
+			req.waiting.Done()
+			return nil
+		}
+		if _, ok := selectReq.reply.(interface{ Error() string }); ok {
+			// SELECT 失败时连接仍然在原来的 DB 上，让下一个请求重新发送 SELECT
+			client.selectedDB.Store(-1)
+			req.selectErr = selectReq.reply
+			req.waiting.Done()
+			return nil
+		}
+		client.selectedDB.Store(int64(req.dbIndex))
+	}
+	if _, err := client.conn.Write(bytes); err != nil {
+		return err
+	}
+	client.waitingReqs <- req // 请求成功，加入等待响应队列
+	return nil
+}
+
 // finishRequest 处理请求的响应
 func (client *Client) finishRequest(reply resp.Reply) {
 	defer func() {
@@ -200,7 +355,8 @@ func (client *Client) handleRead() error {
 	ch := parser.ParseStream(client.conn) // 解析响应数据流
 	for payload := range ch {             // 遍历响应数据
 		if payload.Err != nil {
-			client.finishRequest(reply.MakeErrReply(payload.Err.Error())) // 处理错误响应
+			// 读取回复时连接出错，例如连接断开
+			client.finishRequest(&LinkError{reply.StandardErrReply{Status: payload.Err.Error()}})
 			continue
 		}
 		client.finishRequest(payload.Data) // 处理正常响应
@@ -2,30 +2,53 @@ package connection
 
 import (
 	"bytes"
+	"errors"
 	"goredis/lib/sync/wait"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// connSeq 为每个连接分配递增的 ID
+var connSeq atomic.Int64
+
 // Connection 表示与 redis-cli 的连接
 type Connection struct {
 	conn net.Conn // 网络连接对象
+	id   int64    // 连接 ID，HELLO 的回复中返回给客户端
 	// 等待直到回复完成
 	waitingReply wait.Wait
-	// 发送响应时的锁
+	// 发送响应时的锁，同时保护 out
 	mu sync.Mutex
+	// 已经生成、还没有发送的回复，客户端通过管道发送的多条命令的回复合并为一次写入
+	out bytes.Buffer
+	// 检查 out 是否超过输出缓冲区限制
+	outLimiter *OutputLimiter
 	// 选择的数据库索引
 	selectedDB int
+	// HELLO 协商的协议版本，2 或 3
+	protocol int
+	// 是否通过了 AUTH 认证
+	authenticated bool
+	// HELLO SETNAME 设置的客户端名称
+	name string
 }
 
 // NewConn 创建一个新的 Connection 实例
 func NewConn(conn net.Conn) *Connection {
 	return &Connection{
-		conn: conn, // 传入的 TCP 连接
+		conn:       conn, // 传入的 TCP 连接
+		id:         connSeq.Add(1),
+		protocol:   2, // 默认使用 RESP2，HELLO 3 切换到 RESP3
+		outLimiter: MakeOutputLimiter(ClassNormal),
 	}
 }
 
+// ErrOutputLimit 等待发送的回复超过了输出缓冲区限制
+var ErrOutputLimit = errors.New("client output buffer limit reached")
+
 // RemoteAddr 返回远程网络地址
 func (c *Connection) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr() // 返回连接的远程地址
@@ -40,7 +63,7 @@ func (c *Connection) Close() error {
 	return nil
 }
 
-// Write 通过 TCP 连接发送响应到客户端
+// Write 通过 TCP 连接发送响应到客户端，缓冲区中还没有发送的回复先发送
 func (c *Connection) Write(b []byte) error {
 	// 如果没有数据要发送，直接返回
 	if len(b) == 0 {
@@ -48,16 +71,72 @@ func (c *Connection) Write(b []byte) error {
 	}
 	// 获取锁，防止同时发送响应
 	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.out.Len() > 0 {
+		c.out.Write(b)
+		return c.flushLocked()
+	}
+	return c.send(b)
+}
+
+// Buffer 将回复追加到缓冲区，由 Flush 一起发送
+// 缓冲区超过输出缓冲区限制时返回 ErrOutputLimit，调用者应该关闭连接
+func (c *Connection) Buffer(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.out.Write(b)
+	if c.outLimiter.Exceeded(int64(c.out.Len())) {
+		c.out.Reset()
+		return ErrOutputLimit
+	}
+	return nil
+}
+
+// Buffered 返回缓冲区中还没有发送的字节数
+func (c *Connection) Buffered() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.Len()
+}
+
+// Flush 发送缓冲区中的所有回复
+func (c *Connection) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushLocked()
+}
+
+// flushLocked 发送缓冲区中的所有回复，调用者需要持有 c.mu
+func (c *Connection) flushLocked() error {
+	if c.out.Len() == 0 {
+		return nil
+	}
+	err := c.send(c.out.Bytes())
+	c.out.Reset()
+	return err
+}
+
+// send 通过连接发送 data，data 包含所有还没有发送的回复，调用者需要持有 c.mu
+// 超过软限制时为这次写入设置期限，客户端在期限内没有读完回复时返回 ErrOutputLimit
+func (c *Connection) send(data []byte) error {
+	if c.outLimiter.Exceeded(int64(len(data))) {
+		return ErrOutputLimit
+	}
 	// 增加等待计数，表示正在等待回复
 	c.waitingReply.Add(1)
-	// 在发送完后解锁
-	defer func() {
-		c.waitingReply.Done()
-		c.mu.Unlock()
-	}()
-
-	// 通过连接发送数据
-	_, err := c.conn.Write(b)
+	defer c.waitingReply.Done()
+	if deadline := c.outLimiter.Deadline(); !deadline.IsZero() {
+		_ = c.conn.SetWriteDeadline(deadline)
+		defer func() { _ = c.conn.SetWriteDeadline(time.Time{}) }()
+	}
+	_, err := c.conn.Write(data)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return ErrOutputLimit
+	}
+	if err == nil {
+		// 全部发送完毕，没有等待发送的数据
+		c.outLimiter.Exceeded(0)
+	}
 	return err
 }
 
@@ -71,6 +150,41 @@ func (c *Connection) SelectDB(dbNum int) {
 	c.selectedDB = dbNum // 设置 selectedDB 字段为 dbNum
 }
 
+// ID 返回连接 ID
+func (c *Connection) ID() int64 {
+	return c.id
+}
+
+// Protocol 返回连接使用的协议版本
+func (c *Connection) Protocol() int {
+	return c.protocol
+}
+
+// SetProtocol 设置连接使用的协议版本
+func (c *Connection) SetProtocol(protocol int) {
+	c.protocol = protocol
+}
+
+// Authenticated 返回连接是否通过了认证
+func (c *Connection) Authenticated() bool {
+	return c.authenticated
+}
+
+// SetAuthenticated 设置连接是否通过了认证
+func (c *Connection) SetAuthenticated(authenticated bool) {
+	c.authenticated = authenticated
+}
+
+// Name 返回客户端名称
+func (c *Connection) Name() string {
+	return c.name
+}
+
+// SetName 设置客户端名称
+func (c *Connection) SetName(name string) {
+	c.name = name
+}
+
 // FakeConn 实现了用于测试的 redis.Connection 接口
 type FakeConn struct {
 	Connection              // 嵌入 Connection 类型
@@ -0,0 +1,143 @@
+package connection
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * 输出缓冲区限制，与 Redis 的 client-output-buffer-limit 相同：
+ * 等待发送的数据超过硬限制时立即断开连接，持续超过软限制 SoftSeconds 秒时断开连接，限制为 0 表示不限制。
+ * 普通客户端的回复同步写入连接，超过软限制时为这次写入设置期限，客户端在期限内没有读完回复时断开连接；
+ * 从库的复制流由 sendLoop 异步发送，按照队列中还没有发送的字节数检查。
+ * 配置格式为 client-output-buffer-limit <class> <hard> <soft> <soft seconds>[,<class> ...]，
+ * 大小可以使用 k、kb、m、mb、g、gb 单位，class 为 normal（普通客户端）或 replica（从库，也可以写作 slave）
+ */
+
+// ClientClass 客户端的类别，不同的类别使用不同的输出缓冲区限制
+type ClientClass int
+
+const (
+	ClassNormal ClientClass = iota
+	ClassReplica
+	classCount
+)
+
+// OutputLimit 一类客户端的输出缓冲区限制
+type OutputLimit struct {
+	Hard        int64
+	Soft        int64
+	SoftSeconds int
+}
+
+// outputLimits 每类客户端的输出缓冲区限制，默认值与 Redis 相同，启动时由 SetupOutputLimits 根据配置覆盖
+var outputLimits = [classCount]OutputLimit{
+	ClassNormal:  {},
+	ClassReplica: {Hard: 256 * 1024 * 1024, Soft: 64 * 1024 * 1024, SoftSeconds: 60},
+}
+
+// SetupOutputLimits 在加载配置后解析 client-output-buffer-limit，配置格式错误时返回 error，不修改当前的限制
+func SetupOutputLimits(items []string) error {
+	limits := outputLimits
+	for _, item := range items {
+		fields := strings.Fields(item)
+		if len(fields) != 4 {
+			return errors.New("invalid client-output-buffer-limit config: " + item)
+		}
+		class, ok := parseClientClass(fields[0])
+		if !ok {
+			return errors.New("invalid client-output-buffer-limit class: " + fields[0])
+		}
+		hard, err1 := parseMemory(fields[1])
+		soft, err2 := parseMemory(fields[2])
+		seconds, err3 := strconv.Atoi(fields[3])
+		if err1 != nil || err2 != nil || err3 != nil || hard < 0 || soft < 0 || seconds < 0 {
+			return errors.New("invalid client-output-buffer-limit config: " + item)
+		}
+		limits[class] = OutputLimit{Hard: hard, Soft: soft, SoftSeconds: seconds}
+	}
+	outputLimits = limits
+	return nil
+}
+
+// GetOutputLimit 返回 class 类客户端的输出缓冲区限制
+func GetOutputLimit(class ClientClass) OutputLimit {
+	return outputLimits[class]
+}
+
+func parseClientClass(name string) (ClientClass, bool) {
+	switch strings.ToLower(name) {
+	case "normal":
+		return ClassNormal, true
+	case "replica", "slave":
+		return ClassReplica, true
+	}
+	return 0, false
+}
+
+// parseMemory 解析带单位的大小，k、m、g 是 1000 的幂，kb、mb、gb 是 1024 的幂
+func parseMemory(value string) (int64, error) {
+	value = strings.ToLower(value)
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1},
+	} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+// OutputLimiter 检查一个客户端的输出缓冲区是否超过限制，调用者负责同步
+type OutputLimiter struct {
+	limit     OutputLimit
+	softSince time.Time // 开始超过软限制的时间，零值表示没有超过
+}
+
+// MakeOutputLimiter 创建 class 类客户端的限制检查
+func MakeOutputLimiter(class ClientClass) *OutputLimiter {
+	return &OutputLimiter{
+		limit: GetOutputLimit(class),
+	}
+}
+
+// Exceeded 等待发送的数据为 size 字节时是否应该断开连接，l 为空时不限制
+// size 应该是所有还没有发送的字节数，而不只是这一次写入的数据；size 不超过软限制时重新开始计时
+func (l *OutputLimiter) Exceeded(size int64) bool {
+	if l == nil {
+		return false
+	}
+	if l.limit.Hard > 0 && size > l.limit.Hard {
+		return true
+	}
+	if l.limit.Soft == 0 || size <= l.limit.Soft {
+		l.softSince = time.Time{}
+		return false
+	}
+	now := time.Now()
+	if l.softSince.IsZero() {
+		l.softSince = now
+	}
+	return now.Sub(l.softSince) >= time.Duration(l.limit.SoftSeconds)*time.Second
+}
+
+// Deadline 超过软限制时等待发送的数据必须发送完的时间，没有超过软限制时返回零值
+func (l *OutputLimiter) Deadline() time.Time {
+	if l == nil || l.softSince.IsZero() {
+		return time.Time{}
+	}
+	return l.softSince.Add(time.Duration(l.limit.SoftSeconds) * time.Second)
+}
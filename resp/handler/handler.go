@@ -5,16 +5,19 @@ package handler
  */
 
 import (
+	"bufio"
 	"context"
 	"goredis/cluster"
 	"goredis/config"
 	"goredis/database"
 	databaseface "goredis/interface/database"
+	"goredis/interface/resp"
 	"goredis/lib/logger"
 	"goredis/lib/sync/atomic"
 	"goredis/resp/connection"
 	"goredis/resp/parser"
 	"goredis/resp/reply"
+	"goredis/sentinel"
 	"io"
 	"net"
 	"strings"
@@ -26,6 +29,13 @@ var (
 	unknownErrReplyBytes = []byte("-ERR unknown\r\n")
 )
 
+const (
+	// maxPipeline 数据库支持批量执行时，一次最多取出的客户端已经发送的命令数量
+	maxPipeline = 128
+	// maxPendingOutput 输出缓冲区中的回复超过这个大小时不再等待之后的命令，立即发送
+	maxPendingOutput = 64 * 1024
+)
+
 // RespHandler 实现了 tcp.Handler 接口，充当 Redis 请求的处理器
 type RespHandler struct {
 	activeConn sync.Map              // 存储活动连接的映射，key 为 *client，value 为占位符
@@ -36,8 +46,14 @@ type RespHandler struct {
 // MakeHandler 创建并返回一个 RespHandler 实例
 func MakeHandler() *RespHandler {
 	var db databaseface.Database
-	// 如果配置中包含集群信息，则使用集群数据库
-	if config.Properties.Self != "" && len(config.Properties.Peers) > 0 {
+	if config.Properties.Sentinel {
+		// sentinel 模式只监控主库，不存储数据
+		db = sentinel.MakeSentinel()
+	} else if config.Properties.Proxy {
+		// 代理模式按键将命令转发给后端，不存储数据
+		db = cluster.MakeProxy()
+	} else if config.Properties.ClusterEnabled || (config.Properties.Self != "" && len(config.Properties.Peers) > 0) {
+		// 如果配置中包含集群信息，则使用集群数据库
 		db = cluster.MakeClusterDatabase()
 	} else {
 		// 否则，使用独立数据库
@@ -67,56 +83,79 @@ func (h *RespHandler) Handle(ctx context.Context, conn net.Conn) {
 	client := connection.NewConn(conn) // 创建一个新的连接实例
 	h.activeConn.Store(client, 1)      // 将客户端加入到活动连接映射中
 
-	// 使用 parser 解析请求流
-	ch := parser.ParseStream(conn)
-	for payload := range ch {
-		// 处理解析后的请求数据
-		if payload.Err != nil {
-			// 如果发生错误，检查是否是连接关闭相关的错误
-			if payload.Err == io.EOF ||
-				payload.Err == io.ErrUnexpectedEOF ||
-				strings.Contains(payload.Err.Error(), "use of closed network connection") {
-				// 如果连接已关闭，进行清理
+	// 在当前 goroutine 中逐条读取请求
+	cmdReader := parser.NewCommandReader(bufio.NewReader(conn))
+	_, batcher := h.db.(databaseface.BatchExecutor)
+	for {
+		cmdLine, err := cmdReader.ReadCommand()
+		if err != nil {
+			h.handleReadError(client, err)
+			return
+		}
+		cmdLines := []databaseface.CmdLine{cmdLine}
+		if batcher {
+			// 取出客户端通过管道已经发送的其他命令，一起交给数据库执行
+			cmdLines, err = drainPipeline(cmdReader, cmdLines)
+		}
+		for _, result := range h.exec(client, cmdLines) {
+			if writeErr := writeResult(client, result); writeErr != nil {
+				logger.Warn("closing client " + client.RemoteAddr().String() + ": " + writeErr.Error())
 				h.closeClient(client)
-				logger.Info("connection closed: " + client.RemoteAddr().String())
 				return
 			}
-			// 如果是协议错误，返回错误回复
-			errReply := reply.MakeErrReply(payload.Err.Error())
-			err := client.Write(errReply.ToBytes()) // 写入错误回复
-			if err != nil {
-				h.closeClient(client) // 写入失败，关闭连接
+		}
+		if err != nil {
+			h.handleReadError(client, err)
+			return
+		}
+		// 客户端已经发送的命令都处理完之后再发送回复，管道中的多条命令的回复合并为一次写入
+		// 读取下一条命令可能阻塞时必须先发送回复
+		if !cmdReader.HasCommand() || client.Buffered() >= maxPendingOutput {
+			if err := client.Flush(); err != nil {
+				h.closeClient(client)
 				logger.Info("connection closed: " + client.RemoteAddr().String())
 				return
 			}
-			continue
 		}
+	}
+}
 
-		// 处理有效的请求数据
-		if payload.Data == nil {
-			// 如果负载数据为空，记录错误并跳过
-			logger.Error("empty payload")
-			continue
-		}
+// handleReadError 处理读取请求时的错误并关闭连接
+// 协议错误之后无法确定下一条命令从哪里开始，与 Redis 一样回复错误后关闭连接
+func (h *RespHandler) handleReadError(client *connection.Connection, err error) {
+	// 先发送已经执行的命令的回复
+	_ = client.Flush()
+	if protoErr, ok := err.(*parser.ProtocolError); ok {
+		_ = client.Write((&reply.ProtocolErrReply{Msg: protoErr.Msg}).ToBytes())
+	} else if err != io.EOF && err != io.ErrUnexpectedEOF &&
+		!strings.Contains(err.Error(), "use of closed network connection") {
+		logger.Warn("read request failed: " + err.Error())
+	}
+	h.closeClient(client)
+	logger.Info("connection closed: " + client.RemoteAddr().String())
+}
 
-		// 将负载数据转换为 MultiBulkReply 类型
-		r, ok := payload.Data.(*reply.MultiBulkReply)
-		if !ok {
-			// 如果无法转换为 MultiBulkReply 类型，记录错误并跳过
-			logger.Error("require multi bulk reply")
-			continue
+// drainPipeline 取出客户端已经发送、完整地读入了缓冲区的命令追加到 cmdLines，最多 maxPipeline 条
+func drainPipeline(cmdReader *parser.CommandReader, cmdLines []databaseface.CmdLine) ([]databaseface.CmdLine, error) {
+	for len(cmdLines) < maxPipeline && cmdReader.HasCommand() {
+		cmdLine, err := cmdReader.ReadCommand()
+		if err != nil {
+			return cmdLines, err
 		}
+		cmdLines = append(cmdLines, cmdLine)
+	}
+	return cmdLines, nil
+}
 
-		// 执行数据库操作
-		result := h.db.Exec(client, r.Args)
-		if result != nil {
-			// 如果有结果，写入到客户端
-			_ = client.Write(result.ToBytes())
-		} else {
-			// 如果没有结果，返回未知错误回复
-			_ = client.Write(unknownErrReplyBytes)
-		}
+// writeResult 将命令的结果按连接协商的协议版本编码后放入客户端的输出缓冲区
+// 超过输出缓冲区限制时返回 connection.ErrOutputLimit
+func writeResult(client *connection.Connection, result resp.Reply) error {
+	if result != nil {
+		// 如果有结果，写入到客户端
+		return client.Buffer(reply.Encode(result, client.Protocol()))
 	}
+	// 如果没有结果，返回未知错误回复
+	return client.Buffer(unknownErrReplyBytes)
 }
 
 // Close 停止处理器并关闭所有活动连接
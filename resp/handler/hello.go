@@ -0,0 +1,179 @@
+package handler
+
+/*
+ * 连接级别的命令：HELLO 和 AUTH
+ * 这两个命令只修改连接的状态（协议版本、认证状态、客户端名称），在所有模式下都由 handler 直接处理，不交给数据库
+ */
+
+import (
+	"crypto/subtle"
+	"goredis/config"
+	databaseface "goredis/interface/database"
+	"goredis/interface/resp"
+	"goredis/resp/connection"
+	"goredis/resp/reply"
+	"strconv"
+	"strings"
+)
+
+// serverVersion HELLO 回复中的服务器版本
+const serverVersion = "1.0.0"
+
+var (
+	noAuthReply    = reply.MakeErrReply("NOAUTH Authentication required.")
+	wrongPassReply = reply.MakeErrReply("WRONGPASS invalid username-password pair or user is disabled.")
+)
+
+// exec 按顺序执行一批命令，连接级别的命令由 handler 处理，其余命令交给数据库
+func (h *RespHandler) exec(client *connection.Connection, cmdLines []databaseface.CmdLine) []resp.Reply {
+	replies := make([]resp.Reply, 0, len(cmdLines))
+	start := 0 // 还没有交给数据库执行的第一条命令
+	for i, cmdLine := range cmdLines {
+		result, ok := h.execConnCommand(client, cmdLine)
+		if !ok {
+			continue
+		}
+		// 先执行前面的命令，保证同一个客户端的命令按顺序执行
+		replies = append(replies, h.execDB(client, cmdLines[start:i])...)
+		replies = append(replies, result)
+		start = i + 1
+	}
+	return append(replies, h.execDB(client, cmdLines[start:])...)
+}
+
+// execDB 将命令交给数据库执行，数据库支持批量执行时一起执行
+func (h *RespHandler) execDB(client *connection.Connection, cmdLines []databaseface.CmdLine) []resp.Reply {
+	if len(cmdLines) == 0 {
+		return nil
+	}
+	if batcher, ok := h.db.(databaseface.BatchExecutor); ok && len(cmdLines) > 1 {
+		return batcher.ExecBatch(client, cmdLines)
+	}
+	replies := make([]resp.Reply, len(cmdLines))
+	for i, cmdLine := range cmdLines {
+		replies[i] = h.db.Exec(client, cmdLine)
+	}
+	return replies
+}
+
+// execConnCommand 执行连接级别的命令，没有通过认证的连接执行其他命令时返回 NOAUTH 错误
+// 第二个返回值为 false 表示这条命令需要交给数据库执行
+func (h *RespHandler) execConnCommand(client *connection.Connection, cmdLine [][]byte) (resp.Reply, bool) {
+	switch strings.ToLower(string(cmdLine[0])) {
+	case "hello":
+		return h.execHello(client, cmdLine[1:]), true
+	case "auth":
+		return execAuth(client, cmdLine[1:]), true
+	}
+	if requireAuth(client) {
+		return noAuthReply, true
+	}
+	return nil, false
+}
+
+// requireAuth 配置了 requirepass 并且连接还没有通过认证
+func requireAuth(client *connection.Connection) bool {
+	return config.Properties.RequirePass != "" && !client.Authenticated()
+}
+
+// checkPassword 只支持 default 用户，比较密码的时间与密码的内容无关
+func checkPassword(username string, password string) bool {
+	return username == "default" &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(config.Properties.RequirePass)) == 1
+}
+
+// execAuth AUTH [username] password
+func execAuth(client *connection.Connection, args [][]byte) resp.Reply {
+	if len(args) != 1 && len(args) != 2 {
+		return reply.MakeArgNumErrReply("auth")
+	}
+	if config.Properties.RequirePass == "" {
+		return reply.MakeErrReply("ERR AUTH <password> called without any password configured for the default user. " +
+			"Are you sure your configuration is correct?")
+	}
+	username := "default"
+	if len(args) == 2 {
+		username = string(args[0])
+	}
+	if !checkPassword(username, string(args[len(args)-1])) {
+		client.SetAuthenticated(false)
+		return wrongPassReply
+	}
+	client.SetAuthenticated(true)
+	return reply.MakeOkReply()
+}
+
+// execHello HELLO [protover [AUTH username password] [SETNAME clientname]]
+// 切换连接使用的协议版本，回复服务器信息，回复按照新的协议版本编码
+func (h *RespHandler) execHello(client *connection.Connection, args [][]byte) resp.Reply {
+	protocol := client.Protocol()
+	if len(args) > 0 {
+		version, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			return reply.MakeErrReply("ERR Protocol version is not an integer or out of range")
+		}
+		if version != reply.Resp2 && version != reply.Resp3 {
+			return reply.MakeErrReply("NOPROTO unsupported protocol version")
+		}
+		protocol = version
+		args = args[1:]
+	}
+	var username, password, name string
+	var hasAuth, hasName bool
+	for len(args) > 0 {
+		option := strings.ToLower(string(args[0]))
+		switch {
+		case option == "auth" && len(args) >= 3:
+			username, password, hasAuth = string(args[1]), string(args[2]), true
+			args = args[3:]
+		case option == "setname" && len(args) >= 2:
+			name, hasName = string(args[1]), true
+			args = args[2:]
+		default:
+			return reply.MakeErrReply("ERR Syntax error in HELLO option '" + string(args[0]) + "'")
+		}
+	}
+	if hasAuth {
+		if config.Properties.RequirePass == "" || !checkPassword(username, password) {
+			return wrongPassReply
+		}
+		client.SetAuthenticated(true)
+	} else if requireAuth(client) {
+		return reply.MakeErrReply("NOAUTH HELLO must be called with the client already authenticated, " +
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+	if hasName {
+		if strings.ContainsAny(name, " \n") {
+			return reply.MakeErrReply("ERR Client names cannot contain spaces, newlines or special characters.")
+		}
+		client.SetName(name)
+	}
+	client.SetProtocol(protocol)
+
+	// 角色取决于数据库当前的复制状态，REPLICAOF 命令和故障转移之后与配置文件不同
+	role := "master"
+	if db, ok := h.db.(databaseface.Replicated); ok && db.IsReplica() {
+		role = "replica"
+	}
+	return reply.MakeMapReply().
+		AddString("server", reply.MakeBulkReply([]byte("goredis"))).
+		AddString("version", reply.MakeBulkReply([]byte(serverVersion))).
+		AddString("proto", reply.MakeIntReply(int64(protocol))).
+		AddString("id", reply.MakeIntReply(client.ID())).
+		AddString("mode", reply.MakeBulkReply([]byte(serverMode()))).
+		AddString("role", reply.MakeBulkReply([]byte(role))).
+		AddString("modules", &reply.EmptyMultiBulkReply{})
+}
+
+// serverMode HELLO 回复中的运行模式，与 MakeHandler 选择数据库的方式一致
+func serverMode() string {
+	switch {
+	case config.Properties.Sentinel:
+		return "sentinel"
+	case config.Properties.Proxy:
+		return "proxy"
+	case config.Properties.ClusterEnabled || (config.Properties.Self != "" && len(config.Properties.Peers) > 0):
+		return "cluster"
+	}
+	return "standalone"
+}
@@ -0,0 +1,277 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"goredis/config"
+	"io"
+)
+
+/*
+ * 同步读取客户端命令的解析器
+ * ParseStream 为每个连接启动一个 goroutine，通过 channel 逐条发送解析结果，每一行都会复制一次；
+ * CommandReader 由调用者在自己的 goroutine 中逐条读取命令，行直接在 bufio.Reader 的缓冲区中解析，
+ * 只为命令的参数分配内存（参数会被数据库保存，不能复用）
+ */
+
+const (
+	// maxMultiBulkLen 一条命令的最大参数个数
+	maxMultiBulkLen = 1024 * 1024
+	// maxLineLen 一行的最大长度，包括消息头和文本协议的命令
+	maxLineLen = maxInlineLen
+	// maxPreallocArgs 按照消息头中的参数个数预先分配的最大容量，避免一个很大的参数个数占用大量内存
+	maxPreallocArgs = 1024
+)
+
+// CommandReader 从 bufio.Reader 中逐条读取客户端发送的命令
+type CommandReader struct {
+	reader *bufio.Reader
+	line   []byte // 超过 bufio.Reader 缓冲区大小的行复制到这里，在多次读取之间复用
+	read   int64  // 已经读取的字节数
+
+	MaxBulkLen      int64 // 单个参数的最大长度
+	MaxMultiBulkLen int64 // 一条命令的最大参数个数
+	Inline          bool  // 是否接受文本协议
+	RejectEmpty     bool  // 为 true 时 *0 和 *-1 是格式错误，否则与 Redis 一样忽略
+}
+
+// NewCommandReader 创建 CommandReader，参数长度的限制来自 proto-max-bulk-len 配置
+func NewCommandReader(reader *bufio.Reader) *CommandReader {
+	return &CommandReader{
+		reader:          reader,
+		MaxBulkLen:      int64(config.Properties.ProtoMaxBulkLen),
+		MaxMultiBulkLen: maxMultiBulkLen,
+		Inline:          true,
+	}
+}
+
+// ReadCommand 读取下一条命令
+// 在两条命令之间遇到连接关闭时返回 io.EOF，在命令中间遇到时返回 io.ErrUnexpectedEOF，
+// 格式错误时返回 *ProtocolError，之后流中的位置不确定，调用者不应继续读取
+func (r *CommandReader) ReadCommand() ([][]byte, error) {
+	for {
+		line, err := r.readLine(false)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '*' {
+			if !r.Inline {
+				return nil, &ProtocolError{Msg: "expected '*', got " + quoteFirst(line)}
+			}
+			args, err := parseInlineCommand(line)
+			if err != nil {
+				return nil, err
+			}
+			if len(args) == 0 {
+				// 只有空白的行被忽略
+				continue
+			}
+			return args, nil
+		}
+		argc, ok := parseInt(line[1:])
+		if !ok || argc > r.MaxMultiBulkLen {
+			return nil, &ProtocolError{Msg: "invalid multibulk length"}
+		}
+		if argc <= 0 {
+			if r.RejectEmpty {
+				return nil, &ProtocolError{Msg: "empty multibulk"}
+			}
+			// 与 Redis 一样忽略空的命令
+			continue
+		}
+		return r.readArgs(int(argc))
+	}
+}
+
+// readArgs 读取命令的 argc 个参数
+func (r *CommandReader) readArgs(argc int) ([][]byte, error) {
+	args := make([][]byte, 0, min(argc, maxPreallocArgs))
+	for i := 0; i < argc; i++ {
+		line, err := r.readLine(true)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, &ProtocolError{Msg: "expected '$', got " + quoteFirst(line)}
+		}
+		bulkLen, ok := parseInt(line[1:])
+		if !ok || bulkLen < 0 || bulkLen > r.MaxBulkLen {
+			return nil, &ProtocolError{Msg: "invalid bulk length"}
+		}
+		// 参数的内存随着数据到达分配，只发送消息头的连接不会占用 proto-max-bulk-len 大小的内存
+		arg, err := readBody(r.reader, bulkLen)
+		r.read += int64(len(arg))
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if err := r.readCRLF(); err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// readLine 读取一行并去掉结尾的 \r\n（文本协议可以只有 \n），返回的切片在下一次读取之前有效
+// inCommand 表示正在读取一条命令的中间部分，此时遇到 EOF 返回 io.ErrUnexpectedEOF
+func (r *CommandReader) readLine(inCommand bool) ([]byte, error) {
+	line, err := r.reader.ReadSlice('\n')
+	r.read += int64(len(line))
+	if err == bufio.ErrBufferFull {
+		// 行比缓冲区长，复制到 r.line 中继续读取
+		r.line = append(r.line[:0], line...)
+		for err == bufio.ErrBufferFull {
+			if len(r.line) > maxLineLen {
+				return nil, lineTooBig(r.line, inCommand)
+			}
+			line, err = r.reader.ReadSlice('\n')
+			r.read += int64(len(line))
+			r.line = append(r.line, line...)
+		}
+		line = r.line
+	}
+	if err != nil {
+		if err == io.EOF && (inCommand || len(line) > 0) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if len(line) > maxLineLen {
+		return nil, lineTooBig(line, inCommand)
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		return line[:len(line)-1], nil
+	}
+	// 与 Redis 一样，文本协议的命令可以只以 \n 结尾，例如 nc 发送的命令
+	if !inCommand && r.Inline && (len(line) == 0 || line[0] != '*') {
+		return line, nil
+	}
+	return nil, &ProtocolError{Msg: "line is not terminated by CRLF"}
+}
+
+// lineTooBig 一行超过长度限制时的错误，文本协议的命令只有一行，限制为 maxInlineLen
+func lineTooBig(line []byte, inCommand bool) error {
+	switch {
+	case inCommand:
+		return &ProtocolError{Msg: "too big bulk count string"}
+	case line[0] == '*':
+		return &ProtocolError{Msg: "too big mbulk count string"}
+	}
+	return &ProtocolError{Msg: "too big inline request"}
+}
+
+// quoteFirst 错误信息中显示的行首字符
+func quoteFirst(line []byte) string {
+	if len(line) == 0 {
+		return "empty line"
+	}
+	return "'" + string(line[0]) + "'"
+}
+
+// readCRLF 读取参数之后的 \r\n
+func (r *CommandReader) readCRLF() error {
+	for _, expected := range []byte{'\r', '\n'} {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		r.read++
+		if b != expected {
+			return &ProtocolError{Msg: "bulk string is not terminated by CRLF"}
+		}
+	}
+	return nil
+}
+
+// Offset 返回已经读取的字节数，在 ReadCommand 成功返回后等于最后一条命令结束的位置
+func (r *CommandReader) Offset() int64 {
+	return r.read
+}
+
+// Buffered 返回已经读入缓冲区、还没有解析的字节数
+func (r *CommandReader) Buffered() int {
+	return r.reader.Buffered()
+}
+
+// HasCommand 缓冲区中是否已经有一条完整的命令，为 true 时 ReadCommand 不会阻塞
+// 只检查消息头和参数长度，不解析参数；格式错误时也返回 true，由 ReadCommand 返回错误
+func (r *CommandReader) HasCommand() bool {
+	buf, _ := r.reader.Peek(r.reader.Buffered())
+	for len(buf) > 0 {
+		end := bytes.IndexByte(buf, '\n')
+		if end < 0 {
+			return false
+		}
+		line := bytes.TrimRight(buf[:end], "\r")
+		buf = buf[end+1:]
+		if len(line) == 0 || line[0] != '*' {
+			if len(bytes.TrimSpace(line)) == 0 && r.Inline {
+				// 空行被忽略，继续检查下一行
+				continue
+			}
+			return true
+		}
+		argc, ok := parseInt(line[1:])
+		if !ok || argc > r.MaxMultiBulkLen {
+			return true
+		}
+		if argc <= 0 {
+			if r.RejectEmpty {
+				return true
+			}
+			continue
+		}
+		for i := int64(0); i < argc; i++ {
+			end = bytes.IndexByte(buf, '\n')
+			if end < 0 {
+				return false
+			}
+			header := bytes.TrimRight(buf[:end], "\r")
+			if len(header) == 0 || header[0] != '$' {
+				return true
+			}
+			bulkLen, ok := parseInt(header[1:])
+			if !ok || bulkLen < 0 || bulkLen > r.MaxBulkLen {
+				return true
+			}
+			if int64(len(buf)-end-1) < bulkLen+2 {
+				return false
+			}
+			buf = buf[int64(end+1)+bulkLen+2:]
+		}
+		return true
+	}
+	return false
+}
+
+// unexpectedEOF 命令中间的 EOF 转换为 io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// parseInt 解析十进制整数，不需要先转换为 string
+func parseInt(b []byte) (int64, bool) {
+	negative := len(b) > 0 && b[0] == '-'
+	if negative {
+		b = b[1:]
+	}
+	// 最多 18 位，不会溢出
+	if len(b) == 0 || len(b) > 18 {
+		return 0, false
+	}
+	var n int64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
+	}
+	if negative {
+		n = -n
+	}
+	return n, true
+}
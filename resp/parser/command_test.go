@@ -0,0 +1,103 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"goredis/lib/utils"
+	"goredis/resp/reply"
+	"io"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// pipelinedCommands 生成客户端通过管道发送的 n 条 SET 命令
+func pipelinedCommands(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		key := "key:" + strconv.Itoa(i)
+		buf.Write(reply.MakeMultiBulkReply(utils.ToCmdLine("SET", key, "value-"+key)).ToBytes())
+	}
+	return buf.Bytes()
+}
+
+const benchCommands = 1000
+
+// BenchmarkCommandReader 每条命令只分配参数列表和每个参数，ParseStream 还要为每一行、每条 Payload 和 channel 分配内存
+func BenchmarkCommandReader(b *testing.B) {
+	input := pipelinedCommands(benchCommands)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cmdReader := NewCommandReader(bufio.NewReader(bytes.NewReader(input)))
+		count := 0
+		for {
+			_, err := cmdReader.ReadCommand()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			count++
+		}
+		if count != benchCommands {
+			b.Fatalf("expect %d commands, got %d", benchCommands, count)
+		}
+	}
+}
+
+func BenchmarkParseStream(b *testing.B) {
+	input := pipelinedCommands(benchCommands)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		count := 0
+		for payload := range ParseStream(bytes.NewReader(input)) {
+			if payload.Err == io.EOF {
+				break
+			}
+			if payload.Err != nil {
+				b.Fatal(payload.Err)
+			}
+			count++
+		}
+		if count != benchCommands {
+			b.Fatalf("expect %d commands, got %d", benchCommands, count)
+		}
+	}
+}
+
+// TestCommandReaderLargeBulkHeader 只发送参数长度的消息头时不会预先分配整个参数，连接关闭时返回 io.ErrUnexpectedEOF
+func TestCommandReaderLargeBulkHeader(t *testing.T) {
+	input := []byte("*1\r\n$536870912\r\nabc")
+	cmdReader := NewCommandReader(bufio.NewReader(bytes.NewReader(input)))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := cmdReader.ReadCommand(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expect ErrUnexpectedEOF, got %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("expect at most 1MB allocated before the data arrives, got %d bytes", allocated)
+	}
+}
+
+// TestCommandReaderRejectEmpty AOF 文件和复制流使用 RejectEmpty，空命令是格式错误
+func TestCommandReaderRejectEmpty(t *testing.T) {
+	for _, input := range []string{"*0\r\n", "*-1\r\n"} {
+		cmdReader := NewCommandReader(bufio.NewReader(bytes.NewReader([]byte(input))))
+		if _, err := cmdReader.ReadCommand(); err != io.EOF {
+			t.Errorf("%q: expect empty command to be skipped, got %v", input, err)
+		}
+		cmdReader = NewCommandReader(bufio.NewReader(bytes.NewReader([]byte(input))))
+		cmdReader.RejectEmpty = true
+		if _, err := cmdReader.ReadCommand(); err == nil {
+			t.Errorf("%q: expect protocol error", input)
+		} else if _, ok := err.(*ProtocolError); !ok {
+			t.Errorf("%q: expect protocol error, got %v", input, err)
+		}
+	}
+}
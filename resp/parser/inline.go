@@ -0,0 +1,132 @@
+package parser
+
+/*
+ * 文本协议（inline command），例如通过 telnet 或 nc 发送的 SET key "hello world"
+ * 与 Redis 的 sdssplitargs 相同：参数之间可以有任意多个空白字符，
+ * 双引号中支持 \n \r \t \b \a \xHH 等转义，单引号中只有 \' 表示单引号，其他字符原样保留
+ */
+
+// maxInlineLen 文本协议一行的最大长度
+const maxInlineLen = 64 * 1024
+
+// parseInlineCommand 将一行文本拆分为命令的参数，引号不配对时返回协议错误
+// 返回的参数不引用 line 的内存
+func parseInlineCommand(line []byte) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		// 跳过参数之间的空白
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		var arg []byte
+		inDouble, inSingle := false, false
+		for done := false; !done; {
+			switch {
+			case inDouble:
+				if i == len(line) {
+					return nil, errUnbalancedQuotes
+				}
+				c := line[i]
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					arg = append(arg, hexValue(line[i+2])<<4|hexValue(line[i+3]))
+					i += 3
+				} else if c == '\\' && i+1 < len(line) {
+					i++
+					arg = append(arg, unescape(line[i]))
+				} else if c == '"' {
+					// 右引号之后必须是空白或者行尾
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			case inSingle:
+				if i == len(line) {
+					return nil, errUnbalancedQuotes
+				}
+				c := line[i]
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					arg = append(arg, '\'')
+				} else if c == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			default:
+				if i == len(line) {
+					done = true
+					break
+				}
+				switch c := line[i]; c {
+				case ' ', '\n', '\r', '\t', '\v', '\f':
+					done = true
+				case '"':
+					inDouble = true
+				case '\'':
+					inSingle = true
+				default:
+					arg = append(arg, c)
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		if arg == nil {
+			// "" 或者 '' 是空字符串参数
+			arg = []byte{}
+		}
+		args = append(args, arg)
+	}
+}
+
+var errUnbalancedQuotes = &ProtocolError{Msg: "unbalanced quotes in request"}
+
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\n', '\r', '\t', '\v', '\f':
+		return true
+	}
+	return false
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexValue(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
+
+// unescape 双引号中 \ 之后的字符
+func unescape(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	}
+	return c
+}
@@ -0,0 +1,89 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestParseInlineCommand 文本协议的参数拆分与 Redis 的 sdssplitargs 相同
+func TestParseInlineCommand(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		expect []string
+		err    bool
+	}{
+		{name: "quoted", line: `SET k "hello world"`, expect: []string{"SET", "k", "hello world"}},
+		{name: "whitespace", line: " \t SET   k\t\tv  ", expect: []string{"SET", "k", "v"}},
+		{name: "blank", line: "   ", expect: nil},
+		{name: "empty double quotes", line: `SET k ""`, expect: []string{"SET", "k", ""}},
+		{name: "empty single quotes", line: `SET '' v`, expect: []string{"SET", "", "v"}},
+		{name: "hex escape", line: `SET k "\x41\x6a\xFF"`, expect: []string{"SET", "k", "Aj\xff"}},
+		{name: "invalid hex escape", line: `SET k "\xZZ"`, expect: []string{"SET", "k", "xZZ"}},
+		{name: "newline escape", line: `SET k "a\nb\tc\\d\"e"`, expect: []string{"SET", "k", "a\nb\tc\\d\"e"}},
+		{name: "single quote escape", line: `SET k 'it\'s'`, expect: []string{"SET", "k", "it's"}},
+		{name: "no escape in single quotes", line: `SET k 'a\nb'`, expect: []string{"SET", "k", `a\nb`}},
+		{name: "quotes inside arg", line: `SET k a"b c"`, expect: []string{"SET", "k", "ab c"}},
+		{name: "double quote followed by char", line: `SET k "a"b`, err: true},
+		{name: "single quote followed by char", line: `SET k 'a'b`, err: true},
+		{name: "unbalanced double quote", line: `SET k "abc`, err: true},
+		{name: "unbalanced single quote", line: `SET k 'abc`, err: true},
+		{name: "trailing backslash", line: `SET k "abc\`, err: true},
+	}
+	for _, tt := range tests {
+		args, err := parseInlineCommand([]byte(tt.line))
+		if tt.err {
+			if _, ok := err.(*ProtocolError); !ok {
+				t.Errorf("%s: expect protocol error, got %q, %v", tt.name, args, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, arg := range args {
+			got = append(got, string(arg))
+		}
+		if !reflect.DeepEqual(got, tt.expect) {
+			t.Errorf("%s: expect %q, got %q", tt.name, tt.expect, got)
+		}
+	}
+}
+
+// TestInlineCommandTooBig 超过 maxInlineLen 的文本协议命令返回协议错误
+func TestInlineCommandTooBig(t *testing.T) {
+	for _, test := range []struct {
+		length int
+		ok     bool
+	}{
+		{length: maxInlineLen - 100, ok: true},
+		{length: maxInlineLen + 1, ok: false},
+		{length: 4 * maxInlineLen, ok: false},
+	} {
+		line := "SET k " + strings.Repeat("a", test.length-len("SET k ")) + "\r\n"
+		args, err := NewCommandReader(bufio.NewReader(strings.NewReader(line))).ReadCommand()
+		if test.ok {
+			if err != nil || len(args) != 3 {
+				t.Errorf("length %d: expect 3 args, got %d, %v", test.length, len(args), err)
+			}
+		} else if protoErr, ok := err.(*ProtocolError); !ok || protoErr.Msg != "too big inline request" {
+			t.Errorf("length %d: expect too big inline request, got %v", test.length, err)
+		}
+
+		var last error
+		for payload := range ParseStream(bytes.NewReader([]byte(line))) {
+			if payload.Err != nil {
+				last = payload.Err
+				break
+			}
+		}
+		if _, ok := last.(*ProtocolError); ok == test.ok {
+			t.Errorf("length %d: ParseStream returned %v", test.length, last)
+		}
+	}
+}
@@ -2,14 +2,26 @@ package parser
 
 import (
 	"bufio"
-	"errors"
+	"fmt"
+	"goredis/config"
 	"goredis/interface/resp"
 	"goredis/lib/logger"
 	"goredis/resp/reply"
 	"io"
+	"math"
+	"math/big"
 	"runtime/debug"
+	"slices"
 	"strconv"
-	"strings"
+)
+
+const (
+	// maxAggregateLen 聚合类型的最大元素个数，回复可能很大（如 KEYS），只用来拒绝明显错误的长度
+	maxAggregateLen = math.MaxInt32
+	// maxPreallocItems 按照消息头中的元素个数预先分配的最大容量，更多的元素在实际读到时再扩容
+	maxPreallocItems = 1024
+	// maxPreallocBulk 按照消息头中的长度预先分配的最大字节数，更多的内容在实际读到时再扩容
+	maxPreallocBulk = 64 * 1024
 )
 
 // Payload 用于封装解析结果，包含解析的回复数据和错误信息
@@ -25,246 +37,297 @@ func ParseStream(reader io.Reader) <-chan *Payload {
 	return ch
 }
 
-// readState 记录解析的状态信息
-type readState struct {
-	readingMultiLine  bool     // 是否正在解析多行数据
-	expectedArgsCount int      // 当前预期的参数个数
-	msgType           byte     // 消息类型
-	args              [][]byte // 消息参数
-	bulkLen           int64    // bulk 数据的长度
+// ProtocolError 协议错误，ParseStream 出现协议错误后跳过这一行继续解析，IO 错误则结束解析
+type ProtocolError struct {
+	Msg string
 }
 
-// finished 判断解析是否完成
-func (s *readState) finished() bool {
-	return s.expectedArgsCount > 0 && len(s.args) == s.expectedArgsCount
+func (e *ProtocolError) Error() string {
+	return "protocol error: " + e.Msg
 }
 
-// parseScore 解析从客户端传来的请求
+// parseScore 解析从客户端传来的请求或者服务端发送的回复
 func parseScore(reader io.Reader, ch chan<- *Payload) {
 	defer func() {
 		if err := recover(); err != nil {
 			logger.Error(string(debug.Stack())) // 出现异常时记录堆栈
+			// 通知调用者解析已经结束，否则调用者会一直等待
+			ch <- &Payload{
+				Err: fmt.Errorf("parser panic: %v", err),
+			}
+			close(ch)
 		}
 	}()
 	bufReader := bufio.NewReader(reader)
-	var state readState
-	var err error
-	var msg []byte
 	for {
-		var ioErr bool
-		// 读取一行数据
-		msg, ioErr, err = readLine(bufReader, &state)
+		result, err := readReply(bufReader, true)
 		if err != nil {
-			// 如果是 IO 错误，则发送错误并关闭通道
-			if ioErr {
-				ch <- &Payload{
-					Err: err,
-				}
-				close(ch)
-				return
-			}
-			// 如果是协议错误，则重新读取状态
 			ch <- &Payload{
 				Err: err,
 			}
-			state = readState{}
+			if _, ok := err.(*ProtocolError); !ok {
+				// IO 错误，关闭通道
+				close(ch)
+				return
+			}
 			continue
 		}
-
-		// 解析读取的行
-		if !state.readingMultiLine {
-			// 如果是多行消息，则解析多行
-			if msg[0] == '*' {
-				err = parseMultiBulkHeader(msg, &state)
-				if err != nil {
-					ch <- &Payload{
-						Err: errors.New("protocol error: " + string(msg)),
-					}
-					state = readState{} // 重新设置状态
-					continue
-				}
-				// 如果预期参数个数为0，返回空的多条消息
-				if state.expectedArgsCount == 0 {
-					ch <- &Payload{
-						Data: &reply.EmptyMultiBulkReply{},
-					}
-					state = readState{}
-					continue
-				}
-			} else if msg[0] == '$' { // 如果是单条回复，解析单条消息头
-				err = parseBulkHeader(msg, &state)
-				if err != nil {
-					ch <- &Payload{
-						Err: errors.New("protocol error: " + string(msg)),
-					}
-					state = readState{}
-					continue
-				}
-				// 如果 bulkLen 为-1，说明为空的回复
-				if state.bulkLen == -1 {
-					ch <- &Payload{
-						Data: &reply.NullBulkReply{},
-					}
-					state = readState{}
-					continue
-				}
-			} else {
-				// 如果是单行回复，直接解析
-				result, err := parseSingleLineReply(msg)
-				ch <- &Payload{
-					Data: result,
-					Err:  err,
-				}
-				state = readState{}
-				continue
-			}
-		} else {
-			// 如果正在解析多行消息体，则读取消息体
-			err = readBody(msg, &state)
-			if err != nil {
-				ch <- &Payload{
-					Err: errors.New("protocol error: " + string(msg)),
-				}
-				state = readState{}
-				continue
-			}
-			// 如果所有参数都已经读取完成
-			if state.finished() {
-				var result resp.Reply
-				// 如果是多条消息
-				if state.msgType == '*' {
-					result = reply.MakeMultiBulkReply(state.args)
-				} else if state.msgType == '$' {
-					// 如果是单条消息
-					result = reply.MakeBulkReply(state.args[0])
-				}
-				ch <- &Payload{
-					Data: result,
-					Err:  err,
-				}
-				state = readState{}
-			}
+		ch <- &Payload{
+			Data: result,
 		}
 	}
 }
 
-// readLine 从 bufio.Reader 中读取一行数据
-func readLine(bufReader *bufio.Reader, state *readState) ([]byte, bool, error) {
-	var msg []byte
-	var err error
-	// 如果当前没有读取剩余的 bulk 数据，则正常读取一行
-	if state.bulkLen == 0 {
-		msg, err = bufReader.ReadBytes('\n')
+// readLine 读取以 \r\n 结尾的一行，返回的内容不包含 \r\n
+func readLine(bufReader *bufio.Reader) ([]byte, error) {
+	msg, err := bufReader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	// 如果行结尾没有 \r\n，则是协议错误
+	if len(msg) < 2 || msg[len(msg)-2] != '\r' {
+		return nil, &ProtocolError{Msg: string(msg)}
+	}
+	return msg[:len(msg)-2], nil
+}
+
+// readReply 递归地读取一条完整的 RESP2/RESP3 消息，聚合类型的元素可以是任意类型，包括嵌套的聚合类型
+// inline 为 true 时允许不以类型前缀开头的文本协议，只有最外层的消息可以是文本协议
+func readReply(bufReader *bufio.Reader, inline bool) (resp.Reply, error) {
+	msg, err := readLine(bufReader)
+	// 文本协议中的空行被忽略
+	for err == nil && inline && len(msg) == 0 {
+		msg, err = readLine(bufReader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) == 0 {
+		return nil, &ProtocolError{Msg: "empty line"}
+	}
+	switch msg[0] {
+	case '$': // 批量字符串
+		body, err := readBulk(bufReader, msg)
 		if err != nil {
-			return nil, true, err
+			return nil, err
+		}
+		if body == nil {
+			return &reply.NullBulkReply{}, nil
+		}
+		return reply.MakeBulkReply(body), nil
+	case '!': // RESP3 批量错误
+		body, err := readBulk(bufReader, msg)
+		if err != nil || body == nil {
+			return nil, &ProtocolError{Msg: string(msg)}
 		}
-		// 如果行结尾没有 \r\n，则是协议错误
-		if len(msg) == 0 || msg[len(msg)-2] != '\r' {
-			return nil, false, errors.New("protocol error: " + string(msg))
+		return reply.MakeErrReply(string(body)), nil
+	case '=': // RESP3 verbatim string，格式为 fmt:text
+		body, err := readBulk(bufReader, msg)
+		if err != nil || len(body) < 4 || body[3] != ':' {
+			return nil, &ProtocolError{Msg: string(msg)}
 		}
-	} else {
-		// 如果正在读取 bulk 数据，则按指定长度读取
-		msg = make([]byte, state.bulkLen+2)
-		_, err = io.ReadFull(bufReader, msg)
+		return reply.MakeVerbatimReply(string(body[:3]), body[4:]), nil
+	case '*': // 数组
+		items, err := readAggregate(bufReader, msg, 1)
 		if err != nil {
-			return nil, true, err
+			return nil, err
 		}
-		// 检查行结尾是否符合协议
-		if len(msg) == 0 ||
-			msg[len(msg)-2] != '\r' ||
-			msg[len(msg)-1] != '\n' {
-			return nil, false, errors.New("protocol error: " + string(msg))
+		return makeArrayReply(items), nil
+	case '%': // RESP3 map
+		items, err := readAggregate(bufReader, msg, 2)
+		if err != nil || items == nil {
+			return nil, &ProtocolError{Msg: string(msg)}
 		}
-		state.bulkLen = 0
+		return makeMapReply(items), nil
+	case '~': // RESP3 set
+		items, err := readAggregate(bufReader, msg, 1)
+		if err != nil || items == nil {
+			return nil, &ProtocolError{Msg: string(msg)}
+		}
+		return reply.MakeSetReply(items), nil
+	case '>': // RESP3 push
+		items, err := readAggregate(bufReader, msg, 1)
+		if err != nil || items == nil {
+			return nil, &ProtocolError{Msg: string(msg)}
+		}
+		return reply.MakePushReply(items), nil
+	case '|': // RESP3 属性，之后紧跟着属性所描述的回复
+		items, err := readAggregate(bufReader, msg, 2)
+		if err != nil || items == nil {
+			return nil, &ProtocolError{Msg: string(msg)}
+		}
+		ret, err := readReply(bufReader, false)
+		if err != nil {
+			return nil, err
+		}
+		return reply.MakeAttributeReply(makeMapReply(items), ret), nil
+	case '+', '-', ':', '_', ',', '#', '(':
+		return parseSingleLineReply(msg)
+	}
+	if !inline {
+		return nil, &ProtocolError{Msg: string(msg)}
 	}
-	return msg, false, nil
+	if len(msg) > maxInlineLen {
+		return nil, &ProtocolError{Msg: "too big inline request"}
+	}
+	args, err := parseInlineCommand(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		// 只有空白的行被忽略
+		return readReply(bufReader, inline)
+	}
+	return reply.MakeMultiBulkReply(args), nil
+}
+
+// parseLength 解析消息头中的长度，-1 表示空值
+func parseLength(msg []byte) (int64, error) {
+	length, err := strconv.ParseInt(string(msg[1:]), 10, 64)
+	if err != nil || length < -1 {
+		return 0, &ProtocolError{Msg: string(msg)}
+	}
+	return length, nil
 }
 
-// parseMultiBulkHeader 解析多条消息头
-func parseMultiBulkHeader(msg []byte, state *readState) error {
-	var err error
-	var expectedLine uint64
-	// 解析出预期的参数个数
-	expectedLine, err = strconv.ParseUint(string(msg[1:len(msg)-2]), 10, 32)
+// readBulk 读取批量字符串的内容，长度为 -1 时返回 nil，长度为 0 时返回空切片
+// 长度不能超过 proto-max-bulk-len
+func readBulk(bufReader *bufio.Reader, msg []byte) ([]byte, error) {
+	length, err := parseLength(msg)
+	if err != nil {
+		return nil, err
+	}
+	if length == -1 {
+		return nil, nil
+	}
+	if length > int64(config.Properties.ProtoMaxBulkLen) {
+		return nil, &ProtocolError{Msg: "invalid bulk length"}
+	}
+	body, err := readBody(bufReader, length)
 	if err != nil {
-		return errors.New("protocol error: " + string(msg))
+		return nil, err
 	}
-	if expectedLine == 0 {
-		state.expectedArgsCount = 0
-		return nil
-	} else if expectedLine > 0 {
-		state.msgType = msg[0]
-		state.readingMultiLine = true
-		state.expectedArgsCount = int(expectedLine)
-		state.args = make([][]byte, 0, expectedLine)
-		return nil
-	} else {
-		return errors.New("protocol error: " + string(msg))
+	// 检查内容之后是否是 \r\n
+	var crlf [2]byte
+	if _, err := io.ReadFull(bufReader, crlf[:]); err != nil {
+		return nil, err
 	}
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		return nil, &ProtocolError{Msg: "invalid bulk string terminator"}
+	}
+	return body, nil
+}
+
+// readBody 读取 length 字节，最多预先分配 maxPreallocBulk 字节，之后随着数据到达成倍扩容，
+// 消息头中声明的长度很大但数据没有到达时不会占用大量内存；出错时返回已经读取的部分
+func readBody(reader io.Reader, length int64) ([]byte, error) {
+	body := make([]byte, 0, min(length, maxPreallocBulk))
+	for int64(len(body)) < length {
+		if len(body) == cap(body) {
+			body = slices.Grow(body, int(min(length-int64(len(body)), int64(len(body)))))
+		}
+		end := int(min(int64(cap(body)), length))
+		n, err := io.ReadFull(reader, body[len(body):end])
+		body = body[:len(body)+n]
+		if err != nil {
+			return body, err
+		}
+	}
+	return body, nil
 }
 
-// parseBulkHeader 解析单条消息头
-func parseBulkHeader(msg []byte, state *readState) error {
-	var err error
-	state.bulkLen, err = strconv.ParseInt(string(msg[1:len(msg)-2]), 10, 64)
+// readAggregate 读取聚合类型的所有元素，元素个数是消息头中的数量乘以 width（map 和属性为 2）
+// 数量为 -1 时返回 nil，数量为 0 时返回空切片
+func readAggregate(bufReader *bufio.Reader, msg []byte, width int) ([]resp.Reply, error) {
+	length, err := parseLength(msg)
 	if err != nil {
-		return errors.New("protocol error: " + string(msg))
+		return nil, err
+	}
+	if length == -1 {
+		return nil, nil
 	}
-	if state.bulkLen == -1 {
-		return nil // 如果是空的 bulk 数据，则直接返回
-	} else if state.bulkLen > 0 {
-		state.msgType = msg[0]
-		state.readingMultiLine = true
-		state.expectedArgsCount = 1
-		state.args = make([][]byte, 0, 1)
-		return nil
-	} else {
-		return errors.New("protocol error: " + string(msg))
+	if length > maxAggregateLen {
+		return nil, &ProtocolError{Msg: "invalid multibulk length"}
 	}
+	count := int(length) * width
+	items := make([]resp.Reply, 0, min(count, maxPreallocItems))
+	for i := 0; i < count; i++ {
+		item, err := readReply(bufReader, false)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// makeArrayReply 元素都是批量字符串时返回 MultiBulkReply（客户端发送的命令都是这种形式），否则返回 MultiRawReply
+func makeArrayReply(items []resp.Reply) resp.Reply {
+	if items == nil {
+		return &reply.NullMultiBulkReply{}
+	}
+	if len(items) == 0 {
+		return &reply.EmptyMultiBulkReply{}
+	}
+	args := make([][]byte, len(items))
+	for i, item := range items {
+		switch item := item.(type) {
+		case *reply.BulkReply:
+			args[i] = item.Arg
+		case *reply.NullBulkReply:
+			args[i] = nil
+		default:
+			return reply.MakeMultiRawReply(items)
+		}
+	}
+	return reply.MakeMultiBulkReply(args)
+}
+
+// makeMapReply 将键值交替排列的元素转换为 MapReply
+func makeMapReply(items []resp.Reply) *reply.MapReply {
+	result := reply.MakeMapReply()
+	for i := 0; i+1 < len(items); i += 2 {
+		result.Add(items[i], items[i+1])
+	}
+	return result
 }
 
 // parseSingleLineReply 解析单行回复
 func parseSingleLineReply(msg []byte) (resp.Reply, error) {
-	str := strings.TrimSuffix(string(msg), "\r\n")
-	var result resp.Reply
+	str := string(msg[1:])
 	switch msg[0] {
-	case '+': // 状态恢复
-		result = reply.MakeStatusReply(str[1:])
+	case '+': // 状态回复
+		return reply.MakeStatusReply(str), nil
 	case '-': // 错误回复
-		result = reply.MakeErrReply(str[1:])
+		return reply.MakeErrReply(str), nil
 	case ':':
-		val, err := strconv.ParseInt(str[1:], 10, 64)
+		val, err := strconv.ParseInt(str, 10, 64)
 		if err != nil {
-			return nil, errors.New("protocol error: " + string(msg))
+			return nil, &ProtocolError{Msg: string(msg)}
 		}
-		result = reply.MakeIntReply(val)
-	default:
-		// 解析文本协议
-		strs := strings.Split(str, " ")
-		args := make([][]byte, len(strs))
-		for i, s := range strs {
-			args[i] = []byte(s)
+		return reply.MakeIntReply(val), nil
+	case '_': // RESP3 空值
+		if len(str) != 0 {
+			return nil, &ProtocolError{Msg: string(msg)}
 		}
-		result = reply.MakeMultiBulkReply(args)
-	}
-	return result, nil
-}
-
-// readBody 解析消息体
-func readBody(msg []byte, state *readState) error {
-	line := msg[0 : len(msg)-2]
-	var err error
-	if line[0] == '$' {
-		state.bulkLen, err = strconv.ParseInt(string(line[1:]), 10, 64)
+		return reply.MakeNullReply(), nil
+	case ',': // RESP3 浮点数
+		val, err := strconv.ParseFloat(str, 64)
 		if err != nil {
-			return errors.New("protocol error: " + string(msg))
+			return nil, &ProtocolError{Msg: string(msg)}
+		}
+		return reply.MakeDoubleReply(val), nil
+	case '#': // RESP3 布尔值
+		if str != "t" && str != "f" {
+			return nil, &ProtocolError{Msg: string(msg)}
 		}
-		if state.bulkLen <= 0 {
-			state.args = append(state.args, []byte{})
-			state.bulkLen = 0
+		return reply.MakeBooleanReply(str == "t"), nil
+	case '(': // RESP3 大整数
+		val, ok := new(big.Int).SetString(str, 10)
+		if !ok {
+			return nil, &ProtocolError{Msg: string(msg)}
 		}
-	} else {
-		state.args = append(state.args, line)
+		return reply.MakeBigNumberReply(val), nil
 	}
-	return nil
+	return nil, &ProtocolError{Msg: string(msg)}
 }
@@ -0,0 +1,43 @@
+package parser
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// TestParseStreamHugeLength 消息头中过大的长度返回协议错误，不会按照声明的长度分配内存
+func TestParseStreamHugeLength(t *testing.T) {
+	for _, input := range []string{
+		"$9223372036854775807\r\n",
+		"$536870913\r\n",
+		"*9223372036854775807\r\n",
+		"%4611686018427387904\r\n",
+	} {
+		var errs []error
+		for payload := range ParseStream(bytes.NewReader([]byte(input))) {
+			errs = append(errs, payload.Err)
+		}
+		if len(errs) == 0 {
+			t.Fatalf("%q: no payload", input)
+		}
+		if _, ok := errs[0].(*ProtocolError); !ok {
+			t.Errorf("%q: expect protocol error, got %v", input, errs[0])
+		}
+		if errs[len(errs)-1] != io.EOF {
+			t.Errorf("%q: expect stream to end with EOF, got %v", input, errs[len(errs)-1])
+		}
+	}
+}
+
+// TestParseStreamLargeAggregate 元素个数很大但数据不完整时读到 EOF 结束，不会预先分配所有元素
+func TestParseStreamLargeAggregate(t *testing.T) {
+	input := []byte("*100000000\r\n$1\r\na\r\n")
+	var last error
+	for payload := range ParseStream(bytes.NewReader(input)) {
+		last = payload.Err
+	}
+	if last != io.EOF {
+		t.Errorf("expect EOF, got %v", last)
+	}
+}
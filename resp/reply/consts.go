@@ -37,6 +37,10 @@ func (r *NullBulkReply) ToBytes() []byte {
 	return nullBulkBytes
 }
 
+func (r *NullBulkReply) ToResp3Bytes() []byte {
+	return resp3NullBytes
+}
+
 func MakeNullBulkReply() *NullBulkReply {
 	return &NullBulkReply{}
 }
@@ -56,3 +60,16 @@ var noBytes = []byte("")
 func (r *NoReply) ToBytes() []byte {
 	return noBytes
 }
+
+var nullMultiBulkBytes = []byte("*-1\r\n") // 空数组，注：不是长度为 0 的数组
+
+// NullMultiBulkReply 不存在的数组，例如被 WATCH 的键修改后 EXEC 的回复
+type NullMultiBulkReply struct{}
+
+func (r *NullMultiBulkReply) ToBytes() []byte {
+	return nullMultiBulkBytes
+}
+
+func (r *NullMultiBulkReply) ToResp3Bytes() []byte {
+	return resp3NullBytes
+}
@@ -9,8 +9,7 @@ import (
 // 自定义回复
 
 var (
-	nullBulkReplyBytes = []byte("$-1")
-	CRLF               = "\r\n"
+	CRLF = "\r\n"
 )
 
 /* ---- Bulk Reply ---- */
@@ -27,12 +26,19 @@ func MakeBulkReply(arg []byte) *BulkReply {
 }
 
 func (r *BulkReply) ToBytes() []byte {
-	if len(r.Arg) == 0 {
-		return nullBulkReplyBytes
+	if r.Arg == nil {
+		return nullBulkBytes
 	}
 	return []byte("$" + strconv.Itoa(len(r.Arg)) + CRLF + string(r.Arg) + CRLF)
 }
 
+func (r *BulkReply) ToResp3Bytes() []byte {
+	if r.Arg == nil {
+		return resp3NullBytes
+	}
+	return r.ToBytes()
+}
+
 // MultiBulkReply 相关逻辑
 type MultiBulkReply struct {
 	Args [][]byte
@@ -58,6 +64,45 @@ func (r *MultiBulkReply) ToBytes() []byte {
 	return buf.Bytes()
 }
 
+// ToResp3Bytes 与 RESP2 相同，但不存在的元素编码为 RESP3 的空值
+func (r *MultiBulkReply) ToResp3Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(r.Args)) + CRLF)
+	for _, arg := range r.Args {
+		if arg == nil {
+			buf.Write(resp3NullBytes)
+		} else {
+			buf.WriteString("$" + strconv.Itoa(len(arg)) + CRLF + string(arg) + CRLF)
+		}
+	}
+	return buf.Bytes()
+}
+
+// MultiRawReply 由任意类型的回复组成的数组，用于嵌套数组等 MultiBulkReply 无法表示的情况
+type MultiRawReply struct {
+	Replies []resp.Reply
+}
+
+func MakeMultiRawReply(replies []resp.Reply) *MultiRawReply {
+	return &MultiRawReply{
+		Replies: replies,
+	}
+}
+
+func (r *MultiRawReply) ToBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(r.Replies)) + CRLF)
+	for _, arg := range r.Replies {
+		buf.Write(arg.ToBytes())
+	}
+	return buf.Bytes()
+}
+
+// ToResp3Bytes 元素按 RESP3 编码
+func (r *MultiRawReply) ToResp3Bytes() []byte {
+	return encodeAggregate('*', len(r.Replies), r.Replies, Resp3)
+}
+
 // StatusReply 相关逻辑
 type StatusReply struct {
 	Status string
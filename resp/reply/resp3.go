@@ -0,0 +1,258 @@
+package reply
+
+import (
+	"bytes"
+	"goredis/interface/resp"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+/*
+ * RESP3 的回复类型
+ * 每种回复的 ToBytes 返回 RESP2 中的等价编码，ToResp3Bytes 返回 RESP3 编码，
+ * 命令只需要返回一种回复对象，由连接协商的协议版本决定如何编码
+ */
+
+// Protocol 版本
+const (
+	Resp2 = 2
+	Resp3 = 3
+)
+
+// Encode 按协议版本编码回复，嵌套的回复使用相同的协议
+func Encode(r resp.Reply, protocol int) []byte {
+	if protocol == Resp3 {
+		if r3, ok := r.(resp.Resp3Reply); ok {
+			return r3.ToResp3Bytes()
+		}
+	}
+	return r.ToBytes()
+}
+
+// encodeAggregate 编码聚合类型的头部和所有元素
+func encodeAggregate(prefix byte, count int, items []resp.Reply, protocol int) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(prefix)
+	buf.WriteString(strconv.Itoa(count) + CRLF)
+	for _, item := range items {
+		buf.Write(Encode(item, protocol))
+	}
+	return buf.Bytes()
+}
+
+/* ---- Map Reply ---- */
+
+// MapReply 有序的键值对，RESP2 中编码为键值交替排列的数组
+type MapReply struct {
+	Keys   []resp.Reply
+	Values []resp.Reply
+}
+
+func MakeMapReply() *MapReply {
+	return &MapReply{}
+}
+
+// Add 追加一个键值对
+func (r *MapReply) Add(key resp.Reply, value resp.Reply) *MapReply {
+	r.Keys = append(r.Keys, key)
+	r.Values = append(r.Values, value)
+	return r
+}
+
+// AddString 追加一个键为字符串的键值对
+func (r *MapReply) AddString(key string, value resp.Reply) *MapReply {
+	return r.Add(MakeBulkReply([]byte(key)), value)
+}
+
+func (r *MapReply) items() []resp.Reply {
+	items := make([]resp.Reply, 0, 2*len(r.Keys))
+	for i := range r.Keys {
+		items = append(items, r.Keys[i], r.Values[i])
+	}
+	return items
+}
+
+func (r *MapReply) ToBytes() []byte {
+	return encodeAggregate('*', 2*len(r.Keys), r.items(), Resp2)
+}
+
+func (r *MapReply) ToResp3Bytes() []byte {
+	return encodeAggregate('%', len(r.Keys), r.items(), Resp3)
+}
+
+/* ---- Set Reply ---- */
+
+// SetReply 无序且不重复的集合，RESP2 中编码为数组
+type SetReply struct {
+	Members []resp.Reply
+}
+
+func MakeSetReply(members []resp.Reply) *SetReply {
+	return &SetReply{Members: members}
+}
+
+func (r *SetReply) ToBytes() []byte {
+	return encodeAggregate('*', len(r.Members), r.Members, Resp2)
+}
+
+func (r *SetReply) ToResp3Bytes() []byte {
+	return encodeAggregate('~', len(r.Members), r.Members, Resp3)
+}
+
+/* ---- Push Reply ---- */
+
+// PushReply 服务端主动推送的消息，RESP2 中编码为数组
+type PushReply struct {
+	Items []resp.Reply
+}
+
+func MakePushReply(items []resp.Reply) *PushReply {
+	return &PushReply{Items: items}
+}
+
+func (r *PushReply) ToBytes() []byte {
+	return encodeAggregate('*', len(r.Items), r.Items, Resp2)
+}
+
+func (r *PushReply) ToResp3Bytes() []byte {
+	return encodeAggregate('>', len(r.Items), r.Items, Resp3)
+}
+
+/* ---- Attribute Reply ---- */
+
+// AttributeReply 在回复之前附加的属性，RESP2 中只发送回复本身
+type AttributeReply struct {
+	Attributes *MapReply
+	Reply      resp.Reply
+}
+
+func MakeAttributeReply(attributes *MapReply, reply resp.Reply) *AttributeReply {
+	return &AttributeReply{Attributes: attributes, Reply: reply}
+}
+
+func (r *AttributeReply) ToBytes() []byte {
+	return r.Reply.ToBytes()
+}
+
+func (r *AttributeReply) ToResp3Bytes() []byte {
+	var buf bytes.Buffer
+	buf.Write(encodeAggregate('|', len(r.Attributes.Keys), r.Attributes.items(), Resp3))
+	buf.Write(Encode(r.Reply, Resp3))
+	return buf.Bytes()
+}
+
+/* ---- Double Reply ---- */
+
+// DoubleReply 浮点数，RESP2 中编码为字符串
+type DoubleReply struct {
+	Value float64
+}
+
+func MakeDoubleReply(value float64) *DoubleReply {
+	return &DoubleReply{Value: value}
+}
+
+// formatDouble 使用 Redis 的格式输出浮点数：inf、-inf、nan 或者最短的十进制表示
+func formatDouble(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "inf"
+	case math.IsInf(value, -1):
+		return "-inf"
+	case math.IsNaN(value):
+		return "nan"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (r *DoubleReply) ToBytes() []byte {
+	return MakeBulkReply([]byte(formatDouble(r.Value))).ToBytes()
+}
+
+func (r *DoubleReply) ToResp3Bytes() []byte {
+	return []byte("," + formatDouble(r.Value) + CRLF)
+}
+
+/* ---- Boolean Reply ---- */
+
+// BooleanReply 布尔值，RESP2 中编码为整数 1 或 0
+type BooleanReply struct {
+	Value bool
+}
+
+func MakeBooleanReply(value bool) *BooleanReply {
+	return &BooleanReply{Value: value}
+}
+
+func (r *BooleanReply) ToBytes() []byte {
+	if r.Value {
+		return []byte(":1" + CRLF)
+	}
+	return []byte(":0" + CRLF)
+}
+
+func (r *BooleanReply) ToResp3Bytes() []byte {
+	if r.Value {
+		return []byte("#t" + CRLF)
+	}
+	return []byte("#f" + CRLF)
+}
+
+/* ---- Null Reply ---- */
+
+var resp3NullBytes = []byte("_" + CRLF)
+
+// NullReply 空值，RESP2 中编码为空的批量字符串
+type NullReply struct{}
+
+func MakeNullReply() *NullReply {
+	return &NullReply{}
+}
+
+func (r *NullReply) ToBytes() []byte {
+	return nullBulkBytes
+}
+
+func (r *NullReply) ToResp3Bytes() []byte {
+	return resp3NullBytes
+}
+
+/* ---- Big Number Reply ---- */
+
+// BigNumberReply 超出 64 位整数范围的整数，RESP2 中编码为字符串
+type BigNumberReply struct {
+	Value *big.Int
+}
+
+func MakeBigNumberReply(value *big.Int) *BigNumberReply {
+	return &BigNumberReply{Value: value}
+}
+
+func (r *BigNumberReply) ToBytes() []byte {
+	return MakeBulkReply([]byte(r.Value.String())).ToBytes()
+}
+
+func (r *BigNumberReply) ToResp3Bytes() []byte {
+	return []byte("(" + r.Value.String() + CRLF)
+}
+
+/* ---- Verbatim String Reply ---- */
+
+// VerbatimReply 带格式的文本，Format 是三个字符的格式（txt 或 mkd），RESP2 中编码为批量字符串
+type VerbatimReply struct {
+	Format string
+	Text   []byte
+}
+
+func MakeVerbatimReply(format string, text []byte) *VerbatimReply {
+	return &VerbatimReply{Format: format, Text: text}
+}
+
+func (r *VerbatimReply) ToBytes() []byte {
+	return MakeBulkReply(r.Text).ToBytes()
+}
+
+func (r *VerbatimReply) ToResp3Bytes() []byte {
+	return []byte("=" + strconv.Itoa(len(r.Format)+1+len(r.Text)) + CRLF + r.Format + ":" + string(r.Text) + CRLF)
+}
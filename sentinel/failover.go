@@ -0,0 +1,183 @@
+package sentinel
+
+import (
+	"fmt"
+	"goredis/lib/logger"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	maxElectionTimeout = 10 * time.Second // 等待其他 sentinel 投票的最长时间
+	promotionPoll      = time.Second      // 等待从库完成提升时查询 INFO 的间隔
+)
+
+// failover 执行一次故障转移：
+// 1. 在新的纪元中请求其他 sentinel 投票，得到多数票（且不少于 quorum）后成为领头 sentinel
+// 2. 选出复制偏移量最大的从库，发送 REPLICAOF NO ONE 并等待它成为主库
+// 3. 让其他从库复制新的主库，更新配置后通过 hello 通知其他 sentinel
+func (s *Sentinel) failover(m *masterInstance) {
+	force := s.prepareFailover(m)
+	if !force {
+		// 随机等待一段时间，减少多个 sentinel 同时发起选举导致的平票
+		select {
+		case <-time.After(randomDesync()):
+		case <-s.stopCh:
+			return
+		}
+	}
+
+	s.mu.Lock()
+	if !force && (!m.odown || time.Since(m.failoverAt) <= 2*s.failoverTimeout) {
+		// 等待期间主库恢复了，或者已经投票给其他 sentinel
+		s.mu.Unlock()
+		return
+	}
+	s.currentEpoch++
+	epoch := s.currentEpoch
+	m.leader = s.myId
+	m.leaderEpoch = epoch
+	m.failoverAt = time.Now()
+	m.inFailover = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		m.inFailover = false
+		s.mu.Unlock()
+	}()
+	logger.Info(fmt.Sprintf("sentinel: +try-failover master %s epoch %d", m.name, epoch))
+
+	if !force && !s.waitForElection(m, epoch) {
+		logger.Info(fmt.Sprintf("sentinel: -failover-abort-not-elected master %s epoch %d", m.name, epoch))
+		return
+	}
+	logger.Info(fmt.Sprintf("sentinel: +elected-leader master %s epoch %d", m.name, epoch))
+
+	promoted, others := s.selectReplica(m)
+	if promoted == nil {
+		logger.Info("sentinel: -failover-abort-no-good-slave master " + m.name)
+		return
+	}
+	logger.Info(fmt.Sprintf("sentinel: +selected-slave slave %s @ %s", promoted.addr(), m.name))
+	if !s.promote(promoted) {
+		logger.Info(fmt.Sprintf("sentinel: -failover-abort-slave-timeout slave %s @ %s", promoted.addr(), m.name))
+		return
+	}
+	logger.Info(fmt.Sprintf("sentinel: +promoted-slave slave %s @ %s", promoted.addr(), m.name))
+
+	for _, r := range others {
+		if _, err := r.link.send("REPLICAOF", promoted.host, strconv.Itoa(promoted.port)); err != nil {
+			// 不可达的从库恢复后由 reconfigureInstances 修正
+			logger.Warn(fmt.Sprintf("sentinel: reconfigure slave %s failed: %s", r.addr(), err.Error()))
+			continue
+		}
+		logger.Info(fmt.Sprintf("sentinel: +slave-reconf-sent slave %s @ %s", r.addr(), m.name))
+	}
+
+	s.mu.Lock()
+	s.switchMaster(m, promoted.host, promoted.port, epoch)
+	s.mu.Unlock()
+	s.sendHello(m)
+	logger.Info("sentinel: +failover-end master " + m.name)
+}
+
+// prepareFailover 返回并清除 SENTINEL FAILOVER 设置的强制故障转移标志
+func (s *Sentinel) prepareFailover(m *masterInstance) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	force := m.forceFailover
+	m.forceFailover = false
+	return force
+}
+
+// waitForElection 请求其他 sentinel 在 epoch 中投票给自己，直到得到足够的票数或超时
+func (s *Sentinel) waitForElection(m *masterInstance, epoch int64) bool {
+	s.mu.Lock()
+	needed := (len(s.peers)+1)/2 + 1
+	if m.quorum > needed {
+		needed = m.quorum
+	}
+	timeout := maxElectionTimeout
+	if s.failoverTimeout < timeout {
+		timeout = s.failoverTimeout
+	}
+	s.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		votes := 1 // 自己的一票
+		for _, answer := range s.askPeers(m, epoch, s.myId) {
+			if answer != nil && answer.leader == s.myId && answer.leaderEpoch == epoch {
+				votes++
+			}
+		}
+		if votes >= needed {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		select {
+		case <-time.After(monitorPeriod):
+		case <-s.stopCh:
+			return false
+		}
+	}
+}
+
+// selectReplica 选择要提升的从库：排除不可达的从库，优先复制偏移量最大的，偏移量相同时选择 run id 最小的
+func (s *Sentinel) selectReplica(m *masterInstance) (*instance, []*instance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var candidates, all []*instance
+	for _, r := range m.replicas {
+		all = append(all, r)
+		if time.Since(r.lastOkPing) > 5*monitorPeriod || r.role != "slave" {
+			continue
+		}
+		candidates = append(candidates, r)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].replOffset != candidates[j].replOffset {
+			return candidates[i].replOffset > candidates[j].replOffset
+		}
+		return candidates[i].runId < candidates[j].runId
+	})
+	promoted := candidates[0]
+	others := make([]*instance, 0, len(all)-1)
+	for _, r := range all {
+		if r != promoted {
+			others = append(others, r)
+		}
+	}
+	return promoted, others
+}
+
+// promote 向从库发送 REPLICAOF NO ONE，等待它在 INFO 中报告自己是主库
+func (s *Sentinel) promote(r *instance) bool {
+	if _, err := r.link.send("REPLICAOF", "NO", "ONE"); err != nil {
+		return false
+	}
+	deadline := time.Now().Add(s.failoverTimeout)
+	for time.Now().Before(deadline) {
+		info, err := fetchInfo(r.link)
+		if err == nil {
+			s.mu.Lock()
+			r.apply(info)
+			s.mu.Unlock()
+			if info.fields["role"] == "master" {
+				return true
+			}
+		}
+		select {
+		case <-time.After(promotionPoll):
+		case <-s.stopCh:
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package sentinel
+
+import (
+	"errors"
+	"goredis/interface/resp"
+	"goredis/lib/utils"
+	"goredis/resp/client"
+	"goredis/resp/reply"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// link 维护到一个实例的连接，连接出错后丢弃，下次使用时重新建立
+type link struct {
+	addr     string
+	password string // 连接后发送 AUTH 的密码，为空时不认证
+	mu       sync.Mutex
+	client   *client.Client
+}
+
+func makeLink(addr string, password string) *link {
+	return &link{addr: addr, password: password}
+}
+
+// send 发送命令，连接失败或超时返回 error，实例返回的错误回复不视为 error
+func (l *link) send(args ...string) (resp.Reply, error) {
+	l.mu.Lock()
+	if l.client == nil {
+		c, err := client.MakeAuthClient(l.addr, l.password)
+		if err != nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+		c.Start()
+		l.client = c
+	}
+	c := l.client
+	l.mu.Unlock()
+
+	ret := c.Send(utils.ToCmdLine(args...))
+	if client.IsLinkError(ret) {
+		l.reset(c)
+		return nil, ret.(*client.LinkError)
+	}
+	return ret, nil
+}
+
+// reset 丢弃出错的连接
+func (l *link) reset(c *client.Client) {
+	l.mu.Lock()
+	if l.client == c {
+		l.client = nil
+	}
+	l.mu.Unlock()
+	// Close 会等待进行中的请求结束，不阻塞调用者
+	go c.Close()
+}
+
+func (l *link) close() {
+	l.mu.Lock()
+	c := l.client
+	l.client = nil
+	l.mu.Unlock()
+	if c != nil {
+		go c.Close()
+	}
+}
+
+// instance 被监控的主库或从库，字段由 Sentinel.mu 保护
+type instance struct {
+	host string
+	port int
+	link *link
+
+	lastOkPing time.Time // 最近一次成功收到回复的时间
+	lastInfo   time.Time // 最近一次成功获取 INFO 的时间
+	runId      string
+	role       string // INFO 中报告的角色：master 或 slave
+	masterHost string // 作为从库时报告的主库地址
+	masterPort int
+	linkUp     bool      // 作为从库时与主库的连接是否正常
+	replOffset int64     // 作为从库时的复制偏移量
+	wrongSince time.Time // 开始报告与 sentinel 记录不符的角色或主库的时间，零值表示配置正确
+}
+
+// makeInstance password 为主库配置的 sentinel-auth-pass，主库和它的从库使用相同的密码
+func makeInstance(host string, port int, password string) *instance {
+	return &instance{
+		host:       host,
+		port:       port,
+		link:       makeLink(net.JoinHostPort(host, strconv.Itoa(port)), password),
+		lastOkPing: time.Now(),
+	}
+}
+
+func (inst *instance) addr() string {
+	return net.JoinHostPort(inst.host, strconv.Itoa(inst.port))
+}
+
+// infoResult 一次 INFO 的解析结果
+type infoResult struct {
+	fields   map[string]string
+	replicas []string // 主库报告的从库地址 host:port
+}
+
+// fetchInfo 获取并解析实例的 INFO
+func fetchInfo(l *link) (*infoResult, error) {
+	ret, err := l.send("INFO")
+	if err != nil {
+		return nil, err
+	}
+	bulk, ok := ret.(*reply.BulkReply)
+	if !ok {
+		return nil, errors.New("unexpected INFO reply: " + string(ret.ToBytes()))
+	}
+	return parseInfo(string(bulk.Arg)), nil
+}
+
+// parseInfo 解析 INFO 输出中的 key:value 行，slaveN 行解析为从库地址
+func parseInfo(text string) *infoResult {
+	result := &infoResult{
+		fields: make(map[string]string),
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		pivot := strings.IndexByte(line, ':')
+		if pivot <= 0 {
+			continue
+		}
+		key, value := line[:pivot], line[pivot+1:]
+		if strings.HasPrefix(key, "slave") && strings.Contains(value, "ip=") {
+			// slave0:ip=127.0.0.1,port=6380,state=online,offset=0,lag=0
+			var ip, port string
+			for _, kv := range strings.Split(value, ",") {
+				if strings.HasPrefix(kv, "ip=") {
+					ip = kv[3:]
+				} else if strings.HasPrefix(kv, "port=") {
+					port = kv[5:]
+				}
+			}
+			if ip != "" && port != "" && port != "0" {
+				result.replicas = append(result.replicas, net.JoinHostPort(ip, port))
+			}
+			continue
+		}
+		result.fields[key] = value
+	}
+	return result
+}
+
+// apply 用 INFO 结果更新实例状态，调用者需要持有 Sentinel.mu
+func (inst *instance) apply(info *infoResult) {
+	now := time.Now()
+	inst.lastOkPing = now
+	inst.lastInfo = now
+	inst.runId = info.fields["run_id"]
+	inst.role = info.fields["role"]
+	if inst.role == "slave" {
+		inst.masterHost = info.fields["master_host"]
+		inst.masterPort, _ = strconv.Atoi(info.fields["master_port"])
+		inst.linkUp = info.fields["master_link_status"] == "up"
+		inst.replOffset, _ = strconv.ParseInt(info.fields["slave_repl_offset"], 10, 64)
+	}
+}
@@ -0,0 +1,279 @@
+package sentinel
+
+import (
+	"fmt"
+	"goredis/config"
+	"goredis/interface/resp"
+	"goredis/lib/logger"
+	"goredis/resp/reply"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	monitorPeriod     = time.Second     // 检查实例和发送 hello 的间隔
+	maxDesync         = time.Second     // 发起故障转移前的随机等待上限，避免多个 sentinel 同时发起选举
+	reconfGracePeriod = 8 * time.Second // 实例报告的配置错误持续这么久之后才去修正，等待 hello 传播新的配置
+)
+
+// monitorLoop 定期检查主库和从库的状态，必要时发起故障转移
+func (s *Sentinel) monitorLoop(m *masterInstance) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(monitorPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+		s.refresh(m)
+		s.checkSubjectivelyDown(m)
+		s.checkObjectivelyDown(m)
+		s.sendHello(m)
+		s.reconfigureInstances(m)
+		if s.shouldFailover(m) {
+			s.failover(m)
+		}
+	}
+}
+
+// refresh 并发获取主库和所有从库的 INFO，成功的回复同时视为 PING 成功
+func (s *Sentinel) refresh(m *masterInstance) {
+	s.mu.Lock()
+	instances := []*instance{m.master}
+	for _, r := range m.replicas {
+		instances = append(instances, r)
+	}
+	s.mu.Unlock()
+
+	results := make([]*infoResult, len(instances))
+	var wg sync.WaitGroup
+	for i, inst := range instances {
+		wg.Add(1)
+		go func(i int, inst *instance) {
+			defer wg.Done()
+			info, err := fetchInfo(inst.link)
+			if err == nil {
+				results[i] = info
+			}
+		}(i, inst)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, inst := range instances {
+		if results[i] == nil {
+			continue
+		}
+		inst.apply(results[i])
+		if inst != m.master {
+			continue
+		}
+		// 从主库的 INFO 中发现新的从库
+		for _, addr := range results[i].replicas {
+			if _, ok := m.replicas[addr]; ok || addr == m.master.addr() {
+				continue
+			}
+			host, port, err := splitAddr(addr)
+			if err != nil {
+				continue
+			}
+			m.replicas[addr] = makeInstance(host, port, m.authPass)
+			logger.Info(fmt.Sprintf("sentinel: +slave slave %s @ %s %s", addr, m.name, m.master.addr()))
+		}
+	}
+}
+
+// checkSubjectivelyDown 主库超过 down-after 没有回复时标记为主观下线
+func (s *Sentinel) checkSubjectivelyDown(m *masterInstance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	down := time.Since(m.master.lastOkPing) > s.downAfter
+	if down && !m.sdown {
+		m.sdown = true
+		logger.Info(fmt.Sprintf("sentinel: +sdown master %s %s", m.name, m.master.addr()))
+	} else if !down && m.sdown {
+		m.sdown = false
+		logger.Info(fmt.Sprintf("sentinel: -sdown master %s %s", m.name, m.master.addr()))
+	}
+}
+
+// peerAnswer 其他 sentinel 对 IS-MASTER-DOWN-BY-ADDR 的回复
+type peerAnswer struct {
+	down        bool
+	leader      string
+	leaderEpoch int64
+}
+
+// askPeers 并发询问其他 sentinel 主库是否下线，runId 不为 * 时同时请求投票
+func (s *Sentinel) askPeers(m *masterInstance, epoch int64, runId string) []*peerAnswer {
+	s.mu.Lock()
+	host, port := m.master.host, strconv.Itoa(m.master.port)
+	links := make([]*link, 0, len(s.peers))
+	for _, p := range s.peers {
+		links = append(links, p.link)
+	}
+	s.mu.Unlock()
+
+	answers := make([]*peerAnswer, len(links))
+	var wg sync.WaitGroup
+	for i, l := range links {
+		wg.Add(1)
+		go func(i int, l *link) {
+			defer wg.Done()
+			ret, err := l.send("SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, port, strconv.FormatInt(epoch, 10), runId)
+			if err != nil {
+				return
+			}
+			answers[i] = parsePeerAnswer(ret)
+		}(i, l)
+	}
+	wg.Wait()
+	return answers
+}
+
+func parsePeerAnswer(ret resp.Reply) *peerAnswer {
+	multiRaw, ok := ret.(*reply.MultiRawReply)
+	if !ok || len(multiRaw.Replies) != 3 {
+		return nil
+	}
+	down, ok1 := multiRaw.Replies[0].(*reply.IntReply)
+	leader, ok2 := multiRaw.Replies[1].(*reply.BulkReply)
+	leaderEpoch, ok3 := multiRaw.Replies[2].(*reply.IntReply)
+	if !ok1 || !ok2 || !ok3 {
+		return nil
+	}
+	return &peerAnswer{
+		down:        down.Code == 1,
+		leader:      string(leader.Arg),
+		leaderEpoch: leaderEpoch.Code,
+	}
+}
+
+// checkObjectivelyDown 主观下线时询问其他 sentinel，认为主库下线的数量达到 quorum 时标记为客观下线
+func (s *Sentinel) checkObjectivelyDown(m *masterInstance) {
+	s.mu.Lock()
+	sdown := m.sdown
+	epoch := s.currentEpoch
+	s.mu.Unlock()
+
+	votes := 0
+	if sdown {
+		votes = 1
+		for _, answer := range s.askPeers(m, epoch, "*") {
+			if answer != nil && answer.down {
+				votes++
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	odown := m.sdown && votes >= m.quorum
+	if odown && !m.odown {
+		m.odown = true
+		logger.Info(fmt.Sprintf("sentinel: +odown master %s %s #quorum %d/%d", m.name, m.master.addr(), votes, m.quorum))
+	} else if !odown && m.odown {
+		m.odown = false
+		logger.Info(fmt.Sprintf("sentinel: -odown master %s %s", m.name, m.master.addr()))
+	}
+}
+
+// sendHello 向其他 sentinel 广播自己的信息和主库配置
+func (s *Sentinel) sendHello(m *masterInstance) {
+	s.mu.Lock()
+	args := []string{
+		"SENTINEL", "HELLO",
+		config.Properties.Bind, strconv.Itoa(config.Properties.Port), s.myId, strconv.FormatInt(s.currentEpoch, 10),
+		m.name, m.master.host, strconv.Itoa(m.master.port), strconv.FormatInt(m.configEpoch, 10),
+	}
+	links := make([]*link, 0, len(s.peers))
+	for _, p := range s.peers {
+		links = append(links, p.link)
+	}
+	s.mu.Unlock()
+
+	for _, l := range links {
+		go func(l *link) {
+			_, _ = l.send(args...)
+		}(l)
+	}
+}
+
+// reconfigureInstances 修正配置错误的实例：重新上线的旧主库降级为从库，复制了其他主库的从库改为复制当前主库
+func (s *Sentinel) reconfigureInstances(m *masterInstance) {
+	s.mu.Lock()
+	if m.sdown || m.inFailover {
+		s.mu.Unlock()
+		return
+	}
+	masterHost, masterPort := m.master.host, m.master.port
+	var targets []*instance
+	now := time.Now()
+	for _, r := range m.replicas {
+		if time.Since(r.lastInfo) > 2*monitorPeriod {
+			continue // 不可达或者还没有获取到 INFO
+		}
+		wrong := r.role == "master" ||
+			(r.role == "slave" && (r.masterHost != masterHost || r.masterPort != masterPort))
+		if !wrong {
+			r.wrongSince = time.Time{}
+			continue
+		}
+		if r.wrongSince.IsZero() {
+			r.wrongSince = now
+		}
+		if now.Sub(r.wrongSince) >= reconfGracePeriod {
+			r.wrongSince = now // 下一次修正同样需要等待
+			targets = append(targets, r)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, r := range targets {
+		event := "+fix-slave-config"
+		if r.role == "master" {
+			event = "+convert-to-slave"
+		}
+		logger.Info(fmt.Sprintf("sentinel: %s slave %s @ %s %s:%d", event, r.addr(), m.name, masterHost, masterPort))
+		_, _ = r.link.send("REPLICAOF", masterHost, strconv.Itoa(masterPort))
+	}
+}
+
+// shouldFailover 主库客观下线并且最近没有发起或参与过故障转移时需要发起故障转移
+func (s *Sentinel) shouldFailover(m *masterInstance) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.forceFailover {
+		return true
+	}
+	return m.odown && !m.inFailover && time.Since(m.failoverAt) > 2*s.failoverTimeout
+}
+
+// switchMaster 将主库切换到新的地址，原来的主库成为从库，调用者需要持有 s.mu
+func (s *Sentinel) switchMaster(m *masterInstance, host string, port int, configEpoch int64) {
+	old := m.master
+	promoted := makeInstance(host, port, m.authPass)
+	if r, ok := m.replicas[promoted.addr()]; ok {
+		promoted = r
+		delete(m.replicas, promoted.addr())
+	}
+	promoted.wrongSince = time.Time{}
+	old.wrongSince = time.Time{}
+	m.replicas[old.addr()] = old
+	m.master = promoted
+	m.configEpoch = configEpoch
+	m.sdown = false
+	m.odown = false
+	m.failoverAt = time.Now()
+	logger.Info(fmt.Sprintf("sentinel: +switch-master %s %s %d %s %d", m.name, old.host, old.port, host, port))
+}
+
+// randomDesync 发起故障转移前的随机等待时间
+func randomDesync() time.Duration {
+	return time.Duration(rand.Int63n(int64(maxDesync)))
+}
@@ -0,0 +1,511 @@
+// Package sentinel 实现 sentinel 模式：监控主库，在主库下线时选出领头 sentinel 并将最合适的从库提升为主库
+package sentinel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"goredis/config"
+	"goredis/interface/resp"
+	"goredis/lib/logger"
+	"goredis/resp/reply"
+	"net"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDownAfter       = 30 * time.Second  // 默认的 down-after-milliseconds
+	defaultFailoverTimeout = 180 * time.Second // 默认的 failover-timeout
+)
+
+// masterInstance 一个被监控的主库及其从库，字段由 Sentinel.mu 保护
+type masterInstance struct {
+	name     string
+	quorum   int
+	authPass string // sentinel-auth-pass 配置的密码，用于连接主库和从库
+	master   *instance
+	replicas map[string]*instance // host:port -> 从库
+
+	sdown         bool      // 主观下线：本 sentinel 超过 down-after 没有收到回复
+	odown         bool      // 客观下线：至少 quorum 个 sentinel 认为主库主观下线
+	configEpoch   int64     // 当前主库地址对应的纪元，纪元更大的配置会覆盖纪元小的配置
+	leader        string    // 本 sentinel 在 leaderEpoch 中投票选出的领头 sentinel
+	leaderEpoch   int64     // 最近一次投票的纪元
+	failoverAt    time.Time // 最近一次发起或参与故障转移的时间
+	inFailover    bool
+	forceFailover bool // SENTINEL FAILOVER 请求不经过选举直接进行故障转移
+}
+
+// peer 监控同一批主库的其他 sentinel
+type peer struct {
+	host      string
+	port      int
+	link      *link
+	runId     string
+	lastHello time.Time
+}
+
+// Sentinel 实现了 database.Database 接口，只处理 sentinel 相关的命令
+type Sentinel struct {
+	mu           sync.Mutex
+	myId         string
+	currentEpoch int64
+	masters      map[string]*masterInstance
+	peers        map[string]*peer // host:port -> sentinel
+
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// MakeSentinel 根据配置创建 sentinel 并开始监控
+func MakeSentinel() *Sentinel {
+	s := &Sentinel{
+		myId:            makeRunId(),
+		masters:         make(map[string]*masterInstance),
+		peers:           make(map[string]*peer),
+		downAfter:       defaultDownAfter,
+		failoverTimeout: defaultFailoverTimeout,
+		stopCh:          make(chan struct{}),
+	}
+	if config.Properties.SentinelDownAfter > 0 {
+		s.downAfter = time.Duration(config.Properties.SentinelDownAfter) * time.Millisecond
+	}
+	if config.Properties.SentinelFailoverTimeout > 0 {
+		s.failoverTimeout = time.Duration(config.Properties.SentinelFailoverTimeout) * time.Millisecond
+	}
+	authPass := make(map[string]string)
+	for _, item := range config.Properties.SentinelAuthPass {
+		// sentinel-auth-pass <name> <password>
+		fields := strings.Fields(item)
+		if len(fields) != 2 {
+			panic("invalid sentinel-auth-pass config: " + item)
+		}
+		authPass[fields[0]] = fields[1]
+	}
+	for _, monitor := range config.Properties.SentinelMonitor {
+		// sentinel-monitor <name> <host> <port> <quorum>
+		fields := strings.Fields(monitor)
+		if len(fields) != 4 {
+			panic("invalid sentinel-monitor config: " + monitor)
+		}
+		port, err1 := strconv.Atoi(fields[2])
+		quorum, err2 := strconv.Atoi(fields[3])
+		if err1 != nil || err2 != nil || quorum <= 0 {
+			panic("invalid sentinel-monitor config: " + monitor)
+		}
+		s.masters[fields[0]] = &masterInstance{
+			name:     fields[0],
+			quorum:   quorum,
+			authPass: authPass[fields[0]],
+			master:   makeInstance(fields[1], port, authPass[fields[0]]),
+			replicas: make(map[string]*instance),
+		}
+	}
+	for _, addr := range config.Properties.SentinelPeers {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		host, port, err := splitAddr(addr)
+		if err != nil {
+			panic("invalid sentinel-peers config: " + addr)
+		}
+		s.addPeer(host, port)
+	}
+	for name := range authPass {
+		if _, ok := s.masters[name]; !ok {
+			panic("sentinel-auth-pass for unknown master: " + name)
+		}
+	}
+	for _, m := range s.masters {
+		logger.Info(fmt.Sprintf("sentinel: +monitor master %s %s quorum %d", m.name, m.master.addr(), m.quorum))
+		s.wg.Add(1)
+		go s.monitorLoop(m)
+	}
+	return s
+}
+
+// makeRunId 生成 40 个十六进制字符的随机 ID
+func makeRunId() string {
+	buf := make([]byte, 20)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func splitAddr(addr string) (string, int, error) {
+	pivot := strings.LastIndexByte(addr, ':')
+	if pivot <= 0 {
+		return "", 0, fmt.Errorf("invalid address %s", addr)
+	}
+	port, err := strconv.Atoi(addr[pivot+1:])
+	if err != nil {
+		return "", 0, err
+	}
+	return addr[:pivot], port, nil
+}
+
+// addPeer 记录一个 sentinel，已经存在时返回已有的记录，调用者需要持有 s.mu 或处于初始化阶段
+func (s *Sentinel) addPeer(host string, port int) *peer {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if p, ok := s.peers[addr]; ok {
+		return p
+	}
+	p := &peer{
+		host: host,
+		port: port,
+		link: makeLink(addr, ""),
+	}
+	s.peers[addr] = p
+	return p
+}
+
+// Exec 执行客户端发送给 sentinel 的命令
+func (s *Sentinel) Exec(c resp.Connection, cmdLine [][]byte) (result resp.Reply) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Warn(fmt.Sprintf("error occurs: %v\n%s", err, string(debug.Stack())))
+			result = &reply.UnknownErrReply{}
+		}
+	}()
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	switch cmdName {
+	case "ping":
+		return &reply.PongReply{}
+	case "info":
+		return s.execInfo()
+	case "sentinel":
+		if len(cmdLine) < 2 {
+			return reply.MakeArgNumErrReply("sentinel")
+		}
+		return s.execSentinel(cmdLine[1:])
+	}
+	return reply.MakeErrReply("ERR unknown command '" + cmdName + "'")
+}
+
+// AfterClientClose sentinel 不需要维护客户端状态
+func (s *Sentinel) AfterClientClose(c resp.Connection) {
+}
+
+// Close 停止监控并关闭所有连接
+func (s *Sentinel) Close() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.masters {
+		m.master.link.close()
+		for _, r := range m.replicas {
+			r.link.close()
+		}
+	}
+	for _, p := range s.peers {
+		p.link.close()
+	}
+}
+
+// execSentinel 处理 SENTINEL <subcommand> [args]
+func (s *Sentinel) execSentinel(args [][]byte) resp.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch subCmd {
+	case "myid":
+		return reply.MakeBulkReply([]byte(s.myId))
+	case "masters":
+		return s.execMasters()
+	case "master", "replicas", "slaves", "sentinels", "get-master-addr-by-name", "failover":
+		if len(args) != 1 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'sentinel " + subCmd + "'")
+		}
+		s.mu.Lock()
+		m, ok := s.masters[string(args[0])]
+		s.mu.Unlock()
+		if !ok {
+			if subCmd == "get-master-addr-by-name" {
+				return &reply.NullBulkReply{}
+			}
+			return reply.MakeErrReply("ERR No such master with that name")
+		}
+		switch subCmd {
+		case "master":
+			return s.execMaster(m)
+		case "replicas", "slaves":
+			return s.execReplicas(m)
+		case "sentinels":
+			return s.execSentinels()
+		case "get-master-addr-by-name":
+			return s.execGetMasterAddr(m)
+		default:
+			return s.execFailover(m)
+		}
+	case "is-master-down-by-addr":
+		return s.execIsMasterDownByAddr(args)
+	case "hello":
+		return s.execHello(args)
+	}
+	return reply.MakeErrReply("ERR Unknown sentinel subcommand '" + subCmd + "'")
+}
+
+// masterFlags 返回主库状态标志，调用者需要持有 s.mu
+func masterFlags(m *masterInstance) string {
+	flags := []string{"master"}
+	if m.sdown {
+		flags = append(flags, "s_down")
+	}
+	if m.odown {
+		flags = append(flags, "o_down")
+	}
+	if m.inFailover {
+		flags = append(flags, "failover_in_progress")
+	}
+	return strings.Join(flags, ",")
+}
+
+// describeMaster 以 field value 列表的形式描述主库，调用者需要持有 s.mu
+func (s *Sentinel) describeMaster(m *masterInstance) resp.Reply {
+	return reply.MakeMultiBulkReply(toArgs(
+		"name", m.name,
+		"ip", m.master.host,
+		"port", strconv.Itoa(m.master.port),
+		"runid", m.master.runId,
+		"flags", masterFlags(m),
+		"last-ok-ping-reply", strconv.FormatInt(time.Since(m.master.lastOkPing).Milliseconds(), 10),
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(s.peers)),
+		"quorum", strconv.Itoa(m.quorum),
+		"config-epoch", strconv.FormatInt(m.configEpoch, 10),
+		"down-after-milliseconds", strconv.FormatInt(s.downAfter.Milliseconds(), 10),
+		"failover-timeout", strconv.FormatInt(s.failoverTimeout.Milliseconds(), 10),
+	))
+}
+
+func toArgs(strs ...string) [][]byte {
+	args := make([][]byte, len(strs))
+	for i, str := range strs {
+		args[i] = []byte(str)
+	}
+	return args
+}
+
+// sortedMasters 按名称排序的主库列表，调用者需要持有 s.mu
+func (s *Sentinel) sortedMasters() []*masterInstance {
+	masters := make([]*masterInstance, 0, len(s.masters))
+	for _, m := range s.masters {
+		masters = append(masters, m)
+	}
+	sort.Slice(masters, func(i, j int) bool {
+		return masters[i].name < masters[j].name
+	})
+	return masters
+}
+
+func (s *Sentinel) execMasters() resp.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var replies []resp.Reply
+	for _, m := range s.sortedMasters() {
+		replies = append(replies, s.describeMaster(m))
+	}
+	return reply.MakeMultiRawReply(replies)
+}
+
+func (s *Sentinel) execMaster(m *masterInstance) resp.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.describeMaster(m)
+}
+
+func (s *Sentinel) execReplicas(m *masterInstance) resp.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var replies []resp.Reply
+	for _, r := range m.replicas {
+		flags := "slave"
+		if time.Since(r.lastOkPing) > s.downAfter {
+			flags += ",s_down"
+		}
+		linkStatus := "err"
+		if r.linkUp {
+			linkStatus = "ok"
+		}
+		replies = append(replies, reply.MakeMultiBulkReply(toArgs(
+			"name", r.addr(),
+			"ip", r.host,
+			"port", strconv.Itoa(r.port),
+			"runid", r.runId,
+			"flags", flags,
+			"master-host", r.masterHost,
+			"master-port", strconv.Itoa(r.masterPort),
+			"master-link-status", linkStatus,
+			"slave-repl-offset", strconv.FormatInt(r.replOffset, 10),
+		)))
+	}
+	return reply.MakeMultiRawReply(replies)
+}
+
+func (s *Sentinel) execSentinels() resp.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var replies []resp.Reply
+	for addr, p := range s.peers {
+		lastHello := int64(-1)
+		if !p.lastHello.IsZero() {
+			lastHello = time.Since(p.lastHello).Milliseconds()
+		}
+		replies = append(replies, reply.MakeMultiBulkReply(toArgs(
+			"name", addr,
+			"ip", p.host,
+			"port", strconv.Itoa(p.port),
+			"runid", p.runId,
+			"flags", "sentinel",
+			"last-hello-message", strconv.FormatInt(lastHello, 10),
+		)))
+	}
+	return reply.MakeMultiRawReply(replies)
+}
+
+func (s *Sentinel) execGetMasterAddr(m *masterInstance) resp.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return reply.MakeMultiBulkReply(toArgs(m.master.host, strconv.Itoa(m.master.port)))
+}
+
+// execFailover 处理 SENTINEL FAILOVER，不需要其他 sentinel 同意
+func (s *Sentinel) execFailover(m *masterInstance) resp.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.inFailover {
+		return reply.MakeErrReply("INPROG Failover already in progress")
+	}
+	if len(m.replicas) == 0 {
+		return reply.MakeErrReply("NOGOODSLAVE No suitable replica to promote")
+	}
+	m.forceFailover = true
+	return reply.MakeOkReply()
+}
+
+// execIsMasterDownByAddr 处理其他 sentinel 发送的 SENTINEL IS-MASTER-DOWN-BY-ADDR ip port current-epoch runid
+// runid 为 * 时只询问主库状态，否则同时请求本 sentinel 在 current-epoch 中投票给 runid
+// 回复 [down-state, leader-runid, leader-epoch]
+func (s *Sentinel) execIsMasterDownByAddr(args [][]byte) resp.Reply {
+	if len(args) != 4 {
+		return reply.MakeErrReply("ERR wrong number of arguments for 'sentinel is-master-down-by-addr'")
+	}
+	host := string(args[0])
+	port, err1 := strconv.Atoi(string(args[1]))
+	reqEpoch, err2 := strconv.ParseInt(string(args[2]), 10, 64)
+	if err1 != nil || err2 != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	runId := string(args[3])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var m *masterInstance
+	for _, candidate := range s.masters {
+		if candidate.master.host == host && candidate.master.port == port {
+			m = candidate
+			break
+		}
+	}
+	downState := 0
+	leader, leaderEpoch := "*", int64(0)
+	if m != nil {
+		if m.sdown {
+			downState = 1
+		}
+		if runId != "*" {
+			s.vote(m, runId, reqEpoch)
+			leader, leaderEpoch = m.leader, m.leaderEpoch
+		}
+	}
+	return reply.MakeMultiRawReply([]resp.Reply{
+		reply.MakeIntReply(int64(downState)),
+		reply.MakeBulkReply([]byte(leader)),
+		reply.MakeIntReply(leaderEpoch),
+	})
+}
+
+// vote 在 reqEpoch 中为 runId 投票，每个纪元只投给第一个请求的 sentinel，调用者需要持有 s.mu
+func (s *Sentinel) vote(m *masterInstance, runId string, reqEpoch int64) {
+	if reqEpoch > s.currentEpoch {
+		s.currentEpoch = reqEpoch
+	}
+	if m.leaderEpoch < reqEpoch && s.currentEpoch <= reqEpoch {
+		m.leader = runId
+		m.leaderEpoch = reqEpoch
+		logger.Info(fmt.Sprintf("sentinel: +vote-for-leader %s %d", runId, reqEpoch))
+		if runId != s.myId {
+			// 已经投票给其他 sentinel，一段时间内不发起自己的故障转移
+			m.failoverAt = time.Now()
+		}
+	}
+}
+
+// execHello 处理其他 sentinel 定期发送的 SENTINEL HELLO，内容与 Redis 的 hello 消息相同：
+// ip port runid current-epoch master-name master-ip master-port master-config-epoch
+func (s *Sentinel) execHello(args [][]byte) resp.Reply {
+	if len(args) != 8 {
+		return reply.MakeErrReply("ERR wrong number of arguments for 'sentinel hello'")
+	}
+	port, err1 := strconv.Atoi(string(args[1]))
+	epoch, err2 := strconv.ParseInt(string(args[3]), 10, 64)
+	masterPort, err3 := strconv.Atoi(string(args[6]))
+	configEpoch, err4 := strconv.ParseInt(string(args[7]), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	host, runId, masterName, masterHost := string(args[0]), string(args[2]), string(args[4]), string(args[5])
+	if runId == s.myId {
+		return reply.MakeOkReply()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.addPeer(host, port)
+	p.runId = runId
+	p.lastHello = time.Now()
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+	}
+	m, ok := s.masters[masterName]
+	if ok && configEpoch > m.configEpoch &&
+		(m.master.host != masterHost || m.master.port != masterPort) {
+		// 其他 sentinel 已经完成了故障转移
+		logger.Info(fmt.Sprintf("sentinel: +config-update-from sentinel %s %s", runId, p.link.addr))
+		s.switchMaster(m, masterHost, masterPort, configEpoch)
+	} else if ok && configEpoch > m.configEpoch {
+		m.configEpoch = configEpoch
+	}
+	return reply.MakeOkReply()
+}
+
+// execInfo 输出 INFO 的 sentinel 部分
+func (s *Sentinel) execInfo() resp.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	builder := &strings.Builder{}
+	builder.WriteString("# Sentinel" + reply.CRLF)
+	builder.WriteString(fmt.Sprintf("sentinel_masters:%d%s", len(s.masters), reply.CRLF))
+	for i, m := range s.sortedMasters() {
+		status := "ok"
+		if m.odown {
+			status = "odown"
+		} else if m.sdown {
+			status = "sdown"
+		}
+		builder.WriteString(fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d%s",
+			i, m.name, status, m.master.addr(), len(m.replicas), len(s.peers)+1, reply.CRLF))
+	}
+	return reply.MakeVerbatimReply("txt", []byte(builder.String()))
+}